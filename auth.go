@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiKeyKey = "apiKey"
+
+// keyUseResolution is how out of date a key's last_used_at may get, so that
+// most requests made with it don't each cost a write
+const keyUseResolution = time.Minute
+
+// Scopes an API key can be granted. Each scope includes the ones before it, so
+// a write key can also read and an admin key can do everything.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// scopeOrder ranks the scopes from least to most privileged
+var scopeOrder = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+var (
+	// errInvalidAPIKey is returned when a presented key is unknown or revoked
+	errInvalidAPIKey = errors.New("invalid or revoked API key")
+	// errAPIKeyNotFound is returned when managing a key that doesn't exist or is revoked
+	errAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey describes a stored key. The secret itself is only ever shown once,
+// when the key is created or rotated.
+type APIKey struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	Prefix       string   `json:"prefix"`
+	Scopes       []string `json:"scopes"`
+	DailyQuota   int      `json:"daily_quota"`
+	MonthlyQuota int      `json:"monthly_quota"`
+	CreatedAt    string   `json:"created_at"`
+	LastUsedAt   *string  `json:"last_used_at"`
+	RevokedAt    *string  `json:"revoked_at"`
+}
+
+// HasScope reports whether the key grants scope, directly or through a more privileged scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if scopeGrants(s, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeGrants reports whether having scope have allows what scope want allows
+func scopeGrants(have, want string) bool {
+	i := slices.Index(scopeOrder, want)
+	return i >= 0 && slices.Index(scopeOrder, have) >= i
+}
+
+// parseScopes splits a comma separated scope list, rejecting unknown scopes
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" || slices.Contains(scopes, scope) {
+			continue
+		}
+		if !slices.Contains(scopeOrder, scope) {
+			return nil, fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(scopeOrder, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// hashAPIKey returns the hex SHA-256 of a key secret. Keys are long and random,
+// so a fast hash is enough and lets them be looked up by an index.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret generates a random key and the prefix used to recognise it in listings
+func newAPIKeySecret() (secret, prefix string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	secret = "gk_" + hex.EncodeToString(b)
+	return secret, secret[:11], nil
+}
+
+// apiKeyColumns lists the api_keys columns in the order scanAPIKey expects them
+const apiKeyColumns = "id, name, prefix, scopes, daily_quota, monthly_quota, created_at, last_used_at, revoked_at"
+
+// scanAPIKey reads a single key selected with apiKeyColumns
+func scanAPIKey(s rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	if err := s.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.DailyQuota, &k.MonthlyQuota,
+		&k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+		return APIKey{}, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	return k, nil
+}
+
+// getAPIKey loads a key by ID, returning errAPIKeyNotFound when it doesn't exist
+func getAPIKey(ctx context.Context, db dbtx, id int) (APIKey, error) {
+	k, err := scanAPIKey(db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("failed to query API key: %w", err)
+	}
+	return k, nil
+}
+
+// createAPIKey stores a new key and returns it along with its secret
+func createAPIKey(ctx context.Context, db dbtx, name string, scopes []string) (APIKey, string, error) {
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	res, err := db.ExecContext(ctx, "INSERT INTO api_keys (name, prefix, key_hash, scopes) VALUES (?, ?, ?, ?)",
+		name, prefix, hashAPIKey(secret), strings.Join(scopes, ","))
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("failed to insert API key: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	k, err := getAPIKey(ctx, db, int(id))
+	return k, secret, err
+}
+
+// listAPIKeys returns every key, revoked ones included
+func listAPIKeys(ctx context.Context, db dbtx) ([]APIKey, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return keys, nil
+}
+
+// rotateAPIKey replaces the secret of an active key, invalidating the old one,
+// and returns the key along with its new secret
+func rotateAPIKey(ctx context.Context, db dbtx, id int) (APIKey, string, error) {
+	secret, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	res, err := db.ExecContext(ctx, "UPDATE api_keys SET prefix = ?, key_hash = ? WHERE id = ? AND revoked_at IS NULL",
+		prefix, hashAPIKey(secret), id)
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("failed to rotate API key: %w", err)
+	}
+	if err := expectKeyRow(res); err != nil {
+		return APIKey{}, "", err
+	}
+	k, err := getAPIKey(ctx, db, id)
+	return k, secret, err
+}
+
+// revokeAPIKey permanently disables an active key
+func revokeAPIKey(ctx context.Context, db dbtx, id int) error {
+	res, err := db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return expectKeyRow(res)
+}
+
+// expectKeyRow turns a key update that matched nothing into errAPIKeyNotFound
+func expectKeyRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// authenticateAPIKey resolves a secret to its active key and records its use,
+// to within keyUseResolution
+func authenticateAPIKey(ctx context.Context, db dbtx, secret string) (APIKey, error) {
+	k, err := scanAPIKey(db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL", hashAPIKey(secret)))
+	if err == sql.ErrNoRows {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, fmt.Errorf("failed to query API key: %w", err)
+	}
+	if k.LastUsedAt != nil {
+		if used, err := time.Parse(time.RFC3339Nano, *k.LastUsedAt); err == nil && time.Since(used) < keyUseResolution {
+			return k, nil
+		}
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", k.ID); err != nil {
+		return APIKey{}, fmt.Errorf("failed to record API key use: %w", err)
+	}
+	return k, nil
+}
+
+// requestAPIKey extracts the key secret from the Authorization: Bearer or X-API-Key header
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// Authenticate resolves the API key or user access token sent with a request,
+// if any, and stores it on the context. Anonymous requests pass through; a key
+// or token that doesn't resolve, or the token of an account disabled since it
+// was issued, is answered with 401 rather than being treated as anonymous.
+func Authenticate(db *sql.DB, s *Sessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := requestAPIKey(c.Request)
+		if secret == "" {
+			c.Next()
+			return
+		}
+
+		claims, k, err := resolveSecret(c.Request.Context(), db, s, secret)
+		if err == errInvalidToken || err == errInvalidAPIKey {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if claims != nil {
+			c.Set(userKey, *claims)
+		} else {
+			c.Set(apiKeyKey, *k)
+		}
+		c.Next()
+	}
+}
+
+// resolveSecret looks up a user access token or API key. Exactly one of claims
+// and k is set when err is nil; a secret that doesn't resolve is
+// errInvalidToken or errInvalidAPIKey.
+func resolveSecret(ctx context.Context, db *sql.DB, s *Sessions, secret string) (claims *Claims, k *APIKey, err error) {
+	if looksLikeJWT(secret) {
+		c, err := s.verifyAccessToken(secret)
+		if err == nil {
+			c, err = activeSession(ctx, db, c)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return &c, nil, nil
+	}
+	key, err := authenticateAPIKey(ctx, db, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, &key, nil
+}
+
+// currentAPIKey returns the key Authenticate stored on the context
+func currentAPIKey(c *gin.Context) (APIKey, bool) {
+	k, ok := c.Get(apiKeyKey)
+	if !ok {
+		return APIKey{}, false
+	}
+	return k.(APIKey), true
+}
+
+// RequireScope rejects requests without an API key granting scope or a user
+// session whose role maps to it, with 401 when neither was sent and 403 when
+// the scope is lacking
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claims, ok := currentUser(c); ok {
+			if !scopeGrants(roleScopes[claims.Role], scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("the %s role does not grant the %s scope", claims.Role, scope)})
+				return
+			}
+			c.Next()
+			return
+		}
+
+		k, ok := currentAPIKey(c)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "an API key or user session is required, send it as Authorization: Bearer <token> or X-API-Key"})
+			return
+		}
+		if !k.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasScope reports whether the request's API key or user session grants scope
+func hasScope(c *gin.Context, scope string) bool {
+	if claims, ok := currentUser(c); ok {
+		return scopeGrants(roleScopes[claims.Role], scope)
+	}
+	k, ok := currentAPIKey(c)
+	return ok && k.HasScope(scope)
+}
+
+// apiKeyIDParam parses the :id route parameter of the key admin routes
+func apiKeyIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// keyStatus maps an error from a key store function to its HTTP status code
+func keyStatus(err error) int {
+	if errors.Is(err, errAPIKeyNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// ListAPIKeys lists every API key without their secrets
+func ListAPIKeys(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := listAPIKeys(c.Request.Context(), db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+// CreateAPIKey creates a key from {"name", "scopes", "daily_quota", "monthly_quota"}
+// and returns its secret once
+func CreateAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name         string   `json:"name"`
+			Scopes       []string `json:"scopes"`
+			DailyQuota   int      `json:"daily_quota"`
+			MonthlyQuota int      `json:"monthly_quota"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		scopes, err := parseScopes(strings.Join(req.Scopes, ","))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.DailyQuota < 0 || req.MonthlyQuota < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quotas cannot be negative"})
+			return
+		}
+
+		k, secret, err := createAPIKey(c.Request.Context(), db, name, scopes)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := setAPIKeyQuota(c.Request.Context(), db, k.ID, req.DailyQuota, req.MonthlyQuota); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		k.DailyQuota, k.MonthlyQuota = req.DailyQuota, req.MonthlyQuota
+		c.JSON(http.StatusCreated, gin.H{"key": k, "secret": secret})
+	}
+}
+
+// RotateAPIKey issues a new secret for a key and returns it once
+func RotateAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := apiKeyIDParam(c)
+		if !ok {
+			return
+		}
+		k, secret, err := rotateAPIKey(c.Request.Context(), db, id)
+		if err != nil {
+			c.JSON(keyStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": k, "secret": secret})
+	}
+}
+
+// RevokeAPIKey permanently disables a key
+func RevokeAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := apiKeyIDParam(c)
+		if !ok {
+			return
+		}
+		if err := revokeAPIKey(c.Request.Context(), db, id); err != nil {
+			c.JSON(keyStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	db := newTestDB(t)
+	_, readSecret, err := createAPIKey(t.Context(), db, "reader", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, writeSecret, err := createAPIKey(t.Context(), db, "writer", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)))
+	r.GET("/all", GetAllFirearms(db))
+	r.GET("/sync", RequireScope(ScopeRead), SyncFirearms(db))
+	r.POST("/firearms", RequireScope(ScopeWrite), CreateFirearm(db, testWrites))
+
+	body := `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`
+	tests := []struct {
+		name           string
+		method, target string
+		headers        []string
+		want           int
+	}{
+		{"anonymous read", http.MethodGet, "/all", nil, http.StatusOK},
+		{"unknown key on a read", http.MethodGet, "/all", []string{"X-API-Key", "gk_nope"}, http.StatusUnauthorized},
+		{"anonymous sync", http.MethodGet, "/sync", nil, http.StatusUnauthorized},
+		{"read key syncing", http.MethodGet, "/sync", []string{"X-API-Key", readSecret}, http.StatusOK},
+		{"anonymous write", http.MethodPost, "/firearms", nil, http.StatusUnauthorized},
+		{"read key writing", http.MethodPost, "/firearms", []string{"X-API-Key", readSecret}, http.StatusForbidden},
+		{"write key writing", http.MethodPost, "/firearms", []string{"Authorization", "Bearer " + writeSecret}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		var reqBody string
+		if tt.method == http.MethodPost {
+			reqBody = body
+		}
+		if w := doRequest(r, tt.method, tt.target, reqBody, tt.headers...); w.Code != tt.want {
+			t.Errorf("%s got %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+
+	if k, err := getAPIKey(t.Context(), db, writer.ID); err != nil || k.LastUsedAt == nil {
+		t.Errorf("using the write key didn't record last_used_at: %+v, %v", k, err)
+	}
+
+	// Use within the last minute isn't recorded again
+	for _, tt := range []struct {
+		ago     string
+		written bool
+	}{{"-30 seconds", false}, {"-2 minutes", true}} {
+		if _, err := db.Exec("UPDATE api_keys SET last_used_at = datetime('now', ?) WHERE id = ?", tt.ago, writer.ID); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := getAPIKey(t.Context(), db, writer.ID)
+		doRequest(r, http.MethodGet, "/all", "", "X-API-Key", writeSecret)
+		after, _ := getAPIKey(t.Context(), db, writer.ID)
+		if written := *after.LastUsedAt != *before.LastUsedAt; written != tt.written {
+			t.Errorf("last used %s ago: recorded again %v, want %v", tt.ago, written, tt.written)
+		}
+	}
+
+	// Rotating invalidates the old secret, revoking invalidates the key
+	_, rotated, err := rotateAPIKey(t.Context(), db, writer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, "/all", "", "X-API-Key", writeSecret); w.Code != http.StatusUnauthorized {
+		t.Errorf("old secret after rotation got %d, want 401", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/all", "", "X-API-Key", rotated); w.Code != http.StatusOK {
+		t.Errorf("new secret after rotation got %d, want 200", w.Code)
+	}
+	if err := revokeAPIKey(t.Context(), db, writer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, "/all", "", "X-API-Key", rotated); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key got %d, want 401", w.Code)
+	}
+	if err := revokeAPIKey(t.Context(), db, writer.ID); err != errAPIKeyNotFound {
+		t.Errorf("revoking twice returned %v, want errAPIKeyNotFound", err)
+	}
+}
+
+func TestKeysCommand(t *testing.T) {
+	db := newTestDB(t)
+	var out bytes.Buffer
+
+	if err := runKeysCommand(db, []string{"create", "-name", "ci", "-scopes", "write, admin"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "secret: gk_") {
+		t.Errorf("create printed %q, want the secret", out.String())
+	}
+	keys, err := listAPIKeys(t.Context(), db)
+	if err != nil || len(keys) != 1 || !keys[0].HasScope(ScopeAdmin) || keys[0].Name != "ci" {
+		t.Fatalf("after create the keys are %+v, %v, want one admin key named ci", keys, err)
+	}
+
+	out.Reset()
+	if err := runKeysCommand(db, []string{"list"}, &out); err != nil || !strings.Contains(out.String(), keys[0].Prefix) {
+		t.Errorf("list printed %q, %v, want the key's prefix", out.String(), err)
+	}
+	if err := runKeysCommand(db, []string{"create", "-name", "x", "-scopes", "root"}, &out); err == nil {
+		t.Error("create with an unknown scope succeeded")
+	}
+	if err := runKeysCommand(db, []string{"revoke", "99"}, &out); err != errAPIKeyNotFound {
+		t.Errorf("revoking a missing key returned %v, want errAPIKeyNotFound", err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchOperations caps how many operations a single batch request may carry
+const maxBatchOperations = 500
+
+// Batch modes
+const (
+	// BatchAtomic commits only if every operation succeeds
+	BatchAtomic = "atomic"
+	// BatchBestEffort commits the operations that succeed and reports the rest
+	BatchBestEffort = "best_effort"
+)
+
+// Batch operation kinds
+const (
+	OpCreate = "create"
+	OpUpsert = "upsert"
+	OpPatch  = "patch"
+	OpDelete = "delete"
+)
+
+// BatchRequest is the body of POST /firearms/batch
+type BatchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single write within a batch. Patch and delete address a
+// firearm by ID and need IfMatch, upsert addresses one by the brand and name in
+// Firearm and only checks IfMatch when it's given.
+type BatchOperation struct {
+	Op      string        `json:"op"`
+	ID      int           `json:"id,omitempty"`
+	IfMatch string        `json:"if_match,omitempty"`
+	Firearm *FirearmInput `json:"firearm,omitempty"`
+}
+
+// BatchResult reports the outcome of one operation, in request order
+type BatchResult struct {
+	Index   int      `json:"index"`
+	Op      string   `json:"op"`
+	Status  int      `json:"status"`
+	ID      int      `json:"id,omitempty"`
+	ETag    string   `json:"etag,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Firearm *Firearm `json:"firearm,omitempty"`
+}
+
+// BatchResponse is returned by POST /firearms/batch
+type BatchResponse struct {
+	Mode      string        `json:"mode"`
+	Committed bool          `json:"committed"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// batchError carries the status code an operation failed with
+type batchError struct {
+	status int
+	err    error
+}
+
+func (e *batchError) Error() string { return e.err.Error() }
+
+func batchFail(status int, format string, args ...any) error {
+	return &batchError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// BatchFirearms runs a list of create, upsert, patch and delete operations in one transaction
+func BatchFirearms(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = BatchAtomic
+		}
+		if req.Mode != BatchAtomic && req.Mode != BatchBestEffort {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("mode must be %q or %q", BatchAtomic, BatchBestEffort)})
+			return
+		}
+		if len(req.Operations) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "operations cannot be empty"})
+			return
+		}
+		if len(req.Operations) > maxBatchOperations {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a batch may contain at most %d operations", maxBatchOperations)})
+			return
+		}
+
+		tx, err := db.BeginTx(c.Request.Context(), nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to begin transaction: %v", err)})
+			return
+		}
+		defer tx.Rollback()
+
+		resp := BatchResponse{Mode: req.Mode, Results: make([]BatchResult, len(req.Operations))}
+		for i, op := range req.Operations {
+			resp.Results[i] = runBatchOperation(c.Request.Context(), tx, opts, actorOf(c), i, op)
+			if resp.Results[i].Error != "" {
+				resp.Failed++
+			} else {
+				resp.Succeeded++
+			}
+		}
+
+		// An atomic batch with any failure is rolled back as a whole, so the
+		// operations that did succeed are reported as not applied
+		if req.Mode == BatchAtomic && resp.Failed > 0 {
+			for i := range resp.Results {
+				if resp.Results[i].Error == "" {
+					resp.Results[i] = BatchResult{
+						Index:  i,
+						Op:     resp.Results[i].Op,
+						Status: http.StatusFailedDependency,
+						ID:     req.Operations[i].ID,
+						Error:  "rolled back because another operation in the batch failed",
+					}
+				}
+			}
+			resp.Failed, resp.Succeeded = len(resp.Results), 0
+			c.JSON(http.StatusUnprocessableEntity, resp)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to commit transaction: %v", err)})
+			return
+		}
+		resp.Committed = true
+
+		status := http.StatusOK
+		if resp.Failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		c.JSON(status, resp)
+	}
+}
+
+// runBatchOperation applies one operation inside its own savepoint, so a
+// failure only undoes that operation's changes and revisions
+func runBatchOperation(ctx context.Context, tx *sql.Tx, opts WriteOptions, actor string, index int, op BatchOperation) BatchResult {
+	result := BatchResult{Index: index, Op: op.Op, ID: op.ID}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_op"); err != nil {
+		result.Status = http.StatusInternalServerError
+		result.Error = fmt.Sprintf("failed to create savepoint: %v", err)
+		return result
+	}
+
+	f, status, err := applyBatchOperation(ctx, tx, opts, actor, op)
+	if err != nil {
+		tx.ExecContext(ctx, "ROLLBACK TO batch_op")
+		tx.ExecContext(ctx, "RELEASE batch_op")
+
+		result.Status = http.StatusInternalServerError
+		var be *batchError
+		if errors.As(err, &be) {
+			result.Status = be.status
+		} else if s := writeStatus(err); s != http.StatusInternalServerError {
+			result.Status = s
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	if _, err := tx.ExecContext(ctx, "RELEASE batch_op"); err != nil {
+		result.Status = http.StatusInternalServerError
+		result.Error = fmt.Sprintf("failed to release savepoint: %v", err)
+		return result
+	}
+
+	result.Status = status
+	if f != nil {
+		result.ID = f.ID
+		result.ETag = firearmValidators(*f).ETag
+		result.Firearm = f
+	}
+	return result
+}
+
+// applyBatchOperation performs a single operation, recording its revision, and returns
+// the firearm as it now stands (nil after a delete) along with the status code for the result
+func applyBatchOperation(ctx context.Context, tx *sql.Tx, opts WriteOptions, actor string, op BatchOperation) (*Firearm, int, error) {
+	switch op.Op {
+	case OpCreate:
+		if op.Firearm == nil {
+			return nil, 0, batchFail(http.StatusBadRequest, "firearm is required for %s", op.Op)
+		}
+		if err := op.Firearm.requireAll(); err != nil {
+			return nil, 0, batchFail(http.StatusBadRequest, "%v", err)
+		}
+		var f Firearm
+		op.Firearm.apply(&f)
+		return insertAndReload(ctx, tx, opts, actor, f)
+
+	case OpUpsert:
+		if op.Firearm == nil || op.Firearm.Brand == nil || op.Firearm.Name == nil {
+			return nil, 0, batchFail(http.StatusBadRequest, "firearm with brand and name is required for %s", op.Op)
+		}
+		existing, err := getFirearmByBrandName(ctx, tx, strings.TrimSpace(*op.Firearm.Brand), strings.TrimSpace(*op.Firearm.Name))
+		if err == sql.ErrNoRows {
+			if err := op.Firearm.requireAll(); err != nil {
+				return nil, 0, batchFail(http.StatusBadRequest, "%v", err)
+			}
+			var f Firearm
+			op.Firearm.apply(&f)
+			return insertAndReload(ctx, tx, opts, actor, f)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query database: %w", err)
+		}
+		if existing.DeletedAt != nil {
+			return nil, 0, batchFail(http.StatusConflict, "firearm %d with this brand and name is deleted, restore it first", existing.ID)
+		}
+		if op.IfMatch != "" && !ifMatchMatches(op.IfMatch, existing) {
+			return nil, 0, batchFail(http.StatusPreconditionFailed, "%v", errStaleETag)
+		}
+		before := existing
+		op.Firearm.apply(&existing)
+		return updateAndReload(ctx, tx, opts, actor, before, existing)
+
+	case OpPatch, OpDelete:
+		if op.ID == 0 {
+			return nil, 0, batchFail(http.StatusBadRequest, "id is required for %s", op.Op)
+		}
+		if op.Op == OpPatch && op.Firearm == nil {
+			return nil, 0, batchFail(http.StatusBadRequest, "firearm is required for %s", op.Op)
+		}
+		existing, err := getFirearm(ctx, tx, op.ID)
+		if err == sql.ErrNoRows {
+			return nil, 0, batchFail(http.StatusNotFound, "no firearm found with id: %d", op.ID)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query database: %w", err)
+		}
+		if op.IfMatch == "" {
+			return nil, 0, batchFail(http.StatusPreconditionRequired, "if_match with the firearm's current ETag is required for %s", op.Op)
+		}
+		if !ifMatchMatches(op.IfMatch, existing) {
+			return nil, 0, batchFail(http.StatusPreconditionFailed, "%v", errStaleETag)
+		}
+
+		if op.Op == OpDelete {
+			if err := deleteFirearm(ctx, tx, existing.ID, existing.Version); err != nil {
+				return nil, 0, err
+			}
+			if err := recordRevision(ctx, tx, opts, actor, RevisionDelete, &existing, nil); err != nil {
+				return nil, 0, err
+			}
+			return nil, http.StatusNoContent, nil
+		}
+		before := existing
+		op.Firearm.apply(&existing)
+		return updateAndReload(ctx, tx, opts, actor, before, existing)
+
+	default:
+		return nil, 0, batchFail(http.StatusBadRequest, "unknown op %q, expected one of %s, %s, %s or %s", op.Op, OpCreate, OpUpsert, OpPatch, OpDelete)
+	}
+}
+
+// insertAndReload validates and inserts f, returning the stored row
+func insertAndReload(ctx context.Context, tx *sql.Tx, opts WriteOptions, actor string, f Firearm) (*Firearm, int, error) {
+	if err := validateFirearm(f); err != nil {
+		return nil, 0, batchFail(http.StatusBadRequest, "%v", err)
+	}
+	id, err := insertFirearm(ctx, tx, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	created, err := getFirearm(ctx, tx, id)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query database: %w", err)
+	}
+	if err := recordRevision(ctx, tx, opts, actor, RevisionCreate, nil, &created); err != nil {
+		return nil, 0, err
+	}
+	return &created, http.StatusCreated, nil
+}
+
+// updateAndReload validates and updates f, which was before until now, returning the stored row
+func updateAndReload(ctx context.Context, tx *sql.Tx, opts WriteOptions, actor string, before, f Firearm) (*Firearm, int, error) {
+	if err := validateFirearm(f); err != nil {
+		return nil, 0, batchFail(http.StatusBadRequest, "%v", err)
+	}
+	updated, err := saveFirearm(ctx, tx, opts, actor, before, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &updated, http.StatusOK, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tableCount counts a table's rows
+func tableCount(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBatchModes(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	r := gin.New()
+	r.POST("/firearms/batch", BatchFirearms(db, testWrites))
+
+	// The create succeeds on its own but the patch has a stale If-Match
+	body := func(mode string) string {
+		return `{"mode": "` + mode + `", "operations": [
+			{"op": "create", "firearm": {"brand": "Colt", "name": "M1911", "caliber": ".45 ACP", "type": "pistol",
+				"magazine_capacity": 7, "effective_range": 50, "year": 1911, "price": 900}},
+			{"op": "patch", "id": ` + strconv.Itoa(f.ID) + `, "if_match": "\"stale\"", "firearm": {"price": 1}}
+		]}`
+	}
+
+	w := doRequest(r, http.MethodPost, "/firearms/batch", body(BatchAtomic))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("atomic batch with a failure got %d, want 422: %s", w.Code, w.Body)
+	}
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Committed || resp.Succeeded != 0 || resp.Failed != 2 {
+		t.Errorf("atomic batch reported committed %v, %d succeeded and %d failed, want nothing committed and 2 failed", resp.Committed, resp.Succeeded, resp.Failed)
+	}
+	if got := resp.Results[0].Status; got != http.StatusFailedDependency {
+		t.Errorf("rolled back create reported %d, want 424", got)
+	}
+	if got := resp.Results[1].Status; got != http.StatusPreconditionFailed {
+		t.Errorf("stale patch reported %d, want 412", got)
+	}
+	if n := tableCount(t, db, "firearms"); n != 1 {
+		t.Errorf("firearms has %d rows after a rolled back batch, want 1", n)
+	}
+
+	w = doRequest(r, http.MethodPost, "/firearms/batch", body(BatchBestEffort))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("best effort batch with a failure got %d, want 207: %s", w.Code, w.Body)
+	}
+	resp = BatchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Committed || resp.Succeeded != 1 || resp.Failed != 1 {
+		t.Errorf("best effort batch reported committed %v, %d succeeded and %d failed, want committed with 1 and 1", resp.Committed, resp.Succeeded, resp.Failed)
+	}
+	if _, err := getFirearmByBrandName(t.Context(), db, "Colt", "M1911"); err != nil {
+		t.Errorf("best effort create wasn't committed: %v", err)
+	}
+	if current, err := getFirearm(t.Context(), db, f.ID); err != nil || current.Price != f.Price {
+		t.Errorf("failed patch changed the firearm: %+v, %v", current, err)
+	}
+}
+
+func TestBatchUpsert(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	r := gin.New()
+	r.POST("/firearms/batch", BatchFirearms(db, testWrites))
+
+	// Upsert updates the firearm with the same brand and name and creates the others
+	w := doRequest(r, http.MethodPost, "/firearms/batch", `{"operations": [
+		{"op": "upsert", "firearm": {"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+			"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 600}},
+		{"op": "upsert", "firearm": {"brand": "Colt", "name": "M1911", "caliber": ".45 ACP", "type": "pistol",
+			"magazine_capacity": 7, "effective_range": 50, "year": 1911, "price": 900}}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upsert batch got %d: %s", w.Code, w.Body)
+	}
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Committed || resp.Results[0].Status != http.StatusOK || resp.Results[1].Status != http.StatusCreated {
+		t.Errorf("upsert batch answered %+v, want committed with 200 then 201", resp)
+	}
+	if updated, err := getFirearm(t.Context(), db, f.ID); err != nil || updated.Price != 600 || updated.Version != f.Version+1 {
+		t.Errorf("upserted firearm is %+v, %v, want price 600 at the next version", updated, err)
+	}
+	if n := tableCount(t, db, "firearms"); n != 2 {
+		t.Errorf("firearms has %d rows, want 2", n)
+	}
+}
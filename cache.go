@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	cacheControlKey = "cacheControl"
+	validatorsKey   = "validators"
+)
+
+// Validators holds the ETag and Last-Modified values describing a response
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// strongETag hashes the given parts into a quoted strong entity tag
+func strongETag(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// firearmValidators derives the validators of a single firearm from its version and updated_at
+func firearmValidators(f Firearm) Validators {
+	lastModified, _ := time.Parse(time.RFC3339Nano, f.UpdatedAt)
+	return Validators{
+		ETag:         strongETag(fmt.Sprint(f.ID), fmt.Sprint(f.Version), f.UpdatedAt),
+		LastModified: lastModified,
+	}
+}
+
+// listValidators derives the validators of a list response from the firearms table version,
+// and the citations table version when sources are included, so an unchanged
+// table lets the request be answered without running its query
+func listValidators(db *sql.DB, r *http.Request) (Validators, error) {
+	version, updatedAt, err := tableVersion(r.Context(), db, "firearms")
+	if err != nil {
+		return Validators{}, err
+	}
+	v := Validators{
+		ETag:         strongETag(fmt.Sprint(version), r.URL.Path, r.URL.RawQuery),
+		LastModified: updatedAt,
+	}
+	// An invalid ?include is left for the handler to reject
+	if withSources, _ := wantsSources(r); withSources {
+		return withCitationsVersion(r.Context(), db, v)
+	}
+	return v, nil
+}
+
+// CacheControl sets how long the successful responses of a route may be cached
+func CacheControl(maxAge time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(cacheControlKey, maxAge)
+		c.Next()
+	}
+}
+
+// cacheControl builds the Cache-Control value of a response. Anonymous reads
+// are the same for everyone and may be kept by shared caches, responses to
+// an authenticated caller or with ?include_deleted only by theirs.
+func cacheControl(c *gin.Context, maxAge time.Duration) string {
+	visibility := "public"
+	_, user := currentUser(c)
+	_, key := currentAPIKey(c)
+	if user || key || includeDeleted(c) {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int(maxAge.Seconds()))
+}
+
+// ConditionalList answers list routes with 304 Not Modified while the firearms table is unchanged
+func ConditionalList(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, err := listValidators(db, c.Request)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(validatorsKey, v)
+
+		if notModified(c, v) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// writeValidators sets the ETag, Last-Modified and Cache-Control headers for a response
+func writeValidators(c *gin.Context, v Validators) {
+	if v.ETag != "" {
+		c.Header("ETag", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		c.Header("Last-Modified", v.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if maxAge, ok := c.Get(cacheControlKey); ok {
+		c.Header("Cache-Control", cacheControl(c, maxAge.(time.Duration)))
+		c.Writer.Header().Add("Vary", "Authorization, X-API-Key")
+	}
+}
+
+// notModified writes a 304 response and returns true when the request's
+// If-None-Match or If-Modified-Since header matches the validators
+func notModified(c *gin.Context, v Validators) (hit bool) {
+	defer func() { recordCacheResult(c, hit) }()
+
+	// If-None-Match takes precedence over If-Modified-Since when both are sent
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if !etagListMatches(inm, v.ETag) {
+			return false
+		}
+	} else if ims := c.GetHeader("If-Modified-Since"); ims != "" && !v.LastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || v.LastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	writeValidators(c, v)
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// etagListMatches reports whether a comma separated If-None-Match list contains etag,
+// using the weak comparison required for GET requests
+func etagListMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// respondOK writes a 200 JSON response along with any validators computed for the request
+func respondOK(c *gin.Context, body any) {
+	if v, ok := c.Get(validatorsKey); ok {
+		writeValidators(c, v.(Validators))
+	}
+	if n, ok := sliceLen(body); ok {
+		setResultCount(c, n)
+	}
+	renderJSON(c, http.StatusOK, body)
+}
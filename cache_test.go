@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConditionalList(t *testing.T) {
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	r := gin.New()
+	lists := r.Group("/", CacheControl(time.Minute), ConditionalList(db))
+	lists.GET("/brand/:brand", GetFirearmsByBrand(db))
+
+	first := doRequest(r, http.MethodGet, "/brand/Glock", "")
+	etag := first.Header().Get("ETag")
+	lastModified := first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("got %d with ETag %q and Last-Modified %q, want 200 with both", first.Code, etag, lastModified)
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("Cache-Control = %q, want public, max-age=60", cc)
+	}
+
+	for _, tt := range []struct{ header, value string }{
+		{"If-None-Match", etag},
+		{"If-None-Match", `"other", W/` + etag},
+		{"If-None-Match", "*"},
+		{"If-Modified-Since", lastModified},
+	} {
+		w := doRequest(r, http.MethodGet, "/brand/Glock", "", tt.header, tt.value)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: %s got %d with %d bytes, want an empty 304", tt.header, tt.value, w.Code, w.Body.Len())
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("%s: %s answered with ETag %q, want %q", tt.header, tt.value, got, etag)
+		}
+	}
+
+	// If-None-Match wins over If-Modified-Since, and an earlier date doesn't match
+	if w := doRequest(r, http.MethodGet, "/brand/Glock", "", "If-None-Match", `"other"`, "If-Modified-Since", lastModified); w.Code != http.StatusOK {
+		t.Errorf("mismatched If-None-Match with a matching If-Modified-Since got %d, want 200", w.Code)
+	}
+	earlier := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+	if w := doRequest(r, http.MethodGet, "/brand/Glock", "", "If-Modified-Since", earlier); w.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since a day ago got %d, want 200", w.Code)
+	}
+
+	// Any write to the table changes every list's ETag
+	addTestFirearm(t, db, "Colt", "M1911", 1911, 900)
+	w := doRequest(r, http.MethodGet, "/brand/Glock", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("after a write got %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag did not change after a write")
+	}
+}
+
+func TestConditionalFirearm(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	r := gin.New()
+	r.GET("/id/:id", CacheControl(5*time.Minute), GetFirearmByID(db))
+
+	first := doRequest(r, http.MethodGet, "/id/1", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag != firearmValidators(f).ETag {
+		t.Fatalf("got %d with ETag %q, want 200 with %q", first.Code, etag, firearmValidators(f).ETag)
+	}
+	if w := doRequest(r, http.MethodGet, "/id/1", "", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match got %d, want 304", w.Code)
+	}
+
+	// updated_at only has second precision, so the edit is dated explicitly
+	if _, err := db.Exec("UPDATE firearms SET price = 600, updated_at = '2030-01-01 00:00:00' WHERE id = ?", f.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := doRequest(r, http.MethodGet, "/id/1", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after an update got %d with ETag %q, want 200 with a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestCacheControlVisibility(t *testing.T) {
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	_, adminSecret, err := createAPIKey(t.Context(), db, "admin", []string{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)), IncludeDeleted())
+	r.GET("/all", CacheControl(time.Minute), ConditionalList(db), GetAllFirearms(db))
+
+	// Only what anonymous callers see may be stored by shared caches
+	for _, tt := range []struct {
+		target  string
+		headers []string
+		want    string
+	}{
+		{"/all", nil, "public, max-age=60"},
+		{"/all", []string{"X-API-Key", adminSecret}, "private, max-age=60"},
+		{"/all?include_deleted=true", []string{"X-API-Key", adminSecret}, "private, max-age=60"},
+	} {
+		w := doRequest(r, http.MethodGet, tt.target, "", tt.headers...)
+		if cc := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || cc != tt.want {
+			t.Errorf("%s with %d headers got %d with Cache-Control %q, want %q", tt.target, len(tt.headers)/2, w.Code, cc, tt.want)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Authorization, X-API-Key" {
+			t.Errorf("%s Vary = %q", tt.target, vary)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: catalog/v1/catalog.proto
+
+package catalogpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FirearmCatalog_GetFirearm_FullMethodName     = "/catalog.v1.FirearmCatalog/GetFirearm"
+	FirearmCatalog_ListFirearms_FullMethodName   = "/catalog.v1.FirearmCatalog/ListFirearms"
+	FirearmCatalog_SearchFirearms_FullMethodName = "/catalog.v1.FirearmCatalog/SearchFirearms"
+	FirearmCatalog_GetStats_FullMethodName       = "/catalog.v1.FirearmCatalog/GetStats"
+	FirearmCatalog_WatchFirearms_FullMethodName  = "/catalog.v1.FirearmCatalog/WatchFirearms"
+)
+
+// FirearmCatalogClient is the client API for FirearmCatalog service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FirearmCatalog reads the catalog over gRPC. It is served from the same
+// database as the HTTP API. The google.api.http annotations describe a
+// separate REST surface under /v1 for a grpc-gateway run in front of the gRPC
+// port: the HTTP API doesn't serve those paths, and its own routes such as
+// /id/:id and /all keep their own shapes.
+type FirearmCatalogClient interface {
+	// GetFirearm returns a live firearm, or NOT_FOUND.
+	GetFirearm(ctx context.Context, in *GetFirearmRequest, opts ...grpc.CallOption) (*Firearm, error)
+	// ListFirearms pages through the firearms matching a filter, which matches
+	// like the REST list routes do.
+	ListFirearms(ctx context.Context, in *ListFirearmsRequest, opts ...grpc.CallOption) (*ListFirearmsResponse, error)
+	// SearchFirearms pages through the firearms whose brand, name, caliber,
+	// type, manufacturer or country contains every word of the query.
+	SearchFirearms(ctx context.Context, in *SearchFirearmsRequest, opts ...grpc.CallOption) (*SearchFirearmsResponse, error)
+	// GetStats summarizes the live catalog.
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// WatchFirearms streams catalog changes as they happen, the same changes
+	// GET /events sends. Setting last_event_id first replays every change after it.
+	WatchFirearms(ctx context.Context, in *WatchFirearmsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FirearmChange], error)
+}
+
+type firearmCatalogClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFirearmCatalogClient(cc grpc.ClientConnInterface) FirearmCatalogClient {
+	return &firearmCatalogClient{cc}
+}
+
+func (c *firearmCatalogClient) GetFirearm(ctx context.Context, in *GetFirearmRequest, opts ...grpc.CallOption) (*Firearm, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Firearm)
+	err := c.cc.Invoke(ctx, FirearmCatalog_GetFirearm_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *firearmCatalogClient) ListFirearms(ctx context.Context, in *ListFirearmsRequest, opts ...grpc.CallOption) (*ListFirearmsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListFirearmsResponse)
+	err := c.cc.Invoke(ctx, FirearmCatalog_ListFirearms_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *firearmCatalogClient) SearchFirearms(ctx context.Context, in *SearchFirearmsRequest, opts ...grpc.CallOption) (*SearchFirearmsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SearchFirearmsResponse)
+	err := c.cc.Invoke(ctx, FirearmCatalog_SearchFirearms_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *firearmCatalogClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, FirearmCatalog_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *firearmCatalogClient) WatchFirearms(ctx context.Context, in *WatchFirearmsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FirearmChange], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FirearmCatalog_ServiceDesc.Streams[0], FirearmCatalog_WatchFirearms_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchFirearmsRequest, FirearmChange]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FirearmCatalog_WatchFirearmsClient = grpc.ServerStreamingClient[FirearmChange]
+
+// FirearmCatalogServer is the server API for FirearmCatalog service.
+// All implementations must embed UnimplementedFirearmCatalogServer
+// for forward compatibility.
+//
+// FirearmCatalog reads the catalog over gRPC. It is served from the same
+// database as the HTTP API. The google.api.http annotations describe a
+// separate REST surface under /v1 for a grpc-gateway run in front of the gRPC
+// port: the HTTP API doesn't serve those paths, and its own routes such as
+// /id/:id and /all keep their own shapes.
+type FirearmCatalogServer interface {
+	// GetFirearm returns a live firearm, or NOT_FOUND.
+	GetFirearm(context.Context, *GetFirearmRequest) (*Firearm, error)
+	// ListFirearms pages through the firearms matching a filter, which matches
+	// like the REST list routes do.
+	ListFirearms(context.Context, *ListFirearmsRequest) (*ListFirearmsResponse, error)
+	// SearchFirearms pages through the firearms whose brand, name, caliber,
+	// type, manufacturer or country contains every word of the query.
+	SearchFirearms(context.Context, *SearchFirearmsRequest) (*SearchFirearmsResponse, error)
+	// GetStats summarizes the live catalog.
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// WatchFirearms streams catalog changes as they happen, the same changes
+	// GET /events sends. Setting last_event_id first replays every change after it.
+	WatchFirearms(*WatchFirearmsRequest, grpc.ServerStreamingServer[FirearmChange]) error
+	mustEmbedUnimplementedFirearmCatalogServer()
+}
+
+// UnimplementedFirearmCatalogServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFirearmCatalogServer struct{}
+
+func (UnimplementedFirearmCatalogServer) GetFirearm(context.Context, *GetFirearmRequest) (*Firearm, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFirearm not implemented")
+}
+func (UnimplementedFirearmCatalogServer) ListFirearms(context.Context, *ListFirearmsRequest) (*ListFirearmsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFirearms not implemented")
+}
+func (UnimplementedFirearmCatalogServer) SearchFirearms(context.Context, *SearchFirearmsRequest) (*SearchFirearmsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchFirearms not implemented")
+}
+func (UnimplementedFirearmCatalogServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedFirearmCatalogServer) WatchFirearms(*WatchFirearmsRequest, grpc.ServerStreamingServer[FirearmChange]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchFirearms not implemented")
+}
+func (UnimplementedFirearmCatalogServer) mustEmbedUnimplementedFirearmCatalogServer() {}
+func (UnimplementedFirearmCatalogServer) testEmbeddedByValue()                        {}
+
+// UnsafeFirearmCatalogServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FirearmCatalogServer will
+// result in compilation errors.
+type UnsafeFirearmCatalogServer interface {
+	mustEmbedUnimplementedFirearmCatalogServer()
+}
+
+func RegisterFirearmCatalogServer(s grpc.ServiceRegistrar, srv FirearmCatalogServer) {
+	// If the following call pancis, it indicates UnimplementedFirearmCatalogServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FirearmCatalog_ServiceDesc, srv)
+}
+
+func _FirearmCatalog_GetFirearm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFirearmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FirearmCatalogServer).GetFirearm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FirearmCatalog_GetFirearm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FirearmCatalogServer).GetFirearm(ctx, req.(*GetFirearmRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FirearmCatalog_ListFirearms_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFirearmsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FirearmCatalogServer).ListFirearms(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FirearmCatalog_ListFirearms_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FirearmCatalogServer).ListFirearms(ctx, req.(*ListFirearmsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FirearmCatalog_SearchFirearms_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchFirearmsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FirearmCatalogServer).SearchFirearms(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FirearmCatalog_SearchFirearms_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FirearmCatalogServer).SearchFirearms(ctx, req.(*SearchFirearmsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FirearmCatalog_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FirearmCatalogServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FirearmCatalog_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FirearmCatalogServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FirearmCatalog_WatchFirearms_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchFirearmsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FirearmCatalogServer).WatchFirearms(m, &grpc.GenericServerStream[WatchFirearmsRequest, FirearmChange]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FirearmCatalog_WatchFirearmsServer = grpc.ServerStreamingServer[FirearmChange]
+
+// FirearmCatalog_ServiceDesc is the grpc.ServiceDesc for FirearmCatalog service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FirearmCatalog_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "catalog.v1.FirearmCatalog",
+	HandlerType: (*FirearmCatalogServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFirearm",
+			Handler:    _FirearmCatalog_GetFirearm_Handler,
+		},
+		{
+			MethodName: "ListFirearms",
+			Handler:    _FirearmCatalog_ListFirearms_Handler,
+		},
+		{
+			MethodName: "SearchFirearms",
+			Handler:    _FirearmCatalog_SearchFirearms_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _FirearmCatalog_GetStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchFirearms",
+			Handler:       _FirearmCatalog_WatchFirearms_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "catalog/v1/catalog.proto",
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// eventPollInterval is how often changelog followers look for new changes
+var eventPollInterval = time.Second
+
+// eventBatchSize is how many changes followers read from the changelog at once
+const eventBatchSize = 500
+
+// Change event types
+const (
+	EventFirearmCreated = "firearm.created"
+	EventFirearmUpdated = "firearm.updated"
+	EventFirearmDeleted = "firearm.deleted"
+)
+
+// ChangeEvent announces one change to the catalog. The firearm_revisions table
+// doubles as the changelog: an event's ID is the revision that recorded the
+// change, so IDs only ever grow and consumers can pick up after the last one
+// they saw.
+type ChangeEvent struct {
+	ID         int      `json:"id"`
+	Type       string   `json:"type"`
+	FirearmID  int      `json:"firearm_id"`
+	Actor      string   `json:"actor,omitempty"`
+	OccurredAt string   `json:"occurred_at"`
+	Before     *Firearm `json:"before"`
+	After      *Firearm `json:"after"`
+}
+
+// eventType names the event a revision announces. Restoring a deleted firearm
+// creates it again as far as consumers are concerned.
+func eventType(before, after *Firearm) string {
+	switch {
+	case before == nil:
+		return EventFirearmCreated
+	case after == nil:
+		return EventFirearmDeleted
+	default:
+		return EventFirearmUpdated
+	}
+}
+
+// changeEvent describes a revision as a change event
+func changeEvent(r Revision) ChangeEvent {
+	return ChangeEvent{
+		ID:         r.ID,
+		Type:       eventType(r.Before, r.After),
+		FirearmID:  r.FirearmID,
+		Actor:      r.Actor,
+		OccurredAt: r.CreatedAt,
+		Before:     r.Before,
+		After:      r.After,
+	}
+}
+
+// listChangesSince returns up to limit change events after the given ID, oldest first
+func listChangesSince(ctx context.Context, db dbtx, since, limit int) ([]ChangeEvent, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+revisionColumns+" FROM firearm_revisions WHERE id > ? ORDER BY id LIMIT ?", since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query changes: %w", err)
+	}
+	defer rows.Close()
+
+	events := []ChangeEvent{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		events = append(events, changeEvent(r))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return events, nil
+}
+
+// latestChange returns the ID of the most recent change event, 0 when there is none
+func latestChange(ctx context.Context, db dbtx) (int, error) {
+	var id sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(id) FROM firearm_revisions").Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to query latest change: %w", err)
+	}
+	return int(id.Int64), nil
+}
+
+// followChanges follows the changelog after last for GET /events and
+// WatchFirearms, handing send every batch of changes oldest first. It reads
+// batches back to back while catching up, then polls every
+// eventPollInterval, calling send with no changes when a poll finds none so
+// idle connections can be kept alive. It returns nil once ctx is done or
+// stop is closed, or the first error reading the changelog or from send.
+func followChanges(ctx context.Context, db dbtx, last int, stop <-chan struct{}, send func([]ChangeEvent) error) error {
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	for {
+		events, err := listChangesSince(ctx, db, last, eventBatchSize)
+		if err != nil {
+			return err
+		}
+		if err := send(events); err != nil {
+			return err
+		}
+		if len(events) > 0 {
+			last = events[len(events)-1].ID
+		}
+		// A full batch means there is more to catch up on right away
+		if len(events) == eventBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-poll.C:
+		}
+	}
+}
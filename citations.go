@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Citation confidence levels
+const (
+	ConfidenceLow    = "low"
+	ConfidenceMedium = "medium"
+	ConfidenceHigh   = "high"
+)
+
+// errDuplicateCitation is returned when a field already cites a source
+var errDuplicateCitation = errors.New("this field already cites that source")
+
+// Source is a publication or page firearm data is taken from
+type Source struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	Publisher  string  `json:"publisher"`
+	URL        *string `json:"url"`
+	ISBN       *string `json:"isbn"`
+	AccessedOn *string `json:"accessed_on"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// Citation links one field of a firearm to a source backing its value
+type Citation struct {
+	ID         int    `json:"id"`
+	FirearmID  int    `json:"firearm_id"`
+	Field      string `json:"field"`
+	Confidence string `json:"confidence"`
+	Note       string `json:"note"`
+	CreatedAt  string `json:"created_at"`
+	Source     Source `json:"source"`
+}
+
+// CitedFirearm is a firearm along with the citations of its fields, keyed by field name
+type CitedFirearm struct {
+	Firearm
+	Sources map[string][]Citation `json:"sources"`
+}
+
+// SourceInput is the body of POST /sources. A source needs a URL or an ISBN
+// so readers can find it, and accessed_on is a YYYY-MM-DD date.
+type SourceInput struct {
+	Title      string `json:"title"`
+	Publisher  string `json:"publisher"`
+	URL        string `json:"url"`
+	ISBN       string `json:"isbn"`
+	AccessedOn string `json:"accessed_on"`
+}
+
+// source validates the input and returns the source it describes
+func (in SourceInput) source() (Source, error) {
+	s := Source{Title: strings.TrimSpace(in.Title), Publisher: strings.TrimSpace(in.Publisher)}
+	if s.Title == "" {
+		return Source{}, errors.New("title cannot be empty")
+	}
+
+	if raw := strings.TrimSpace(in.URL); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Source{}, fmt.Errorf("url %q must be an absolute http or https URL", raw)
+		}
+		s.URL = &raw
+	}
+	if raw := strings.TrimSpace(in.ISBN); raw != "" {
+		isbn, err := normalizeISBN(raw)
+		if err != nil {
+			return Source{}, err
+		}
+		s.ISBN = &isbn
+	}
+	if s.URL == nil && s.ISBN == nil {
+		return Source{}, errors.New("a source needs a url or an isbn")
+	}
+
+	if raw := strings.TrimSpace(in.AccessedOn); raw != "" {
+		if _, err := time.Parse(time.DateOnly, raw); err != nil {
+			return Source{}, fmt.Errorf("accessed_on %q must be a YYYY-MM-DD date", raw)
+		}
+		s.AccessedOn = &raw
+	}
+	return s, nil
+}
+
+// normalizeISBN strips the hyphens and spaces from an ISBN-10 or ISBN-13 and
+// checks its check digit
+func normalizeISBN(raw string) (string, error) {
+	isbn := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(raw))
+	invalid := fmt.Errorf("isbn %q is not a valid ISBN-10 or ISBN-13", raw)
+
+	sum := 0
+	switch len(isbn) {
+	case 10:
+		for i, r := range isbn {
+			d := int(r - '0')
+			if r == 'X' && i == 9 {
+				d = 10
+			} else if r < '0' || r > '9' {
+				return "", invalid
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", invalid
+		}
+	case 13:
+		for i, r := range isbn {
+			if r < '0' || r > '9' {
+				return "", invalid
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(r-'0')
+		}
+		if sum%10 != 0 {
+			return "", invalid
+		}
+	default:
+		return "", invalid
+	}
+	return isbn, nil
+}
+
+// citableField reports whether name is a catalog field of Firearm that can be cited
+func citableField(name string) bool {
+	t := reflect.TypeOf(Firearm{})
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return !bookkeepingField(name)
+		}
+	}
+	return false
+}
+
+// sourceColumns lists the sources columns in the order scanSource expects them
+const sourceColumns = "id, title, publisher, url, isbn, accessed_on, created_at"
+
+func scanSource(s rowScanner) (Source, error) {
+	var src Source
+	err := s.Scan(&src.ID, &src.Title, &src.Publisher, &src.URL, &src.ISBN, &src.AccessedOn, &src.CreatedAt)
+	return src, err
+}
+
+// getSource loads a source, returning sql.ErrNoRows when it doesn't exist
+func getSource(ctx context.Context, db dbtx, id int) (Source, error) {
+	return scanSource(db.QueryRowContext(ctx, "SELECT "+sourceColumns+" FROM sources WHERE id = ?", id))
+}
+
+// listSources returns every source, oldest first
+func listSources(ctx context.Context, db dbtx) ([]Source, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+sourceColumns+" FROM sources ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sources: %w", err)
+	}
+	defer rows.Close()
+
+	sources := []Source{}
+	for rows.Next() {
+		src, err := scanSource(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		sources = append(sources, src)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return sources, nil
+}
+
+// createSource stores a validated source
+func createSource(ctx context.Context, db dbtx, src Source) (Source, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO sources (title, publisher, url, isbn, accessed_on) VALUES (?, ?, ?, ?, ?)",
+		src.Title, src.Publisher, src.URL, src.ISBN, src.AccessedOn)
+	if err != nil {
+		return Source{}, fmt.Errorf("failed to insert source: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Source{}, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return getSource(ctx, db, int(id))
+}
+
+// citationQuery selects citations joined with their sources, in the order scanCitation expects
+const citationQuery = `
+	SELECT c.id, c.firearm_id, c.field, c.confidence, c.note, c.created_at,
+		s.id, s.title, s.publisher, s.url, s.isbn, s.accessed_on, s.created_at
+	FROM firearm_citations c JOIN sources s ON s.id = c.source_id`
+
+func scanCitation(s rowScanner) (Citation, error) {
+	var ct Citation
+	src := &ct.Source
+	err := s.Scan(&ct.ID, &ct.FirearmID, &ct.Field, &ct.Confidence, &ct.Note, &ct.CreatedAt,
+		&src.ID, &src.Title, &src.Publisher, &src.URL, &src.ISBN, &src.AccessedOn, &src.CreatedAt)
+	return ct, err
+}
+
+// getCitation loads one citation of a firearm, returning sql.ErrNoRows when it doesn't exist
+func getCitation(ctx context.Context, db dbtx, firearmID, id int) (Citation, error) {
+	return scanCitation(db.QueryRowContext(ctx, citationQuery+" WHERE c.firearm_id = ? AND c.id = ?", firearmID, id))
+}
+
+// addCitation cites a source for a field of a firearm
+func addCitation(ctx context.Context, db dbtx, ct Citation) (Citation, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO firearm_citations (firearm_id, field, source_id, confidence, note) VALUES (?, ?, ?, ?, ?)",
+		ct.FirearmID, ct.Field, ct.Source.ID, ct.Confidence, ct.Note)
+	if isUniqueViolation(err) {
+		return Citation{}, errDuplicateCitation
+	}
+	if err != nil {
+		return Citation{}, fmt.Errorf("failed to insert citation: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Citation{}, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return getCitation(ctx, db, ct.FirearmID, int(id))
+}
+
+// deleteCitation removes a citation from a firearm, returning sql.ErrNoRows when it doesn't exist
+func deleteCitation(ctx context.Context, db dbtx, firearmID, id int) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM firearm_citations WHERE firearm_id = ? AND id = ?", firearmID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete citation: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// citationsFor returns the citations of the given firearms in one query,
+// grouped by firearm and then by field
+func citationsFor(ctx context.Context, db dbtx, firearmIDs []int) (map[int]map[string][]Citation, error) {
+	cited := make(map[int]map[string][]Citation, len(firearmIDs))
+	if len(firearmIDs) == 0 {
+		return cited, nil
+	}
+	placeholders := make([]string, len(firearmIDs))
+	args := make([]any, len(firearmIDs))
+	for i, id := range firearmIDs {
+		placeholders[i], args[i] = "?", id
+	}
+
+	rows, err := db.QueryContext(ctx, citationQuery+" WHERE c.firearm_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY c.field, c.id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query citations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ct, err := scanCitation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if cited[ct.FirearmID] == nil {
+			cited[ct.FirearmID] = make(map[string][]Citation)
+		}
+		cited[ct.FirearmID][ct.Field] = append(cited[ct.FirearmID][ct.Field], ct)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return cited, nil
+}
+
+// fieldCitations returns a firearm's citations from citationsFor, never nil so
+// a firearm without any encodes as an empty object
+func fieldCitations(cited map[int]map[string][]Citation, firearmID int) map[string][]Citation {
+	if fields := cited[firearmID]; fields != nil {
+		return fields
+	}
+	return map[string][]Citation{}
+}
+
+// wantsSources reports whether a request asked for ?include=sources. It's the
+// only thing that can be included so far, anything else is rejected.
+func wantsSources(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("include")
+	sources := false
+	for _, part := range strings.Split(raw, ",") {
+		switch strings.TrimSpace(part) {
+		case "":
+		case "sources":
+			sources = true
+		default:
+			return false, fmt.Errorf("cannot include %q, only sources", strings.TrimSpace(part))
+		}
+	}
+	return sources, nil
+}
+
+// includeSources is wantsSources for handlers, responding with a 400 when ?include is invalid
+func includeSources(c *gin.Context) (include, ok bool) {
+	include, err := wantsSources(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false, false
+	}
+	return include, true
+}
+
+// withCitationsVersion folds the citations table version into validators, so
+// responses that include sources change whenever a citation does
+func withCitationsVersion(ctx context.Context, db *sql.DB, v Validators) (Validators, error) {
+	version, updatedAt, err := tableVersion(ctx, db, "citations")
+	if err != nil {
+		return Validators{}, err
+	}
+	v.ETag = strongETag(v.ETag, fmt.Sprint(version))
+	if updatedAt.After(v.LastModified) {
+		v.LastModified = updatedAt
+	}
+	return v, nil
+}
+
+// ListSources lists every source
+func ListSources(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sources, err := listSources(c.Request.Context(), db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, sources)
+	}
+}
+
+// GetSource retrieves a single source
+func GetSource(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+			return
+		}
+		src, err := getSource(c.Request.Context(), db, id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no source found with id: %d", id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, src)
+	}
+}
+
+// CreateSource adds a source that firearm fields can then cite
+func CreateSource(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var in SourceInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		src, err := in.source()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		src, err = createSource(c.Request.Context(), db, src)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, src)
+	}
+}
+
+// AddCitation cites a source for one field of a firearm with a body of
+// {"field", "source_id", "confidence", "note"}
+func AddCitation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := loadFirearm(c, db)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Field      string `json:"field"`
+			SourceID   int    `json:"source_id"`
+			Confidence string `json:"confidence"`
+			Note       string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if !citableField(req.Field) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("field %q is not a firearm field that can be cited", req.Field)})
+			return
+		}
+		switch req.Confidence {
+		case ConfidenceLow, ConfidenceMedium, ConfidenceHigh:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("confidence must be %s, %s or %s", ConfidenceLow, ConfidenceMedium, ConfidenceHigh)})
+			return
+		}
+
+		src, err := getSource(c.Request.Context(), db, req.SourceID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no source found with id: %d", req.SourceID)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+
+		ct, err := addCitation(c.Request.Context(), db, Citation{
+			FirearmID:  f.ID,
+			Field:      req.Field,
+			Confidence: req.Confidence,
+			Note:       strings.TrimSpace(req.Note),
+			Source:     src,
+		})
+		if err == errDuplicateCitation {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, ct)
+	}
+}
+
+// DeleteCitation removes a citation from a firearm
+func DeleteCitation(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := firearmIDParam(c)
+		if !ok {
+			return
+		}
+		citationID, err := strconv.Atoi(c.Param("citation"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "citation must be a valid integer"})
+			return
+		}
+
+		err = deleteCitation(c.Request.Context(), db, id, citationID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no citation %d found for firearm with id: %d", citationID, id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	for raw, want := range map[string]string{
+		"0-306-40615-2":     "0306406152",
+		"978-0-306-40615-7": "9780306406157",
+		"0-8044-2957-x":     "080442957X",
+	} {
+		if got, err := normalizeISBN(raw); err != nil || got != want {
+			t.Errorf("normalizeISBN(%q) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"0-306-40615-3", "978-0-306-40615-8", "12345", "X306406152"} {
+		if _, err := normalizeISBN(raw); err == nil {
+			t.Errorf("normalizeISBN(%q) accepted an invalid ISBN", raw)
+		}
+	}
+}
+
+func TestCitations(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	_, writeSecret, err := createAPIKey(t.Context(), db, "writer", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)))
+	r.GET("/id/:id", GetFirearmByID(db))
+	r.GET("/firearms", ConditionalList(db), GetFirearmsByIDs(db))
+	r.POST("/sources", RequireScope(ScopeWrite), CreateSource(db))
+	r.POST("/firearms/:id/citations", RequireScope(ScopeWrite), AddCitation(db))
+	r.DELETE("/firearms/:id/citations/:citation", RequireScope(ScopeWrite), DeleteCitation(db))
+
+	for _, body := range []string{
+		`{"title": "No way to find it"}`,
+		`{"title": "Bad link", "url": "ftp://example.com"}`,
+		`{"title": "Bad date", "url": "https://example.com", "accessed_on": "yesterday"}`,
+	} {
+		if w := doRequest(r, http.MethodPost, "/sources", body, "X-API-Key", writeSecret); w.Code != http.StatusBadRequest {
+			t.Errorf("creating source %s got %d, want 400", body, w.Code)
+		}
+	}
+	w := doRequest(r, http.MethodPost, "/sources", `{"title": "Glock price list", "publisher": "Glock", "url": "https://example.com/prices", "accessed_on": "2024-03-01"}`, "X-API-Key", writeSecret)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating source got %d: %s", w.Code, w.Body)
+	}
+	var src Source
+	if err := json.Unmarshal(w.Body.Bytes(), &src); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"field": "version", "source_id": 1, "confidence": "high"}`,
+		`{"field": "price", "source_id": 1, "confidence": "certain"}`,
+		`{"field": "price", "source_id": 99, "confidence": "high"}`,
+	} {
+		if w := doRequest(r, http.MethodPost, "/firearms/1/citations", body, "X-API-Key", writeSecret); w.Code != http.StatusBadRequest {
+			t.Errorf("citing %s got %d, want 400", body, w.Code)
+		}
+	}
+	cite := `{"field": "price", "source_id": 1, "confidence": "high", "note": "MSRP"}`
+	if w := doRequest(r, http.MethodPost, "/firearms/1/citations", cite); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous citation got %d, want 401", w.Code)
+	}
+
+	// Remember the ETag with sources so a new citation can be seen to change it
+	w = doRequest(r, http.MethodGet, "/id/1?include=sources", "")
+	etag := w.Header().Get("ETag")
+	if etag == firearmValidators(f).ETag {
+		t.Error("including sources kept the plain firearm ETag")
+	}
+
+	if w := doRequest(r, http.MethodPost, "/firearms/1/citations", cite, "X-API-Key", writeSecret); w.Code != http.StatusCreated {
+		t.Fatalf("citing got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodPost, "/firearms/1/citations", cite, "X-API-Key", writeSecret); w.Code != http.StatusConflict {
+		t.Errorf("citing the same source twice got %d, want 409", w.Code)
+	}
+
+	w = doRequest(r, http.MethodGet, "/id/1?include=sources", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/id/1?include=sources after a new citation got %d, want 200", w.Code)
+	}
+	var cited CitedFirearm
+	if err := json.Unmarshal(w.Body.Bytes(), &cited); err != nil {
+		t.Fatal(err)
+	}
+	if cited.ID != f.ID || len(cited.Sources["price"]) != 1 {
+		t.Fatalf("cited firearm = %+v", cited)
+	}
+	if ct := cited.Sources["price"][0]; ct.Confidence != ConfidenceHigh || ct.Note != "MSRP" || ct.Source.ID != src.ID || *ct.Source.URL != "https://example.com/prices" {
+		t.Errorf("price citation = %+v", ct)
+	}
+	if w := doRequest(r, http.MethodGet, "/id/1", ""); w.Header().Get("ETag") != firearmValidators(f).ETag {
+		t.Error("citations changed the plain firearm ETag")
+	}
+	if w := doRequest(r, http.MethodGet, "/id/1?include=history", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("?include=history got %d, want 400", w.Code)
+	}
+
+	w = doRequest(r, http.MethodGet, "/firearms?ids=1&include=sources", "")
+	var resp LookupResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || len(resp.Results[0].Sources["price"]) != 1 {
+		t.Errorf("lookup with sources = %+v", resp)
+	}
+	listETag := w.Header().Get("ETag")
+
+	if w := doRequest(r, http.MethodDelete, "/firearms/1/citations/1", "", "X-API-Key", writeSecret); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting citation got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodGet, "/firearms?ids=1&include=sources", "", "If-None-Match", listETag); w.Code != http.StatusOK {
+		t.Errorf("lookup with sources after deleting a citation got %d, want 200", w.Code)
+	}
+	if w := doRequest(r, http.MethodDelete, "/firearms/1/citations/1", "", "X-API-Key", writeSecret); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing citation got %d, want 404", w.Code)
+	}
+}
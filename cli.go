@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const cliUsage = `usage: gundatabase [global flags] [command] [arguments]
+
+commands:
+  serve                     serve the API, the default without a command
+  migrate [-status]         apply pending schema migrations
+  seed                      load the built-in firearms dataset
+  import <file> [flags]     add or update firearms from a JSON or CSV file
+  export <format> [flags]   write the catalog as json or csv
+  query [flags]             list firearms matching filters
+  validate                  check the configuration and the data
+  shell [-server url]       look firearms up interactively
+  config print              show the effective configuration
+  keys, users, purge        manage API keys, user accounts and deleted firearms
+
+Global flags such as -config and -database.dsn go before the command.
+`
+
+// errUnknownCommand is returned by runCommand for a command it doesn't know
+var errUnknownCommand = errors.New("unknown command")
+
+// cliActor is recorded as the author of revisions made from the command line
+const cliActor = "cli"
+
+// dbCommands run against the database once it is fully migrated
+var dbCommands = map[string]func(*sql.DB, []string, io.Writer) error{
+	"keys":   runKeysCommand,
+	"users":  runUsersCommand,
+	"purge":  runPurgeCommand,
+	"export": runExportCommand,
+	"query":  runQueryCommand,
+}
+
+// writeCommands change the catalog, with the same WriteOptions as the server
+var writeCommands = map[string]func(*sql.DB, WriteOptions, []string, io.Writer) error{
+	"seed":   runSeedCommand,
+	"import": runImportCommand,
+}
+
+// runCommand runs every command but serve, writing its results to out
+func runCommand(cfg Config, name string, args []string, out io.Writer) error {
+	switch name {
+	case "help":
+		fmt.Fprint(out, cliUsage)
+		return nil
+	case "config":
+		return runConfigCommand(cfg, args, out)
+	case "shell":
+		return runShellCommand(cfg, args, os.Stdin, out)
+	case "migrate", "validate":
+		// These look at the schema as it is, so they open the database
+		// without migrating it first
+		db, err := openDatabase(cfg.Database.DSN)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		configurePool(db, cfg.Database)
+		if name == "migrate" {
+			return runMigrateCommand(db, args, out)
+		}
+		return runValidateCommand(db, args, out)
+	}
+
+	run := dbCommands[name]
+	if write, ok := writeCommands[name]; ok {
+		opts := WriteOptions{Webhooks: cfg.Features.Webhooks}
+		run = func(db *sql.DB, args []string, out io.Writer) error { return write(db, opts, args, out) }
+	}
+	if run == nil {
+		return fmt.Errorf("%w %q", errUnknownCommand, name)
+	}
+	db, err := InitDB(cfg.Database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	configurePool(db, cfg.Database)
+	return run(db, args, out)
+}
+
+// runMigrateCommand applies pending migrations, or with -status only reports them
+func runMigrateCommand(db *sql.DB, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	status := fs.Bool("status", false, "report the schema version without migrating")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	before, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if *status {
+		fmt.Fprintf(out, "schema version %d of %d, %d pending\n", before, len(migrations), len(migrations)-before)
+		return nil
+	}
+	if err := migrate(db); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "applied %d migrations, schema version %d\n", len(migrations)-before, len(migrations))
+	return nil
+}
+
+// runSeedCommand loads the built-in dataset, recording it in the history and
+// leaving firearms that are already there alone
+func runSeedCommand(db *sql.DB, opts WriteOptions, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return fmt.Errorf("seed takes no arguments, got %q", args)
+	}
+	added, err := InsertFirearms(context.Background(), db, opts)
+	if err != nil {
+		return err
+	}
+	total, err := countFirearms(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "added %d firearms, %d in the catalog\n", added, total)
+	return nil
+}
+
+// countFirearms counts every firearm row, soft deleted ones included
+func countFirearms(ctx context.Context, db dbtx) (int, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM firearms").Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count firearms: %w", err)
+	}
+	return n, nil
+}
+
+// runValidateCommand checks the configuration, which LoadConfig has already
+// done by the time it runs, and then the database: the readiness checks,
+// SQLite's integrity and foreign key checks, and every live firearm against
+// the rules writes are held to. It fails when any check does.
+func runValidateCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return fmt.Errorf("validate takes no arguments, got %q", args)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	checks, ok := checkReadiness(ctx, db)
+	checks["config"] = "ok"
+
+	// The rest needs the current schema
+	if checks["migrations"] == "ok" {
+		checks["integrity"] = sqliteCheck(db, "PRAGMA integrity_check")
+		checks["foreign_keys"] = sqliteCheck(db, "PRAGMA foreign_key_check")
+		checks["firearms"] = "ok"
+		problems, err := invalidFirearms(context.Background(), db)
+		switch {
+		case err != nil:
+			checks["firearms"] = err.Error()
+		case len(problems) > 0:
+			checks["firearms"] = strings.Join(problems, "; ")
+		}
+		ok = ok && checks["integrity"] == "ok" && checks["foreign_keys"] == "ok" && checks["firearms"] == "ok"
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(checks)) {
+		fmt.Fprintf(out, "%s: %s\n", name, checks[name])
+	}
+	if !ok {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+// sqliteCheck runs one of SQLite's check pragmas, which return "ok" or rows
+// describing what is wrong, and summarizes the outcome
+func sqliteCheck(db *sql.DB, pragma string) string {
+	rows, err := db.Query(pragma)
+	if err != nil {
+		return err.Error()
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err.Error()
+	}
+
+	var problems []string
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err.Error()
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			parts[i] = fmt.Sprint(v)
+		}
+		if row := strings.Join(parts, " "); row != "ok" {
+			problems = append(problems, row)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err.Error()
+	}
+	if len(problems) > 0 {
+		return strings.Join(problems, "; ")
+	}
+	return "ok"
+}
+
+// invalidFirearms lists the live firearms that validateFirearm rejects
+func invalidFirearms(ctx context.Context, db dbtx) ([]string, error) {
+	firearms, err := queryFirearms(ctx, db, firearmsWhere(false, "")+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, f := range firearms {
+		if err := validateFirearm(f); err != nil {
+			problems = append(problems, fmt.Sprintf("firearm %d (%s %s): %v", f.ID, f.Brand, f.Name, err))
+		}
+	}
+	return problems, nil
+}
+
+// filterFlags adds the flags for a FirearmFilter to fs, named after the
+// REST list routes, and returns the filter they fill in
+func filterFlags(fs *flag.FlagSet) *FirearmFilter {
+	var f FirearmFilter
+	fs.StringVar(&f.Brand, "brand", "", "brand, matched exactly")
+	fs.StringVar(&f.Name, "name", "", "part of the name")
+	fs.StringVar(&f.Caliber, "caliber", "", "part of the caliber")
+	fs.StringVar(&f.Type, "type", "", "part of the type")
+	fs.StringVar(&f.Country, "country", "", "part of the country of origin")
+	intFlag := func(p **int, name, usage string) {
+		fs.Func(name, usage, func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return errors.New("must be a whole number")
+			}
+			*p = &n
+			return nil
+		})
+	}
+	intFlag(&f.Year, "year", "year of introduction")
+	intFlag(&f.MinPrice, "min-price", "lowest price")
+	intFlag(&f.MaxPrice, "max-price", "highest price")
+	return &f
+}
+
+// sortOrder turns a sort key such as price, or -price for descending, into an
+// ORDER BY clause. The keys are the GraphQL FirearmSort values in lower case.
+func sortOrder(key string) (string, error) {
+	dir := "ASC"
+	if rest, ok := strings.CutPrefix(key, "-"); ok {
+		key, dir = rest, "DESC"
+	}
+	column, ok := firearmSortColumns[strings.ToUpper(key)]
+	if !ok {
+		return "", fmt.Errorf("cannot sort by %q, use one of %s", key, strings.Join(sortKeys(), ", "))
+	}
+	return fmt.Sprintf("%s %s, id %s", column, dir, dir), nil
+}
+
+// sortKeys lists the keys sortOrder accepts
+func sortKeys() []string {
+	var keys []string
+	for _, k := range slices.Sorted(maps.Keys(firearmSortColumns)) {
+		keys = append(keys, strings.ToLower(k))
+	}
+	return keys
+}
+
+// runQueryCommand lists the firearms matching the filter flags, as a table or
+// in one of the export formats
+func runQueryCommand(db *sql.DB, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.SetOutput(out)
+	filter := filterFlags(fs)
+	sort := fs.String("sort", "id", "order by one of "+strings.Join(sortKeys(), ", ")+", prefixed with - for descending")
+	limit := fs.Int("limit", 50, "most firearms to list")
+	offset := fs.Int("offset", 0, "firearms to skip")
+	format := fs.String("format", "table", "table, json or csv")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if *limit < 1 || *offset < 0 {
+		return errors.New("-limit must be positive and -offset cannot be negative")
+	}
+	if *format != "table" && !slices.Contains(exportFormats, *format) {
+		return fmt.Errorf("unknown format %q, use table, json or csv", *format)
+	}
+	orderBy, err := sortOrder(*sort)
+	if err != nil {
+		return err
+	}
+
+	cond, condArgs := filter.where()
+	firearms, total, err := pageFirearms(context.Background(), db, cond, condArgs, orderBy, *limit, *offset)
+	if err != nil {
+		return err
+	}
+	if *format != "table" {
+		return writeFirearms(out, *format, firearms)
+	}
+
+	return writeFirearmTable(out, firearms, *offset, total)
+}
+
+// writeFirearmTable lists a page of firearms starting at offset, one row
+// each, followed by where the page falls among all total matches
+func writeFirearmTable(out io.Writer, firearms []Firearm, offset, total int) error {
+	if len(firearms) == 0 {
+		_, err := fmt.Fprintf(out, "no firearms match, %d in all\n", total)
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tBRAND\tNAME\tCALIBER\tTYPE\tYEAR\tPRICE\tCOUNTRY")
+	for _, f := range firearms {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", f.ID, f.Brand, f.Name, f.Caliber, f.Type, f.Year, f.Price, f.CountryOfOrigin)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d-%d of %d\n", offset+1, offset+len(firearms), total)
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestCommand runs a command against cfg and returns what it printed
+func runTestCommand(t *testing.T, cfg Config, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := runCommand(cfg, args[0], args[1:], &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database.DSN = filepath.Join(t.TempDir(), "cli.db")
+
+	// A new database starts with every migration pending and nothing loaded
+	if out, err := runTestCommand(t, cfg, "migrate", "-status"); err != nil || !strings.Contains(out, fmt.Sprintf("%d pending", len(migrations))) {
+		t.Errorf("migrate -status got %q, %v", out, err)
+	}
+	if out, err := runTestCommand(t, cfg, "migrate"); err != nil || !strings.HasPrefix(out, "applied") {
+		t.Errorf("migrate got %q, %v", out, err)
+	}
+	if out, err := runTestCommand(t, cfg, "validate"); err == nil || !strings.Contains(out, "seed_data: no firearms loaded") {
+		t.Errorf("validate before seeding got %q, %v", out, err)
+	}
+
+	out, err := runTestCommand(t, cfg, "seed")
+	if err != nil || !strings.HasPrefix(out, "added") {
+		t.Fatalf("seed got %q, %v", out, err)
+	}
+	if out, err := runTestCommand(t, cfg, "seed"); err != nil || !strings.HasPrefix(out, "added 0 firearms") {
+		t.Errorf("seeding again got %q, %v", out, err)
+	}
+	// Seeded firearms are in the history like imported ones
+	db, err := openDatabase(cfg.Database.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if firearms, revisions := tableCount(t, db, "firearms"), tableCount(t, db, "firearm_revisions"); firearms == 0 || revisions != firearms {
+		t.Errorf("seeded %d firearms with %d revisions", firearms, revisions)
+	}
+	if out, err := runTestCommand(t, cfg, "validate"); err != nil || strings.Contains(out, "failed") {
+		t.Errorf("validate got %q, %v", out, err)
+	}
+
+	// Filters work the way the list routes do, brand matching whatever its case
+	out, err = runTestCommand(t, cfg, "query", "-brand", "glock", "-sort", "-price", "-limit", "2")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if err != nil || len(lines) != 4 || !strings.Contains(lines[1], "620") || !strings.HasPrefix(lines[3], "1-2 of 3") {
+		t.Errorf("query got %q, %v", out, err)
+	}
+	if _, err := runTestCommand(t, cfg, "query", "-sort", "caliber"); err == nil {
+		t.Error("query sorted by an unknown key succeeded")
+	}
+
+	if _, err := runTestCommand(t, cfg, "frobnicate"); !errors.Is(err, errUnknownCommand) {
+		t.Errorf("unknown command got %v", err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	dir := t.TempDir()
+	source := DefaultConfig()
+	source.Database.DSN = filepath.Join(dir, "source.db")
+	if _, err := runTestCommand(t, source, "seed"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range exportFormats {
+		t.Run(format, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "glock."+format)
+			if out, err := runTestCommand(t, source, "export", format, "-o", file, "-brand", "Glock"); err != nil || !strings.HasPrefix(out, "exported 3 firearms") {
+				t.Fatalf("export got %q, %v", out, err)
+			}
+
+			target := DefaultConfig()
+			target.Database.DSN = filepath.Join(t.TempDir(), "target.db")
+			if out, err := runTestCommand(t, target, "import", file, "-dry-run"); err != nil || !strings.Contains(out, "3 created") {
+				t.Errorf("dry run got %q, %v", out, err)
+			}
+			if out, err := runTestCommand(t, target, "import", file); err != nil || !strings.Contains(out, "3 created") {
+				t.Errorf("import got %q, %v", out, err)
+			}
+			if out, err := runTestCommand(t, target, "import", file, "-update"); err != nil || !strings.Contains(out, "3 unchanged") {
+				t.Errorf("importing again got %q, %v", out, err)
+			}
+
+			// Imports are recorded like any other write
+			db, err := InitDB(target.Database.DSN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			f, err := getFirearmByBrandName(t.Context(), db, "Glock", "19")
+			if err != nil || f.Caliber != "9mm Parabellum" || f.Weight != 0.67 {
+				t.Fatalf("imported firearm = %+v, %v", f, err)
+			}
+			if revs, err := listRevisions(t.Context(), db, f.ID); err != nil || len(revs) != 1 || revs[0].Actor != cliActor {
+				t.Errorf("revisions = %+v, %v", revs, err)
+			}
+		})
+	}
+}
+
+func TestImportRejectsInvalidRecords(t *testing.T) {
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	records, err := readCSVFirearms(strings.NewReader("brand,name,price\nGlock,17,600\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := importFirearms(t.Context(), db, testWrites, records, true, false); err != nil || res.Updated != 1 {
+		t.Errorf("patch got %+v, %v", res, err)
+	}
+
+	// One bad record leaves the whole file unimported
+	records, err = readCSVFirearms(strings.NewReader("brand,name,price\nGlock,17,700\nGlock,19,-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importFirearms(t.Context(), db, testWrites, records, true, false); err == nil || !strings.HasPrefix(err.Error(), "record 2:") {
+		t.Errorf("invalid record got %v", err)
+	}
+	if f, _ := getFirearmByBrandName(t.Context(), db, "Glock", "17"); f.Price != 600 {
+		t.Errorf("price after failed import = %d", f.Price)
+	}
+
+	if _, err := readCSVFirearms(strings.NewReader("brand,name,colour\nGlock,17,black\n")); err == nil {
+		t.Error("unknown column accepted")
+	}
+}
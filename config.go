@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with. Each setting is
+// read from, in increasing precedence: its default, the YAML or TOML file
+// named by -config or GUNAPI_CONFIG, the environment variable in its env tag,
+// and the command line flag named after its place in the file, like
+// -http.addr for http.addr.
+type Config struct {
+	HTTP      HTTPConfig      `yaml:"http" toml:"http"`
+	GRPC      GRPCConfig      `yaml:"grpc" toml:"grpc"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	CORS      CORSConfig      `yaml:"cors" toml:"cors"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth"`
+	Web       WebConfig       `yaml:"web" toml:"web"`
+	Cache     CacheConfig     `yaml:"cache" toml:"cache"`
+	Features  FeaturesConfig  `yaml:"features" toml:"features"`
+}
+
+// HTTPConfig configures the HTTP server, see ServerOptions
+type HTTPConfig struct {
+	Addr              string   `yaml:"addr" toml:"addr" env:"GUNAPI_HTTP_ADDR" usage:"address to listen on, host:port or unix:/path/to.sock"`
+	TLSCert           string   `yaml:"tls_cert" toml:"tls_cert" env:"GUNAPI_TLS_CERT" usage:"PEM certificate file to serve HTTPS with"`
+	TLSKey            string   `yaml:"tls_key" toml:"tls_key" env:"GUNAPI_TLS_KEY" usage:"PEM key file to serve HTTPS with"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"GUNAPI_READ_HEADER_TIMEOUT" usage:"time allowed to read request headers"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout" env:"GUNAPI_READ_TIMEOUT" usage:"time allowed to read a whole request"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout" env:"GUNAPI_WRITE_TIMEOUT" usage:"time allowed to write a response, /events excepted"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"GUNAPI_IDLE_TIMEOUT" usage:"time a keep-alive connection may sit idle"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes" env:"GUNAPI_MAX_HEADER_BYTES" usage:"largest request headers accepted"`
+	DrainDelay        Duration `yaml:"drain_delay" toml:"drain_delay" env:"GUNAPI_DRAIN_DELAY" usage:"time /readyz fails before shutdown stops accepting connections"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"GUNAPI_SHUTDOWN_TIMEOUT" usage:"time in-flight requests get to finish at shutdown"`
+}
+
+// GRPCConfig configures the gRPC server
+type GRPCConfig struct {
+	Addr string `yaml:"addr" toml:"addr" env:"GUNAPI_GRPC_ADDR" usage:"address the gRPC server listens on"`
+}
+
+// DatabaseConfig picks the database and sizes its connection pool
+type DatabaseConfig struct {
+	Driver          string   `yaml:"driver" toml:"driver" env:"GUNAPI_DB_DRIVER" usage:"database driver, only sqlite3 is supported"`
+	DSN             string   `yaml:"dsn" toml:"dsn" env:"GUNAPI_DB_DSN" usage:"database file or DSN"`
+	MaxOpenConns    int      `yaml:"max_open_conns" toml:"max_open_conns" env:"GUNAPI_DB_MAX_OPEN_CONNS" usage:"most open connections, 0 for no limit"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" toml:"max_idle_conns" env:"GUNAPI_DB_MAX_IDLE_CONNS" usage:"most idle connections kept"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"GUNAPI_DB_CONN_MAX_LIFETIME" usage:"longest a connection is reused, 0 for no limit"`
+	ConnMaxIdleTime Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time" env:"GUNAPI_DB_CONN_MAX_IDLE_TIME" usage:"longest a connection sits idle, 0 for no limit"`
+}
+
+// CORSConfig says which browser origins may call the API, see CORS
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" toml:"allowed_origins" env:"GUNAPI_CORS_ORIGINS" usage:"comma separated origins allowed to call the API, * for any, none when empty"`
+	AllowedMethods   []string `yaml:"allowed_methods" toml:"allowed_methods" env:"GUNAPI_CORS_METHODS" usage:"comma separated methods allowed in cross-origin requests"`
+	AllowedHeaders   []string `yaml:"allowed_headers" toml:"allowed_headers" env:"GUNAPI_CORS_HEADERS" usage:"comma separated headers allowed in cross-origin requests"`
+	AllowCredentials bool     `yaml:"allow_credentials" toml:"allow_credentials" env:"GUNAPI_CORS_CREDENTIALS" usage:"allow cross-origin requests with cookies or auth headers"`
+	MaxAge           Duration `yaml:"max_age" toml:"max_age" env:"GUNAPI_CORS_MAX_AGE" usage:"how long browsers may cache a preflight response"`
+}
+
+// RateLimitConfig sizes every client's token bucket, see RateLimiter
+type RateLimitConfig struct {
+	PerMinute int `yaml:"per_minute" toml:"per_minute" env:"GUNAPI_RATE_LIMIT_PER_MINUTE" usage:"requests a client may make per minute"`
+	Burst     int `yaml:"burst" toml:"burst" env:"GUNAPI_RATE_LIMIT_BURST" usage:"requests a client may make at once"`
+}
+
+// LogConfig configures the server log
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level" env:"GUNAPI_LOG_LEVEL" usage:"least severe level logged: debug, info, warn or error"`
+	Format string `yaml:"format" toml:"format" env:"GUNAPI_LOG_FORMAT" usage:"log format: json or text"`
+}
+
+// TracingConfig picks where spans go, see initTracing
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" toml:"exporter" env:"GUNAPI_TRACE_EXPORTER" usage:"trace exporter: otlp, stdout or none"`
+}
+
+// AuthConfig configures user sessions
+type AuthConfig struct {
+	JWTSecret string `yaml:"jwt_secret" toml:"jwt_secret" env:"GUNAPI_JWT_SECRET" usage:"secret signing session tokens, random when empty" secret:"true"`
+}
+
+// WebConfig says where the HTML templates and static files are
+type WebConfig struct {
+	Templates string `yaml:"templates" toml:"templates" env:"GUNAPI_TEMPLATES" usage:"glob of the HTML templates"`
+	StaticDir string `yaml:"static_dir" toml:"static_dir" env:"GUNAPI_STATIC_DIR" usage:"directory served under /static"`
+}
+
+// CacheConfig says how long clients and shared caches may keep the
+// responses of each group of read routes, see CacheControl
+type CacheConfig struct {
+	ListMaxAge    Duration `yaml:"list_max_age" toml:"list_max_age" env:"GUNAPI_CACHE_LIST_MAX_AGE" usage:"how long list responses may be cached"`
+	FirearmMaxAge Duration `yaml:"firearm_max_age" toml:"firearm_max_age" env:"GUNAPI_CACHE_FIREARM_MAX_AGE" usage:"how long /id/:id responses may be cached"`
+	CatalogMaxAge Duration `yaml:"catalog_max_age" toml:"catalog_max_age" env:"GUNAPI_CACHE_CATALOG_MAX_AGE" usage:"how long HTML catalog pages may be cached"`
+}
+
+// FeaturesConfig turns optional parts of the server on and off
+type FeaturesConfig struct {
+	GraphQL  bool `yaml:"graphql" toml:"graphql" env:"GUNAPI_FEATURE_GRAPHQL" usage:"serve /graphql"`
+	GRPC     bool `yaml:"grpc" toml:"grpc" env:"GUNAPI_FEATURE_GRPC" usage:"serve the gRPC catalog"`
+	Events   bool `yaml:"events" toml:"events" env:"GUNAPI_FEATURE_EVENTS" usage:"serve the /events stream"`
+	Metrics  bool `yaml:"metrics" toml:"metrics" env:"GUNAPI_FEATURE_METRICS" usage:"serve /metrics"`
+	Webhooks bool `yaml:"webhooks" toml:"webhooks" env:"GUNAPI_FEATURE_WEBHOOKS" usage:"deliver webhooks"`
+}
+
+// Duration is a time.Duration written like 30s or 1m30s in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, want something like 30s", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// DefaultConfig returns the configuration the server runs with when nothing is set
+func DefaultConfig() Config {
+	server := DefaultServerOptions()
+	return Config{
+		HTTP: HTTPConfig{
+			Addr:              server.Addr,
+			ReadHeaderTimeout: Duration(server.ReadHeaderTimeout),
+			ReadTimeout:       Duration(server.ReadTimeout),
+			WriteTimeout:      Duration(server.WriteTimeout),
+			IdleTimeout:       Duration(server.IdleTimeout),
+			MaxHeaderBytes:    server.MaxHeaderBytes,
+			DrainDelay:        Duration(server.DrainDelay),
+			ShutdownTimeout:   Duration(server.ShutdownTimeout),
+		},
+		GRPC:     GRPCConfig{Addr: ":4001"},
+		Database: DatabaseConfig{Driver: "sqlite3", DSN: "gundatabase.db", MaxIdleConns: 2},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "X-API-Key", "X-Request-ID"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		RateLimit: RateLimitConfig{PerMinute: 120, Burst: 30},
+		Log:       LogConfig{Level: "info", Format: "json"},
+		Tracing:   TracingConfig{Exporter: "none"},
+		Web:       WebConfig{Templates: "**/*.html", StaticDir: "./static"},
+		Cache:     CacheConfig{ListMaxAge: Duration(time.Minute), FirearmMaxAge: Duration(5 * time.Minute), CatalogMaxAge: Duration(time.Minute)},
+		Features:  FeaturesConfig{GraphQL: true, GRPC: true, Events: true, Metrics: true, Webhooks: true},
+	}
+}
+
+// configField is a setting along with its place in the config file
+type configField struct {
+	path  string
+	value reflect.Value
+	field reflect.StructField
+}
+
+// configFields lists every setting of cfg, in file order
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			path := prefix + f.Tag.Get("yaml")
+			if f.Type.Kind() == reflect.Struct {
+				walk(path+".", v.Field(i))
+				continue
+			}
+			fields = append(fields, configField{path: path, value: v.Field(i), field: f})
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return fields
+}
+
+// set parses s into the setting, lists being comma separated
+func (f configField) set(s string) error {
+	v := f.value
+	if u, ok := v.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, want true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue collects a flag's value so it can be applied after the file and environment
+type flagValue struct {
+	value string
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(s string) error { f.value = s; return nil }
+
+// boolFlagValue lets boolean settings be turned on with just -features.graphql
+type boolFlagValue struct{ flagValue }
+
+func (f *boolFlagValue) IsBoolFlag() bool { return true }
+
+// LoadConfig works out the configuration from the defaults, the config file,
+// the environment and the flags in args, returning it along with the
+// arguments left after the flags. Every invalid setting is reported at once.
+func LoadConfig(args []string, getenv func(string) string, stderr io.Writer) (Config, []string, error) {
+	cfg := DefaultConfig()
+	fields := configFields(&cfg)
+
+	fs := flag.NewFlagSet("gundatabase", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "%s\nglobal flags:\n", cliUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", getenv("GUNAPI_CONFIG"), "YAML or TOML config file (env GUNAPI_CONFIG)")
+	flags := make(map[string]flag.Value, len(fields))
+	for _, f := range fields {
+		var v flag.Value = &flagValue{}
+		if f.value.Kind() == reflect.Bool {
+			v = &boolFlagValue{}
+		}
+		flags[f.path] = v
+		fs.Var(v, f.path, fmt.Sprintf("%s (env %s)", f.field.Tag.Get("usage"), f.field.Tag.Get("env")))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		if err := loadConfigFile(&cfg, *configPath); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	var errs []error
+	for _, f := range fields {
+		if env := f.field.Tag.Get("env"); getenv(env) != "" {
+			if err := f.set(getenv(env)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if f.path == fl.Name {
+				if err := f.set(fl.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", fl.Name, err))
+				}
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return cfg, nil, errors.Join(errs...)
+	}
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+// loadConfigFile reads settings from a YAML or TOML file, picked by its
+// extension. Unknown settings are errors, so a typo doesn't go unnoticed.
+func loadConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(cfg); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Validate reports every setting the server can't start with
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.HTTP.Addr != "" && c.HTTP.Addr != "unix:", "http.addr cannot be empty")
+	check((c.HTTP.TLSCert == "") == (c.HTTP.TLSKey == ""), "http.tls_cert and http.tls_key must be set together")
+	for name, d := range map[string]Duration{
+		"http.read_header_timeout": c.HTTP.ReadHeaderTimeout, "http.read_timeout": c.HTTP.ReadTimeout,
+		"http.write_timeout": c.HTTP.WriteTimeout, "http.idle_timeout": c.HTTP.IdleTimeout,
+		"http.drain_delay": c.HTTP.DrainDelay, "http.shutdown_timeout": c.HTTP.ShutdownTimeout,
+		"database.conn_max_lifetime": c.Database.ConnMaxLifetime, "database.conn_max_idle_time": c.Database.ConnMaxIdleTime,
+		"cors.max_age": c.CORS.MaxAge, "cache.list_max_age": c.Cache.ListMaxAge,
+		"cache.firearm_max_age": c.Cache.FirearmMaxAge, "cache.catalog_max_age": c.Cache.CatalogMaxAge,
+	} {
+		check(d >= 0, "%s cannot be negative", name)
+	}
+	check(c.HTTP.MaxHeaderBytes > 0, "http.max_header_bytes must be positive")
+	check(!c.Features.GRPC || c.GRPC.Addr != "", "grpc.addr cannot be empty while the grpc feature is on")
+	check(c.Database.Driver == "sqlite3", "database.driver %q isn't supported, only sqlite3 is", c.Database.Driver)
+	check(c.Database.DSN != "", "database.dsn cannot be empty")
+	check(c.Database.MaxOpenConns >= 0 && c.Database.MaxIdleConns >= 0, "database connection limits cannot be negative")
+	for _, origin := range c.CORS.AllowedOrigins {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			"cors.allowed_origins entry %q must be * or start with http:// or https://", origin)
+		check(origin != "*" || !c.CORS.AllowCredentials, "cors.allow_credentials cannot be used with the * origin")
+	}
+	check(c.RateLimit.PerMinute > 0 && c.RateLimit.Burst > 0, "rate_limit.per_minute and rate_limit.burst must be positive")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level %q must be debug, info, warn or error", c.Log.Level)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format %q must be json or text", c.Log.Format)
+	check(c.Tracing.Exporter == "otlp" || c.Tracing.Exporter == "stdout" || c.Tracing.Exporter == "none",
+		"tracing.exporter %q must be otlp, stdout or none", c.Tracing.Exporter)
+	check(c.Web.Templates != "", "web.templates cannot be empty")
+	return errors.Join(errs...)
+}
+
+// ServerOptions returns the HTTP server options of the configuration
+func (c HTTPConfig) ServerOptions() ServerOptions {
+	return ServerOptions{
+		Addr:              c.Addr,
+		TLSCertFile:       c.TLSCert,
+		TLSKeyFile:        c.TLSKey,
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(c.ReadTimeout),
+		WriteTimeout:      time.Duration(c.WriteTimeout),
+		IdleTimeout:       time.Duration(c.IdleTimeout),
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+		DrainDelay:        time.Duration(c.DrainDelay),
+		ShutdownTimeout:   time.Duration(c.ShutdownTimeout),
+	}
+}
+
+// runConfigCommand runs `config print`, which writes the effective
+// configuration as YAML for reading. Secrets that are set show as ********,
+// so the output only works as a config file once they are filled back in.
+func runConfigCommand(cfg Config, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+	for _, f := range configFields(&cfg) {
+		if f.field.Tag.Get("secret") == "true" && f.value.String() != "" {
+			f.value.SetString("********")
+		}
+	}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return fmt.Errorf("failed to print config: %w", err)
+	}
+	return enc.Close()
+}
+
+// configurePool sizes the database's connection pool
+func configurePool(db *sql.DB, cfg DatabaseConfig) {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	db.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime))
+}
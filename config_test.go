@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a config file into a temp dir and returns its path
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// envFrom returns a getenv looking variables up in env
+func envFrom(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, args, err := LoadConfig(nil, envFrom(nil), io.Discard)
+	if err != nil || len(args) != 0 {
+		t.Fatalf("defaults got %v, %v", args, err)
+	}
+	if cfg.HTTP.Addr != ":4000" || cfg.Database.DSN != "gundatabase.db" || cfg.RateLimit.PerMinute != 120 || !cfg.Features.GraphQL {
+		t.Errorf("defaults = %+v", cfg)
+	}
+
+	yamlFile := writeConfigFile(t, "gundatabase.yaml", `
+http:
+  addr: ":8080"
+  write_timeout: 1m
+database:
+  dsn: /var/lib/gundatabase/catalog.db
+  max_open_conns: 4
+cors:
+  allowed_origins: [https://example.com]
+features:
+  graphql: false
+`)
+	tomlFile := writeConfigFile(t, "gundatabase.toml", `
+[http]
+addr = ":8080"
+write_timeout = "1m"
+
+[database]
+dsn = "/var/lib/gundatabase/catalog.db"
+max_open_conns = 4
+
+[cors]
+allowed_origins = ["https://example.com"]
+
+[features]
+graphql = false
+`)
+	for _, file := range []string{yamlFile, tomlFile} {
+		cfg, _, err := LoadConfig([]string{"-config", file}, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if cfg.HTTP.Addr != ":8080" || time.Duration(cfg.HTTP.WriteTimeout) != time.Minute || cfg.Database.MaxOpenConns != 4 ||
+			cfg.CORS.AllowedOrigins[0] != "https://example.com" || cfg.Features.GraphQL || !cfg.Features.Events || cfg.GRPC.Addr != ":4001" {
+			t.Errorf("%s loaded %+v", file, cfg)
+		}
+	}
+
+	// The environment overrides the file and flags override both
+	env := envFrom(map[string]string{
+		"GUNAPI_CONFIG":           yamlFile,
+		"GUNAPI_HTTP_ADDR":        ":9090",
+		"GUNAPI_DB_DSN":           "env.db",
+		"GUNAPI_CORS_ORIGINS":     "https://a.example, https://b.example",
+		"GUNAPI_FEATURE_GRAPHQL":  "true",
+		"GUNAPI_RATE_LIMIT_BURST": "5",
+	})
+	cfg, args, err = LoadConfig([]string{"-http.addr", ":7070", "-features.graphql=false", "-log.format", "text", "keys", "list"}, env, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTP.Addr != ":7070" || cfg.Database.DSN != "env.db" || cfg.Database.MaxOpenConns != 4 || len(cfg.CORS.AllowedOrigins) != 2 ||
+		cfg.CORS.AllowedOrigins[1] != "https://b.example" || cfg.Features.GraphQL || cfg.RateLimit.Burst != 5 || cfg.Log.Format != "text" {
+		t.Errorf("loaded %+v", cfg)
+	}
+	if strings.Join(args, " ") != "keys list" {
+		t.Errorf("args left = %v", args)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{"unknown setting", []string{"-config", writeConfigFile(t, "typo.yaml", "http:\n  adress: \":80\"\n")}, nil,
+			[]string{"adress"}},
+		{"unknown extension", []string{"-config", writeConfigFile(t, "config.json", "{}")}, nil,
+			[]string{".yaml, .yml or .toml"}},
+		{"bad values", nil, map[string]string{"GUNAPI_WRITE_TIMEOUT": "soon", "GUNAPI_DB_MAX_OPEN_CONNS": "many"},
+			[]string{"GUNAPI_WRITE_TIMEOUT", "GUNAPI_DB_MAX_OPEN_CONNS"}},
+		{"every invalid setting at once", []string{"-database.driver", "postgres", "-log.level", "loud", "-http.tls_cert", "cert.pem",
+			"-cors.allowed_origins", "*", "-cors.allow_credentials"}, nil,
+			[]string{"database.driver", "log.level", "http.tls_cert and http.tls_key", "cors.allow_credentials"}},
+	}
+	for _, tt := range tests {
+		_, _, err := LoadConfig(tt.args, envFrom(tt.env), io.Discard)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't mention %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	cfg, _, err := LoadConfig([]string{"-auth.jwt_secret", "hunter2", "-http.addr", ":8080"}, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runConfigCommand(cfg, []string{"print"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") || !strings.Contains(out.String(), "jwt_secret: '********'") {
+		t.Errorf("secret isn't masked:\n%s", out.String())
+	}
+
+	// The output is a config file giving the same settings back
+	printed, _, err := LoadConfig([]string{"-config", writeConfigFile(t, "printed.yaml", out.String())}, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printed.HTTP.Addr != ":8080" || printed.HTTP.ReadTimeout != cfg.HTTP.ReadTimeout || len(printed.CORS.AllowedHeaders) != len(cfg.CORS.AllowedHeaders) {
+		t.Errorf("printed config loaded back as %+v", printed)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORS(t *testing.T) {
+	cfg := DefaultConfig().CORS
+	cfg.AllowedOrigins = []string{"https://app.example"}
+	r := gin.New()
+	r.Use(CORS(cfg))
+	r.GET("/all", func(c *gin.Context) { c.JSON(http.StatusOK, []Firearm{}) })
+
+	// A preflight from an allowed origin is answered before reaching any route
+	w := doRequest(r, http.MethodOptions, "/all", "", "Origin", "https://app.example", "Access-Control-Request-Method", "PATCH")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PATCH, DELETE" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight got %d with %v", w.Code, w.Header())
+	}
+
+	w = doRequest(r, http.MethodGet, "/all", "", "Origin", "https://app.example")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example" || w.Header().Get("Vary") != "Origin" {
+		t.Errorf("request got %d with %v", w.Code, w.Header())
+	}
+
+	// Other origins get no CORS headers, so browsers block them
+	w = doRequest(r, http.MethodGet, "/all", "", "Origin", "https://evil.example")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin got %d with %v", w.Code, w.Header())
+	}
+
+	cfg.AllowedOrigins = []string{"*"}
+	r = gin.New()
+	r.Use(CORS(cfg))
+	r.GET("/all", func(c *gin.Context) { c.JSON(http.StatusOK, []Firearm{}) })
+	if w := doRequest(r, http.MethodGet, "/all", "", "Origin", "https://any.example"); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("any origin got %v", w.Header())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// eventKeepAlive is how long the change feed lets a connection sit idle
+// before sending a comment to keep proxies from closing it
+var eventKeepAlive = 15 * time.Second
+
+// lastEventID reads where a client wants the feed to resume from: the
+// Last-Event-ID header browsers send when reconnecting, or ?last_event_id for
+// the first connection. ok is false when neither was sent.
+func lastEventID(c *gin.Context) (id int, ok bool, err error) {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("last_event_id")
+	}
+	if raw == "" {
+		return 0, false, nil
+	}
+	id, err = strconv.Atoi(raw)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("last event id %q must be a non-negative integer", raw)
+	}
+	return id, true, nil
+}
+
+// StreamEvents streams catalog changes as Server-Sent Events. Each event's id
+// is its changelog sequence number, its name the event type and its data the
+// ChangeEvent as JSON, without its actor unless the caller has the write
+// scope. A client that resumes with Last-Event-ID first gets
+// every change it missed; a new one only gets changes from now on. The stream
+// ends when the client goes away or end is closed.
+func StreamEvents(db *sql.DB, end <-chan struct{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		last, resume, err := lastEventID(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !resume {
+			if last, err = latestChange(c.Request.Context(), db); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		withActors := showActors(c)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+		// The stream outlives the server's write timeout, and ends when the
+		// client goes away or the server shuts down instead
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+		idleSince := time.Now()
+		err = followChanges(c.Request.Context(), db, last, end, func(events []ChangeEvent) error {
+			for _, ev := range events {
+				if !withActors {
+					ev.Actor = ""
+				}
+				c.Render(-1, sse.Event{Id: strconv.Itoa(ev.ID), Event: ev.Type, Data: ev})
+			}
+			switch {
+			case len(events) > 0:
+				c.Writer.Flush()
+				idleSince = time.Now()
+			case time.Since(idleSince) >= eventKeepAlive:
+				fmt.Fprint(c.Writer, ": keepalive\n\n")
+				c.Writer.Flush()
+				idleSince = time.Now()
+			}
+			return nil
+		})
+		if err != nil {
+			// The status is already sent, so the error can only end the stream
+			c.Error(err)
+		}
+	}
+}
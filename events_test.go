@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent is one event read off a Server-Sent Events stream
+type sseEvent struct {
+	id, name string
+	data     ChangeEvent
+}
+
+// readEvents reads n events from an SSE stream, skipping comments
+func readEvents(t *testing.T, sc *bufio.Scanner, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var ev sseEvent
+	for len(events) < n && sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if ev.id != "" {
+				events = append(events, ev)
+			}
+			ev = sseEvent{}
+		case strings.HasPrefix(line, "id:"):
+			ev.id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			ev.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev.data); err != nil {
+				t.Fatalf("decoding %q: %v", line, err)
+			}
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("stream ended after %d events, want %d: %v", len(events), n, sc.Err())
+	}
+	return events
+}
+
+func TestStreamEvents(t *testing.T) {
+	defer func(poll time.Duration) { eventPollInterval = poll }(eventPollInterval)
+	eventPollInterval = 10 * time.Millisecond
+
+	db := newTestDB(t)
+	r := gin.New()
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+	r.PATCH("/firearms/:id", UpdateFirearm(db, testWrites))
+	r.GET("/events", StreamEvents(db, nil))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+
+	if w := doRequest(r, http.MethodGet, "/events?last_event_id=soon", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid last event id got %d, want 400", w.Code)
+	}
+
+	// Resuming from the start replays the creation, then new changes follow live
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	sc := bufio.NewScanner(resp.Body)
+
+	events := readEvents(t, sc, 1)
+	if events[0].id != "1" || events[0].name != EventFirearmCreated || events[0].data.After == nil || events[0].data.After.Name != "17" {
+		t.Fatalf("replayed event = %+v", events[0])
+	}
+
+	if w := doRequest(r, http.MethodPatch, "/firearms/1", `{"price": 600}`, "If-Match", etag); w.Code != http.StatusOK {
+		t.Fatalf("patch got %d: %s", w.Code, w.Body)
+	}
+	events = readEvents(t, sc, 1)
+	if events[0].id != "2" || events[0].name != EventFirearmUpdated || events[0].data.Before.Price != 550 || events[0].data.After.Price != 600 {
+		t.Fatalf("live event = %+v", events[0])
+	}
+	if id, _ := strconv.Atoi(events[0].id); id != events[0].data.ID {
+		t.Errorf("event id %s doesn't match its data id %d", events[0].id, events[0].data.ID)
+	}
+}
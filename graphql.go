@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// /graphql runs on github.com/graphql-go/graphql. This file adds what the
+// library leaves to us: fields under a list load for every object of the list
+// with one query, a query is costed and rejected before it runs when it asks
+// for too much, and the schema is printed as SDL.
+
+// gqlError is a GraphQL request error, reported to the client as is. Anything
+// else a resolver fails with is an internal error.
+type gqlError struct {
+	msg string
+}
+
+func (e *gqlError) Error() string { return e.msg }
+
+func gqlErrorf(format string, args ...any) error {
+	return &gqlError{msg: fmt.Sprintf(format, args...)}
+}
+
+// gqlCause digs the error a resolver failed with out of the library's wrapping
+func gqlCause(err error) error {
+	for {
+		switch e := err.(type) {
+		case gqlerrors.FormattedError:
+			if e.OriginalError() == nil {
+				return err
+			}
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			if e.OriginalError == nil {
+				return err
+			}
+			err = e.OriginalError
+		default:
+			return err
+		}
+	}
+}
+
+// gqlBatch loads a field for every object it's resolved on with one query.
+// Resolvers add their key and return a thunk, and the library resolves a whole
+// level of the response before it calls any of them, so the first thunk
+// called loads the keys of the entire level.
+type gqlBatch[K comparable, V any] struct {
+	load    func(keys []K) (map[K]V, error)
+	pending []K
+	loaded  map[K]V
+	err     error
+}
+
+func (b *gqlBatch[K, V]) get(key K) func() (any, error) {
+	if _, ok := b.loaded[key]; !ok && !slices.Contains(b.pending, key) {
+		b.pending = append(b.pending, key)
+	}
+	return func() (any, error) {
+		if _, ok := b.loaded[key]; !ok && len(b.pending) > 0 {
+			keys := b.pending
+			b.pending = nil
+			values, err := b.load(keys)
+			if err != nil {
+				b.err = err
+			}
+			for _, k := range keys {
+				b.loaded[k] = values[k]
+			}
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		return b.loaded[key], nil
+	}
+}
+
+// gqlBatchesKey is the context key of the batches of a request, by field and arguments
+type gqlBatchesKey struct{}
+
+// batchFor returns the request's batch named name, starting it on first use
+func batchFor[K comparable, V any](p graphql.ResolveParams, name string, load func(keys []K) (map[K]V, error)) *gqlBatch[K, V] {
+	batches := p.Context.Value(gqlBatchesKey{}).(map[string]any)
+	b, ok := batches[name].(*gqlBatch[K, V])
+	if !ok {
+		b = &gqlBatch[K, V]{load: load, loaded: make(map[K]V)}
+		batches[name] = b
+	}
+	return b
+}
+
+// gqlCoster works out the cost of an operation. Each field selected costs 1,
+// and fields taking a first argument multiply the cost of the fields selected
+// under them by it, since they can return that many objects.
+type gqlCoster struct {
+	op        *ast.OperationDefinition
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+}
+
+func (c *gqlCoster) cost(typ *graphql.Object, set *ast.SelectionSet, depth int) (int, error) {
+	if set == nil {
+		return 0, nil
+	}
+	if depth > graphQLMaxDepth {
+		return 0, gqlErrorf("query is nested more than %d levels deep", graphQLMaxDepth)
+	}
+	cost := 0
+	for _, sel := range set.Selections {
+		var n int
+		var err error
+		switch sel := sel.(type) {
+		case *ast.Field:
+			// Validation has passed, so a field the type lacks is __typename or introspection
+			def, ok := typ.Fields()[sel.Name.Value]
+			if !ok {
+				continue
+			}
+			child, ok := graphql.GetNamed(def.Type).(*graphql.Object)
+			if !ok {
+				n = 1
+				break
+			}
+			if n, err = c.cost(child, sel.SelectionSet, depth+1); err == nil {
+				n = 1 + n*max(c.first(def, sel), 1)
+			}
+		case *ast.FragmentSpread:
+			n, err = c.cost(typ, c.fragments[sel.Name.Value].SelectionSet, depth)
+		case *ast.InlineFragment:
+			n, err = c.cost(typ, sel.SelectionSet, depth)
+		}
+		if err != nil {
+			return 0, err
+		}
+		cost += n
+	}
+	return cost, nil
+}
+
+// first reads the first argument of a field, from the query, the variables or
+// the defaults, and 1 for fields without one
+func (c *gqlCoster) first(def *graphql.FieldDefinition, field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		value := arg.Value
+		if v, ok := value.(*ast.Variable); ok {
+			if given, ok := graphql.Int.ParseValue(c.variables[v.Name.Value]).(int); ok {
+				return given
+			}
+			value = nil
+			for _, vd := range c.op.VariableDefinitions {
+				if vd.Variable.Name.Value == v.Name.Value && vd.DefaultValue != nil {
+					value = vd.DefaultValue
+				}
+			}
+		}
+		if n, ok := graphql.Int.ParseLiteral(value).(int); ok {
+			return n
+		}
+	}
+	for _, arg := range def.Args {
+		if n, ok := arg.DefaultValue.(int); ok && arg.Name() == "first" {
+			return n
+		}
+	}
+	return 1
+}
+
+// gqlOperation picks the operation of a document to run, by name when it has several
+func gqlOperation(doc *ast.Document, name string) (*ast.OperationDefinition, error) {
+	var found *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok || name != "" && (op.Name == nil || op.Name.Value != name) {
+			continue
+		}
+		if found != nil {
+			return nil, gqlErrorf("operationName is required when the query has several operations")
+		}
+		found = op
+	}
+	if found == nil {
+		return nil, gqlErrorf("no operation named %q", name)
+	}
+	if found.Operation != ast.OperationTypeQuery {
+		return nil, gqlErrorf("%s operations are not supported", found.Operation)
+	}
+	return found, nil
+}
+
+// runGraphQL parses, validates, costs and executes a query. A query that is
+// invalid, too expensive or that a resolver rejects comes back as a result
+// with errors for the client; anything else going wrong is returned as err.
+func runGraphQL(ctx context.Context, schema graphql.Schema, req graphQLRequest) (*graphql.Result, error) {
+	rejected := func(err error) *graphql.Result {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query)})})
+	if err != nil {
+		return rejected(err), nil
+	}
+	// Some of the library's rules recurse forever on a fragment that spreads
+	// itself, so cycles are ruled out before the rest run
+	for _, rules := range [][]graphql.ValidationRuleFn{{graphql.NoFragmentCyclesRule}, graphql.SpecifiedRules} {
+		if v := graphql.ValidateDocument(&schema, doc, rules); !v.IsValid {
+			return &graphql.Result{Errors: v.Errors}, nil
+		}
+	}
+	op, err := gqlOperation(doc, req.OperationName)
+	if err != nil {
+		return rejected(err), nil
+	}
+	coster := &gqlCoster{op: op, fragments: make(map[string]*ast.FragmentDefinition), variables: req.Variables}
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok {
+			coster.fragments[frag.Name.Value] = frag
+		}
+	}
+	cost, err := coster.cost(schema.QueryType(), op.SelectionSet, 1)
+	if err == nil && cost > graphQLMaxComplexity {
+		err = gqlErrorf("query complexity %d is over the limit of %d, ask for fewer objects", cost, graphQLMaxComplexity)
+	}
+	if err != nil {
+		return rejected(err), nil
+	}
+
+	res := graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       context.WithValue(ctx, gqlBatchesKey{}, make(map[string]any)),
+	})
+	// Errors with a path come from resolving a field, the rest from the variables
+	for _, e := range res.Errors {
+		cause := gqlCause(e)
+		if _, ok := cause.(*gqlError); !ok && len(e.Path) > 0 {
+			return nil, cause
+		}
+	}
+	return res, nil
+}
+
+// gqlLiteral writes a default value the way it would appear in a document
+func gqlLiteral(typ graphql.Type, v any) string {
+	if s, ok := v.(string); ok {
+		if _, enum := graphql.GetNamed(typ).(*graphql.Enum); enum {
+			return s
+		}
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// gqlSDL writes a schema in the schema definition language, with Query first
+// and everything else by name. The library only prints documents, not schemas.
+func gqlSDL(schema graphql.Schema) string {
+	var b strings.Builder
+	description := func(indent, desc string) {
+		if desc != "" {
+			b.WriteString(indent + strconv.Quote(desc) + "\n")
+		}
+	}
+	withDefault := func(name string, typ graphql.Type, def any) string {
+		if def == nil {
+			return name + ": " + typ.String()
+		}
+		return name + ": " + typ.String() + " = " + gqlLiteral(typ, def)
+	}
+
+	types := schema.TypeMap()
+	names := slices.Sorted(maps.Keys(types))
+	query := schema.QueryType().Name()
+	names = append([]string{query}, slices.DeleteFunc(names, func(n string) bool { return n == query })...)
+	for _, name := range names {
+		switch t := types[name].(type) {
+		case *graphql.Object:
+			if strings.HasPrefix(name, "__") {
+				continue
+			}
+			fields := t.Fields()
+			description("", t.Description())
+			b.WriteString("type " + name + " {\n")
+			for _, fname := range slices.Sorted(maps.Keys(fields)) {
+				f := fields[fname]
+				description("  ", f.Description)
+				b.WriteString("  " + fname)
+				if len(f.Args) > 0 {
+					args := make([]string, len(f.Args))
+					for i, a := range f.Args {
+						args[i] = withDefault(a.Name(), a.Type, a.DefaultValue)
+					}
+					slices.Sort(args)
+					b.WriteString("(" + strings.Join(args, ", ") + ")")
+				}
+				b.WriteString(": " + f.Type.String() + "\n")
+			}
+			b.WriteString("}\n\n")
+		case *graphql.InputObject:
+			fields := t.Fields()
+			description("", t.Description())
+			b.WriteString("input " + name + " {\n")
+			for _, fname := range slices.Sorted(maps.Keys(fields)) {
+				b.WriteString("  " + withDefault(fname, fields[fname].Type, fields[fname].DefaultValue) + "\n")
+			}
+			b.WriteString("}\n\n")
+		case *graphql.Enum:
+			if strings.HasPrefix(name, "__") {
+				continue
+			}
+			values := make([]string, len(t.Values()))
+			for i, v := range t.Values() {
+				values[i] = v.Name
+			}
+			slices.Sort(values)
+			description("", t.Description())
+			b.WriteString("enum " + name + " {\n  " + strings.Join(values, "\n  ") + "\n}\n\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
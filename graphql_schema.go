@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+// Limits on what one GraphQL query can ask for. Every field costs 1, and a
+// field taking first multiplies the cost of what is selected under it, so
+// firearms(first: 100) { items { similar(first: 10) { name } } } costs about
+// 100 * 10. first itself is capped per field.
+const (
+	graphQLMaxComplexity = 5000
+	graphQLMaxDepth      = 8
+	graphQLMaxFirst      = 100
+	graphQLMaxQuery      = 16 << 10
+)
+
+// firearmSortColumns maps the FirearmSort enum to the column it orders by
+var firearmSortColumns = map[string]string{
+	"ID":                "id",
+	"BRAND":             "brand",
+	"NAME":              "name",
+	"YEAR":              "year",
+	"PRICE":             "price",
+	"EFFECTIVE_RANGE":   "effective_range",
+	"MAGAZINE_CAPACITY": "magazine_capacity",
+	"WEIGHT":            "weight",
+	"CREATED_AT":        "created_at",
+	"UPDATED_AT":        "updated_at",
+}
+
+// gqlFirearmPage is one page of a firearms query
+type gqlFirearmPage struct {
+	total   int
+	items   []Firearm
+	hasMore bool
+}
+
+// gqlGroup is a manufacturer or caliber, standing for the firearms sharing it
+type gqlGroup struct{ name string }
+
+// gqlField resolves a field of a T from the T alone, for fields that need no query
+func gqlField[T any](get func(T) any) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		return get(p.Source.(T)), nil
+	}
+}
+
+// firstArg reads the first argument of a list field, enforcing its cap
+func firstArg(args map[string]any) (int, error) {
+	first := args["first"].(int)
+	if first < 0 || first > graphQLMaxFirst {
+		return 0, gqlErrorf("first must be between 0 and %d", graphQLMaxFirst)
+	}
+	return first, nil
+}
+
+// inList builds the placeholders and arguments of an IN (...) clause
+func inList[T any](keys []T) (string, []any) {
+	placeholders := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, k := range keys {
+		placeholders[i], args[i] = "?", k
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// firearmsByColumn loads the first live firearms, by ID, for each value of a
+// column in one query. column is one of ours, never user input.
+func firearmsByColumn(ctx context.Context, db dbtx, column string, values []string, first int) (map[string][]Firearm, error) {
+	byValue := make(map[string][]Firearm, len(values))
+	if len(values) == 0 || first == 0 {
+		return byValue, nil
+	}
+	in, args := inList(values)
+	firearms, err := queryFirearms(ctx, db, `
+		SELECT `+firearmColumns+` FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY `+column+` ORDER BY id) AS row_rank
+			FROM firearms WHERE deleted_at IS NULL AND `+column+` IN (`+in+`)
+		) WHERE row_rank <= ? ORDER BY id`, append(args, first)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range firearms {
+		key := f.Caliber
+		if column == "manufacturer" {
+			key = f.Manufacturer
+		}
+		byValue[key] = append(byValue[key], f)
+	}
+	return byValue, nil
+}
+
+// countByColumn counts the live firearms for each value of a column in one query
+func countByColumn(ctx context.Context, db dbtx, column string, values []string) (map[string]int, error) {
+	counts := make(map[string]int, len(values))
+	if len(values) == 0 {
+		return counts, nil
+	}
+	in, args := inList(values)
+	rows, err := db.QueryContext(ctx, `SELECT `+column+`, COUNT(*) FROM firearms
+		WHERE deleted_at IS NULL AND `+column+` IN (`+in+`) GROUP BY `+column, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		var n int
+		if err := rows.Scan(&value, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		counts[value] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return counts, nil
+}
+
+// similarFirearms loads, for each firearm, the first others of the same
+// caliber and type in one query. Each group is read one row long so a
+// firearm can leave itself out and still have first left.
+func similarFirearms(ctx context.Context, db dbtx, firearms []Firearm, first int) ([][]Firearm, error) {
+	out := make([][]Firearm, len(firearms))
+	if len(firearms) == 0 || first == 0 {
+		return out, nil
+	}
+	type group struct{ caliber, typ string }
+	var groups []group
+	var args []any
+	for _, f := range firearms {
+		if g := (group{f.Caliber, f.Type}); !slices.Contains(groups, g) {
+			groups = append(groups, g)
+			args = append(args, g.caliber, g.typ)
+		}
+	}
+	in := strings.TrimSuffix(strings.Repeat("(?, ?), ", len(groups)), ", ")
+	candidates, err := queryFirearms(ctx, db, `
+		SELECT `+firearmColumns+` FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY caliber, type ORDER BY id) AS row_rank
+			FROM firearms WHERE deleted_at IS NULL AND (caliber, type) IN (VALUES `+in+`)
+		) WHERE row_rank <= ? ORDER BY id`, append(args, first+1)...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, f := range firearms {
+		out[i] = []Firearm{}
+		for _, c := range candidates {
+			if len(out[i]) < first && c.ID != f.ID && c.Caliber == f.Caliber && c.Type == f.Type {
+				out[i] = append(out[i], c)
+			}
+		}
+	}
+	return out, nil
+}
+
+// gqlFirearmFilter reads a FirearmFilter input object
+func gqlFirearmFilter(in map[string]any) FirearmFilter {
+	str := func(name string) string {
+		s, _ := in[name].(string)
+		return s
+	}
+	num := func(name string) *int {
+		if n, ok := in[name].(int); ok {
+			return &n
+		}
+		return nil
+	}
+	return FirearmFilter{
+		Brand: str("brand"), Name: str("name"), Caliber: str("caliber"), Type: str("type"), Country: str("country"),
+		Year: num("year"), MinPrice: num("minPrice"), MaxPrice: num("maxPrice"),
+	}
+}
+
+// searchFirearms runs a Query.firearms: one page of the filtered catalog in
+// the requested order, plus the total number of matches
+func searchFirearms(ctx context.Context, db dbtx, args map[string]any) (gqlFirearmPage, error) {
+	first, err := firstArg(args)
+	if err != nil {
+		return gqlFirearmPage{}, err
+	}
+	offset := args["offset"].(int)
+	if offset < 0 {
+		return gqlFirearmPage{}, gqlErrorf("offset cannot be negative")
+	}
+	filter, _ := args["filter"].(map[string]any)
+	cond, condArgs := gqlFirearmFilter(filter).where()
+
+	var page gqlFirearmPage
+	dir := args["order"].(string)
+	orderBy := fmt.Sprintf("%s %s, id %s", firearmSortColumns[args["sort"].(string)], dir, dir)
+	if page.items, page.total, err = pageFirearms(ctx, db, cond, condArgs, orderBy, first, offset); err != nil {
+		return page, err
+	}
+	page.hasMore = offset+len(page.items) < page.total
+	return page, nil
+}
+
+// findName looks up a manufacturer or caliber by name, ignoring case, and
+// returns it as stored. ok is false when no live firearm has it.
+func findName(ctx context.Context, db dbtx, column, name string) (found string, ok bool, err error) {
+	err = db.QueryRowContext(ctx, `SELECT `+column+` FROM firearms
+		WHERE deleted_at IS NULL AND `+column+` = ? COLLATE NOCASE ORDER BY id LIMIT 1`, name).Scan(&found)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to query database: %w", err)
+	}
+	return found, true, nil
+}
+
+// groupType builds Manufacturer or Caliber, which both stand for the firearms
+// sharing a value of column
+func groupType(db dbtx, name, column string, firearmList func() graphql.Output) *graphql.Object {
+	what := strings.ToLower(name)
+	groupName := func(p graphql.ResolveParams) string { return p.Source.(gqlGroup).name }
+	return graphql.NewObject(graphql.ObjectConfig{Name: name, Fields: graphql.FieldsThunk(func() graphql.Fields {
+		return graphql.Fields{
+			"name": {Type: graphql.NewNonNull(graphql.String), Resolve: gqlField(func(g gqlGroup) any { return g.name })},
+			"firearmCount": {Type: graphql.NewNonNull(graphql.Int), Description: "Live firearms with this " + what,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					counts := batchFor(p, column+".firearmCount", func(names []string) (map[string]int, error) {
+						return countByColumn(p.Context, db, column, names)
+					})
+					return counts.get(groupName(p)), nil
+				}},
+			"firearms": {Type: firearmList(), Description: "The first firearms with this " + what + ", by ID",
+				Args: graphql.FieldConfigArgument{"first": {Type: graphql.Int, DefaultValue: 20}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					first, err := firstArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					byValue := batchFor(p, fmt.Sprintf("%s.firearms(%d)", column, first), func(names []string) (map[string][]Firearm, error) {
+						return firearmsByColumn(p.Context, db, column, names, first)
+					})
+					return byValue.get(groupName(p)), nil
+				}},
+		}
+	})})
+}
+
+// newCatalogSchema builds the GraphQL schema of the catalog. Soft deleted
+// firearms are never visible through it.
+func newCatalogSchema(db dbtx) graphql.Schema {
+	nonNull := graphql.NewNonNull
+	var firearm *graphql.Object
+	firearmList := func() graphql.Output { return nonNull(graphql.NewList(nonNull(firearm))) }
+	manufacturer := groupType(db, "Manufacturer", "manufacturer", firearmList)
+	caliber := groupType(db, "Caliber", "caliber", firearmList)
+
+	source := graphql.NewObject(graphql.ObjectConfig{Name: "Source", Fields: graphql.Fields{
+		"id":         {Type: nonNull(graphql.Int), Resolve: gqlField(func(s Source) any { return s.ID })},
+		"title":      {Type: nonNull(graphql.String), Resolve: gqlField(func(s Source) any { return s.Title })},
+		"publisher":  {Type: nonNull(graphql.String), Resolve: gqlField(func(s Source) any { return s.Publisher })},
+		"url":        {Type: graphql.String, Resolve: gqlField(func(s Source) any { return s.URL })},
+		"isbn":       {Type: graphql.String, Resolve: gqlField(func(s Source) any { return s.ISBN })},
+		"accessedOn": {Type: graphql.String, Resolve: gqlField(func(s Source) any { return s.AccessedOn })},
+		"createdAt":  {Type: nonNull(graphql.String), Resolve: gqlField(func(s Source) any { return s.CreatedAt })},
+	}})
+	citation := graphql.NewObject(graphql.ObjectConfig{Name: "Citation", Fields: graphql.Fields{
+		"id": {Type: nonNull(graphql.Int), Resolve: gqlField(func(ct Citation) any { return ct.ID })},
+		"field": {Type: nonNull(graphql.String), Description: "The JSON name of the cited field",
+			Resolve: gqlField(func(ct Citation) any { return ct.Field })},
+		"confidence": {Type: nonNull(graphql.String), Resolve: gqlField(func(ct Citation) any { return ct.Confidence })},
+		"note":       {Type: nonNull(graphql.String), Resolve: gqlField(func(ct Citation) any { return ct.Note })},
+		"createdAt":  {Type: nonNull(graphql.String), Resolve: gqlField(func(ct Citation) any { return ct.CreatedAt })},
+		"source":     {Type: nonNull(source), Resolve: gqlField(func(ct Citation) any { return ct.Source })},
+	}})
+
+	firearm = graphql.NewObject(graphql.ObjectConfig{Name: "Firearm", Fields: graphql.FieldsThunk(func() graphql.Fields {
+		return graphql.Fields{
+			"id":               {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.ID })},
+			"brand":            {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.Brand })},
+			"name":             {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.Name })},
+			"caliber":          {Type: nonNull(caliber), Resolve: gqlField(func(f Firearm) any { return gqlGroup{f.Caliber} })},
+			"type":             {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.Type })},
+			"magazineCapacity": {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.MagazineCapacity })},
+			"effectiveRange":   {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.EffectiveRange })},
+			"year":             {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.Year })},
+			"price":            {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.Price })},
+			"manufacturer": {Type: manufacturer, Resolve: gqlField(func(f Firearm) any {
+				if f.Manufacturer == "" {
+					return nil
+				}
+				return gqlGroup{f.Manufacturer}
+			})},
+			"weight":          {Type: nonNull(graphql.Float), Resolve: gqlField(func(f Firearm) any { return f.Weight })},
+			"barrelLength":    {Type: nonNull(graphql.Float), Resolve: gqlField(func(f Firearm) any { return f.BarrelLength })},
+			"action":          {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.Action })},
+			"countryOfOrigin": {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.CountryOfOrigin })},
+			"createdAt":       {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.CreatedAt })},
+			"updatedAt":       {Type: nonNull(graphql.String), Resolve: gqlField(func(f Firearm) any { return f.UpdatedAt })},
+			"version":         {Type: nonNull(graphql.Int), Resolve: gqlField(func(f Firearm) any { return f.Version })},
+			"similar": {Type: firearmList(), Description: "Other firearms of the same caliber and type, by ID",
+				Args: graphql.FieldConfigArgument{"first": {Type: graphql.Int, DefaultValue: 5}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					first, err := firstArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					similar := batchFor(p, fmt.Sprintf("similar(%d)", first), func(firearms []Firearm) (map[Firearm][]Firearm, error) {
+						lists, err := similarFirearms(p.Context, db, firearms, first)
+						if err != nil {
+							return nil, err
+						}
+						byFirearm := make(map[Firearm][]Firearm, len(firearms))
+						for i, f := range firearms {
+							byFirearm[f] = lists[i]
+						}
+						return byFirearm, nil
+					})
+					return similar.get(p.Source.(Firearm)), nil
+				}},
+			"sources": {Type: nonNull(graphql.NewList(nonNull(citation))), Description: "Citations backing the firearm's fields, by field",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					sources := batchFor(p, "sources", func(ids []int) (map[int][]Citation, error) {
+						cited, err := citationsFor(p.Context, db, ids)
+						if err != nil {
+							return nil, err
+						}
+						byID := make(map[int][]Citation, len(ids))
+						for _, id := range ids {
+							citations := []Citation{}
+							for _, field := range slices.Sorted(maps.Keys(cited[id])) {
+								citations = append(citations, cited[id][field]...)
+							}
+							byID[id] = citations
+						}
+						return byID, nil
+					})
+					return sources.get(p.Source.(Firearm).ID), nil
+				}},
+		}
+	})})
+
+	page := graphql.NewObject(graphql.ObjectConfig{Name: "FirearmPage", Fields: graphql.Fields{
+		"total": {Type: nonNull(graphql.Int), Description: "Firearms matching the filter across all pages",
+			Resolve: gqlField(func(p gqlFirearmPage) any { return p.total })},
+		"hasMore": {Type: nonNull(graphql.Boolean), Resolve: gqlField(func(p gqlFirearmPage) any { return p.hasMore })},
+		"items":   {Type: firearmList(), Resolve: gqlField(func(p gqlFirearmPage) any { return p.items })},
+	}})
+	filter := graphql.NewInputObject(graphql.InputObjectConfig{Name: "FirearmFilter",
+		Description: "Matches like the REST list routes: brand and year exactly, name, caliber, type and country in part, ignoring case",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"brand":    {Type: graphql.String},
+			"name":     {Type: graphql.String},
+			"caliber":  {Type: graphql.String},
+			"type":     {Type: graphql.String},
+			"country":  {Type: graphql.String},
+			"year":     {Type: graphql.Int},
+			"minPrice": {Type: graphql.Int},
+			"maxPrice": {Type: graphql.Int},
+		}})
+	sortValues := graphql.EnumValueConfigMap{}
+	for name := range firearmSortColumns {
+		sortValues[name] = &graphql.EnumValueConfig{Value: name}
+	}
+	sortEnum := graphql.NewEnum(graphql.EnumConfig{Name: "FirearmSort", Values: sortValues})
+	orderEnum := graphql.NewEnum(graphql.EnumConfig{Name: "SortOrder", Values: graphql.EnumValueConfigMap{
+		"ASC": {Value: "ASC"}, "DESC": {Value: "DESC"},
+	}})
+
+	findGroup := func(column string) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (any, error) {
+			name, ok, err := findName(p.Context, db, column, p.Args["name"].(string))
+			if !ok || err != nil {
+				return nil, err
+			}
+			return gqlGroup{name}, nil
+		}
+	}
+	query := graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+		"firearm": {Type: firearm, Description: "A firearm by ID, null when there is none",
+			Args: graphql.FieldConfigArgument{"id": {Type: nonNull(graphql.Int)}},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				f, err := getFirearm(p.Context, db, p.Args["id"].(int))
+				if err == sql.ErrNoRows {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, fmt.Errorf("failed to query database: %w", err)
+				}
+				return f, nil
+			}},
+		// Arguments with a default are nullable: the library only fills in
+		// defaults for those, and uses them for a null too
+		"firearms": {Type: nonNull(page), Description: "Firearms matching filter, a page at a time",
+			Args: graphql.FieldConfigArgument{
+				"filter": {Type: filter},
+				"sort":   {Type: sortEnum, DefaultValue: "ID"},
+				"order":  {Type: orderEnum, DefaultValue: "ASC"},
+				"first":  {Type: graphql.Int, DefaultValue: 20},
+				"offset": {Type: graphql.Int, DefaultValue: 0},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) { return searchFirearms(p.Context, db, p.Args) }},
+		"manufacturer": {Type: manufacturer, Description: "A manufacturer by name, ignoring case",
+			Args: graphql.FieldConfigArgument{"name": {Type: nonNull(graphql.String)}}, Resolve: findGroup("manufacturer")},
+		"caliber": {Type: caliber, Description: "A caliber by name, ignoring case",
+			Args: graphql.FieldConfigArgument{"name": {Type: nonNull(graphql.String)}}, Resolve: findGroup("caliber")},
+	}})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL schema: %v", err))
+	}
+	return schema
+}
+
+// graphQLRequest is the body of POST /graphql, also accepted as the query
+// string of GET /graphql with variables as JSON
+type graphQLRequest struct {
+	Query         string         `json:"query" form:"query"`
+	OperationName string         `json:"operationName" form:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphQLErrors is the body of a failed GraphQL request
+func graphQLErrors(err error) gin.H {
+	return gin.H{"errors": []gin.H{{"message": err.Error()}}}
+}
+
+// GraphQL serves read-only GraphQL queries over the catalog. A query is
+// parsed, validated and costed before it runs, and rejected with 400 when it
+// is invalid or too expensive. A failure while running it is logged with the
+// request ID and answered with a bare 500.
+func GraphQL(db *sql.DB) gin.HandlerFunc {
+	schema := newCatalogSchema(db)
+	return func(c *gin.Context) {
+		var body graphQLRequest
+		if c.Request.Method == http.MethodGet {
+			body.Query, body.OperationName = c.Query("query"), c.Query("operationName")
+			if raw := c.Query("variables"); raw != "" {
+				if err := json.Unmarshal([]byte(raw), &body.Variables); err != nil {
+					c.JSON(http.StatusBadRequest, graphQLErrors(fmt.Errorf("variables must be a JSON object: %v", err)))
+					return
+				}
+			}
+		} else if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, graphQLErrors(fmt.Errorf("invalid request body: %v", err)))
+			return
+		}
+		if body.Query == "" {
+			c.JSON(http.StatusBadRequest, graphQLErrors(errors.New("query is required")))
+			return
+		}
+		if len(body.Query) > graphQLMaxQuery {
+			c.JSON(http.StatusBadRequest, graphQLErrors(fmt.Errorf("query is longer than %d bytes", graphQLMaxQuery)))
+			return
+		}
+
+		res, err := runGraphQL(c.Request.Context(), schema, body)
+		switch {
+		case err != nil:
+			// Internal errors can carry SQL and paths, so they go to the log only
+			requestLogger(c).Error("graphql query failed", "error", err)
+			c.JSON(http.StatusInternalServerError, graphQLErrors(errors.New("internal server error")))
+		case len(res.Errors) > 0:
+			c.JSON(http.StatusBadRequest, gin.H{"errors": res.Errors})
+		default:
+			c.JSON(http.StatusOK, gin.H{"data": res.Data})
+		}
+	}
+}
+
+// GraphQLSchema serves the schema of /graphql in the schema definition language
+func GraphQLSchema(db *sql.DB) gin.HandlerFunc {
+	sdl := gqlSDL(newCatalogSchema(db))
+	return func(c *gin.Context) {
+		c.String(http.StatusOK, sdl)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingDB counts the queries run through it
+type countingDB struct {
+	*sql.DB
+	queries int
+}
+
+func (db *countingDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	db.queries++
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *countingDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	db.queries++
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+// graphQLPost sends a query with variables to /graphql and splits up the response,
+// keeping data and errors as sent. Objects come back with their keys sorted.
+func graphQLPost(t *testing.T, h http.Handler, query string, variables map[string]any) (int, map[string]json.RawMessage) {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := doRequest(h, http.MethodPost, "/graphql", string(body))
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return w.Code, resp
+}
+
+func addGraphQLFirearms(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, f := range []Firearm{
+		{Brand: "Glock", Name: "17", Caliber: "9mm", Type: "pistol", Year: 1982, Price: 550, Manufacturer: "Glock Ges.m.b.H."},
+		{Brand: "Glock", Name: "19", Caliber: "9mm", Type: "pistol", Year: 1988, Price: 560, Manufacturer: "Glock Ges.m.b.H."},
+		{Brand: "Sig Sauer", Name: "P226", Caliber: "9mm", Type: "pistol", Year: 1984, Price: 1100, Manufacturer: "Sig Sauer"},
+		{Brand: "Colt", Name: "M1911", Caliber: ".45 ACP", Type: "pistol", Year: 1911, Price: 900},
+		{Brand: "Colt", Name: "AR-15", Caliber: "5.56mm", Type: "rifle", Year: 1964, Price: 1200},
+	} {
+		if _, err := insertFirearm(t.Context(), db, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	db := newTestDB(t)
+	addGraphQLFirearms(t, db)
+	r := gin.New()
+	r.GET("/graphql", GraphQL(db))
+	r.POST("/graphql", GraphQL(db))
+
+	code, resp := graphQLPost(t, r, `
+		query Pistols($filter: FirearmFilter, $first: Int = 2) {
+			page: firearms(filter: $filter, sort: PRICE, order: DESC, first: $first) {
+				total
+				hasMore
+				items { ...basics caliber { name firearmCount } manufacturer { name } }
+			}
+		}
+		fragment basics on Firearm { __typename id name price }`,
+		map[string]any{"filter": map[string]any{"type": "pistol", "maxPrice": 1000}})
+	if code != http.StatusOK {
+		t.Fatalf("query got %d: %v", code, resp)
+	}
+	got := resp["data"]
+	want := `{"page":{"hasMore":true,"items":[` +
+		`{"__typename":"Firearm","caliber":{"firearmCount":1,"name":".45 ACP"},"id":4,"manufacturer":null,"name":"M1911","price":900},` +
+		`{"__typename":"Firearm","caliber":{"firearmCount":3,"name":"9mm"},"id":2,"manufacturer":{"name":"Glock Ges.m.b.H."},"name":"19","price":560}],"total":3}}`
+	if string(got) != want {
+		t.Errorf("data = %s\nwant   %s", got, want)
+	}
+
+	// Filters match like the REST routes do, and GET works too
+	q := url.Values{"query": {`{ firearms(filter: {brand: "glock", name: "1"}, offset: 1) { total items { name } } }`}}
+	w := doRequest(r, http.MethodGet, "/graphql?"+q.Encode(), "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"data":{"firearms":{"items":[{"name":"19"}],"total":2}}}` {
+		t.Errorf("GET got %d: %s", w.Code, w.Body)
+	}
+
+	code, resp = graphQLPost(t, r, `{
+		firearm(id: 1) { name similar(first: 1) { name } sources { field } }
+		missing: firearm(id: 99) { name }
+		manufacturer(name: "glock ges.m.b.h.") { name firearms { name } }
+		nobody: caliber(name: "7.62mm") { name }
+		glock: firearm(id: 1) @skip(if: true) { name }
+	}`, nil)
+	got = resp["data"]
+	want = `{"firearm":{"name":"17","similar":[{"name":"19"}],"sources":[]},` +
+		`"manufacturer":{"firearms":[{"name":"17"},{"name":"19"}],"name":"Glock Ges.m.b.H."},"missing":null,"nobody":null}`
+	if code != http.StatusOK || string(got) != want {
+		t.Errorf("lookups got %d: %s\nwant %s", code, got, want)
+	}
+
+	for query, wantErr := range map[string]string{
+		`{ firearms { items { serial } } }`:   `Cannot query field \"serial\"`,
+		`{ firearms { total items } }`:        `must have a sub selection`,
+		`{ firearms(first: 500) { total } }`:  `first must be between 0 and 100`,
+		`{ firearms(sort: COLOR) { total } }`: `has invalid value COLOR`,
+		`{ firearm(id: "one") { name } }`:     `has invalid value \"one\"`,
+		`mutation { deleteFirearm(id: 1) }`:   `mutation operations are not supported`,
+		`{ firearm(id: 1) { ...a } } fragment a on Firearm { ...b } fragment b on Firearm { ...a }`: `within itself`,
+		`{ firearm(id: 1) { name }`: `Expected Name, found EOF`,
+		`{ firearms(first: 100) { items { similar(first: 100) { name } } } }`: `query complexity`,
+	} {
+		code, resp := graphQLPost(t, r, query, nil)
+		errs := resp["errors"]
+		if code != http.StatusBadRequest || !strings.Contains(string(errs), wantErr) {
+			t.Errorf("%s got %d: %s, want an error containing %q", query, code, errs, wantErr)
+		}
+	}
+
+	// What went wrong inside stays in the log
+	if _, err := db.Exec(`DROP TABLE firearm_citations`); err != nil {
+		t.Fatal(err)
+	}
+	code, resp = graphQLPost(t, r, `{ firearm(id: 1) { sources { field } } }`, nil)
+	if errs := string(resp["errors"]); code != http.StatusInternalServerError || errs != `[{"message":"internal server error"}]` {
+		t.Errorf("failed query got %d: %s", code, errs)
+	}
+}
+
+func TestGraphQLBatching(t *testing.T) {
+	db := newTestDB(t)
+	addGraphQLFirearms(t, db)
+	counting := &countingDB{DB: db}
+	res, err := runGraphQL(context.Background(), newCatalogSchema(counting), graphQLRequest{Query: `{
+		firearms(first: 5) {
+			items {
+				name
+				similar { name caliber { firearmCount } }
+				manufacturer { firearms { name } }
+				sources { source { title } }
+			}
+		}
+	}`})
+	if err != nil || len(res.Errors) > 0 {
+		t.Fatal(err, res)
+	}
+	// A count and a page, then one query per field that loads anything:
+	// similar, its calibers' counts, manufacturers' firearms and sources
+	if counting.queries != 6 {
+		t.Errorf("ran %d queries, want 6", counting.queries)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+//go:generate protoc -I proto -I third_party/googleapis --go_out=. --go_opt=module=gundatabase --go-grpc_out=. --go-grpc_opt=module=gundatabase catalog/v1/catalog.proto
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gundatabase/catalogpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// Page sizes of ListFirearms and SearchFirearms, when none is asked for and at most
+const (
+	grpcPageSize    = 20
+	grpcMaxPageSize = 100
+)
+
+// pageTokenPrefix versions the page token format
+const pageTokenPrefix = "o1:"
+
+// catalogServer implements the FirearmCatalog gRPC service on the same store
+// as the HTTP API
+type catalogServer struct {
+	catalogpb.UnimplementedFirearmCatalogServer
+	db *sql.DB
+}
+
+// CatalogServer is a gRPC server with the FirearmCatalog service
+type CatalogServer struct {
+	*grpc.Server
+	db       *sql.DB
+	sessions *Sessions
+	// streams is done once shutdown begins, ending WatchFirearms calls
+	streams     context.Context
+	stopStreams context.CancelFunc
+}
+
+// grpcMethodScopes are the scopes gRPC methods need, like the scopes of their
+// HTTP counterparts. Methods without one can be called anonymously.
+var grpcMethodScopes = map[string]string{
+	catalogpb.FirearmCatalog_WatchFirearms_FullMethodName: ScopeRead,
+}
+
+// NewCatalogServer returns a gRPC server with the FirearmCatalog service and
+// server reflection, so tools like grpcurl can call it without the .proto.
+// Calls are traced and authenticated like HTTP requests.
+func NewCatalogServer(db *sql.DB, sessions *Sessions) *CatalogServer {
+	s := &CatalogServer{db: db, sessions: sessions}
+	s.streams, s.stopStreams = context.WithCancel(context.Background())
+	s.Server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(traceUnary, s.authenticateUnary),
+		grpc.ChainStreamInterceptor(traceStream, s.endStreams, s.authenticateStream))
+	catalogpb.RegisterFirearmCatalogServer(s.Server, &catalogServer{db: db})
+	reflection.Register(s.Server)
+	return s
+}
+
+// endStreams ends a streaming call's context once shutdown begins, the way
+// the HTTP server ends /events streams
+func (s *CatalogServer) endStreams(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.streams, cancel)
+	defer stop()
+	return handler(srv, tracedStream{ss, ctx})
+}
+
+// grpcCaller is the user session or API key a gRPC call was made with. Both
+// are nil for anonymous calls.
+type grpcCaller struct {
+	claims *Claims
+	key    *APIKey
+}
+
+type grpcCallerKey struct{}
+
+// hasScope reports whether the caller's key or session grants scope
+func (c grpcCaller) hasScope(scope string) bool {
+	if c.claims != nil {
+		return scopeGrants(roleScopes[c.claims.Role], scope)
+	}
+	return c.key != nil && c.key.HasScope(scope)
+}
+
+// callerOf returns the caller authenticate stored on a call's context
+func callerOf(ctx context.Context) grpcCaller {
+	c, _ := ctx.Value(grpcCallerKey{}).(grpcCaller)
+	return c
+}
+
+// authenticate resolves the API key or user access token sent as
+// authorization: Bearer <key> or x-api-key metadata, the same way
+// Authenticate does for HTTP headers, and checks it grants the scope method
+// needs. A secret that doesn't resolve is UNAUTHENTICATED rather than anonymous.
+func (s *CatalogServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	var caller grpcCaller
+	md, _ := metadata.FromIncomingContext(ctx)
+	if secret := metadataAPIKey(md); secret != "" {
+		claims, k, err := resolveSecret(ctx, s.db, s.sessions, secret)
+		if err == errInvalidToken || err == errInvalidAPIKey {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if err != nil {
+			return nil, internalError(err)
+		}
+		caller = grpcCaller{claims: claims, key: k}
+	}
+
+	if scope, ok := grpcMethodScopes[method]; ok && !caller.hasScope(scope) {
+		if caller.claims == nil && caller.key == nil {
+			return nil, status.Errorf(codes.Unauthenticated, "an API key or user session with the %s scope is required", scope)
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "the %s scope is required", scope)
+	}
+	return context.WithValue(ctx, grpcCallerKey{}, caller), nil
+}
+
+// metadataAPIKey extracts the secret sent with a call, if any
+func metadataAPIKey(md metadata.MD) string {
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		if scheme, token, ok := strings.Cut(auth[0], " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		return strings.TrimSpace(keys[0])
+	}
+	return ""
+}
+
+// authenticateUnary authenticates unary calls
+func (s *CatalogServer) authenticateUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticateStream authenticates streaming calls
+func (s *CatalogServer) authenticateStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, tracedStream{ss, ctx})
+}
+
+// Shutdown ends open streams and waits for the calls in flight to finish,
+// stopping the server outright if ctx runs out first
+func (s *CatalogServer) Shutdown(ctx context.Context) error {
+	s.stopStreams()
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return fmt.Errorf("failed to finish in-flight calls: %w", ctx.Err())
+	}
+}
+
+// firearmProto converts a firearm to its protobuf message
+func firearmProto(f Firearm) *catalogpb.Firearm {
+	return &catalogpb.Firearm{
+		Id:               int64(f.ID),
+		Brand:            f.Brand,
+		Name:             f.Name,
+		Caliber:          f.Caliber,
+		Type:             f.Type,
+		MagazineCapacity: int32(f.MagazineCapacity),
+		EffectiveRange:   int32(f.EffectiveRange),
+		Year:             int32(f.Year),
+		Price:            int32(f.Price),
+		Manufacturer:     f.Manufacturer,
+		Weight:           f.Weight,
+		BarrelLength:     f.BarrelLength,
+		Action:           f.Action,
+		CountryOfOrigin:  f.CountryOfOrigin,
+		CreatedAt:        f.CreatedAt,
+		UpdatedAt:        f.UpdatedAt,
+		Version:          int32(f.Version),
+	}
+}
+
+func firearmProtos(firearms []Firearm) []*catalogpb.Firearm {
+	out := make([]*catalogpb.Firearm, len(firearms))
+	for i, f := range firearms {
+		out[i] = firearmProto(f)
+	}
+	return out
+}
+
+// changeProto converts a change event to its protobuf message
+func changeProto(ev ChangeEvent) *catalogpb.FirearmChange {
+	ch := &catalogpb.FirearmChange{
+		Id:         int64(ev.ID),
+		Type:       ev.Type,
+		FirearmId:  int64(ev.FirearmID),
+		Actor:      ev.Actor,
+		OccurredAt: ev.OccurredAt,
+	}
+	if ev.Before != nil {
+		ch.Before = firearmProto(*ev.Before)
+	}
+	if ev.After != nil {
+		ch.After = firearmProto(*ev.After)
+	}
+	return ch
+}
+
+// pageToken encodes the offset of the next page as an opaque token
+func pageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pageTokenPrefix + strconv.Itoa(offset)))
+}
+
+// pageBounds works out the limit and offset of a page from its size and token
+func pageBounds(size int32, token string) (limit, offset int, err error) {
+	switch {
+	case size < 0:
+		return 0, 0, status.Error(codes.InvalidArgument, "page_size cannot be negative")
+	case size == 0:
+		limit = grpcPageSize
+	default:
+		limit = min(int(size), grpcMaxPageSize)
+	}
+	if token == "" {
+		return limit, 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil && strings.HasPrefix(string(raw), pageTokenPrefix) {
+		offset, err = strconv.Atoi(strings.TrimPrefix(string(raw), pageTokenPrefix))
+	}
+	if err != nil || !strings.HasPrefix(string(raw), pageTokenPrefix) || offset < 0 {
+		return 0, 0, status.Error(codes.InvalidArgument, "invalid page_token")
+	}
+	return limit, offset, nil
+}
+
+// nextPageToken returns the token of the page after one, empty after the last
+func nextPageToken(offset, count, total int) string {
+	if offset+count >= total {
+		return ""
+	}
+	return pageToken(offset + count)
+}
+
+// internalError hides a store failure behind an INTERNAL status
+func internalError(err error) error {
+	return status.Error(codes.Internal, err.Error())
+}
+
+func optionalInt(n *int32) *int {
+	if n == nil {
+		return nil
+	}
+	v := int(*n)
+	return &v
+}
+
+func (s *catalogServer) GetFirearm(ctx context.Context, req *catalogpb.GetFirearmRequest) (*catalogpb.Firearm, error) {
+	f, err := getFirearm(ctx, s.db, int(req.Id))
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "no firearm found with id: %d", req.Id)
+	}
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return firearmProto(f), nil
+}
+
+func (s *catalogServer) ListFirearms(ctx context.Context, req *catalogpb.ListFirearmsRequest) (*catalogpb.ListFirearmsResponse, error) {
+	limit, offset, err := pageBounds(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	filter := FirearmFilter{
+		Brand: req.Brand, Name: req.Name, Caliber: req.Caliber, Type: req.Type, Country: req.Country,
+		Year: optionalInt(req.Year), MinPrice: optionalInt(req.MinPrice), MaxPrice: optionalInt(req.MaxPrice),
+	}
+	cond, args := filter.where()
+	firearms, total, err := pageFirearms(ctx, s.db, cond, args, "id", limit, offset)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return &catalogpb.ListFirearmsResponse{
+		Firearms:      firearmProtos(firearms),
+		NextPageToken: nextPageToken(offset, len(firearms), total),
+		TotalSize:     int32(total),
+	}, nil
+}
+
+func (s *catalogServer) SearchFirearms(ctx context.Context, req *catalogpb.SearchFirearmsRequest) (*catalogpb.SearchFirearmsResponse, error) {
+	words := strings.Fields(req.Query)
+	if len(words) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "query is required")
+	}
+	limit, offset, err := pageBounds(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, args := searchWhere(words)
+	firearms, total, err := pageFirearms(ctx, s.db, cond, args, "id", limit, offset)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return &catalogpb.SearchFirearmsResponse{
+		Firearms:      firearmProtos(firearms),
+		NextPageToken: nextPageToken(offset, len(firearms), total),
+		TotalSize:     int32(total),
+	}, nil
+}
+
+// countsBy counts the live firearms by the values of a column, most common first
+func countsBy(ctx context.Context, db dbtx, column string) ([]*catalogpb.Count, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+column+", COUNT(*) AS n FROM firearms WHERE deleted_at IS NULL GROUP BY "+column+" ORDER BY n DESC, "+column)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+
+	var counts []*catalogpb.Count
+	for rows.Next() {
+		c := &catalogpb.Count{}
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return counts, nil
+}
+
+func (s *catalogServer) GetStats(ctx context.Context, req *catalogpb.GetStatsRequest) (*catalogpb.Stats, error) {
+	stats := &catalogpb.Stats{}
+	// One transaction keeps the totals and the counts consistent
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(MIN(price), 0), COALESCE(MAX(price), 0), COALESCE(AVG(price), 0),
+				COALESCE(MIN(year), 0), COALESCE(MAX(year), 0)
+			FROM firearms WHERE deleted_at IS NULL`).Scan(
+			&stats.Total, &stats.MinPrice, &stats.MaxPrice, &stats.AveragePrice, &stats.OldestYear, &stats.NewestYear)
+		if err != nil {
+			return fmt.Errorf("failed to query database: %w", err)
+		}
+		if stats.ByType, err = countsBy(ctx, tx, "type"); err != nil {
+			return err
+		}
+		if stats.ByCaliber, err = countsBy(ctx, tx, "caliber"); err != nil {
+			return err
+		}
+		stats.ByCountry, err = countsBy(ctx, tx, "country_of_origin")
+		return err
+	})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return stats, nil
+}
+
+// WatchFirearms follows the changelog like StreamEvents does, sending each
+// change as it is found until the client goes away
+func (s *catalogServer) WatchFirearms(req *catalogpb.WatchFirearmsRequest, stream catalogpb.FirearmCatalog_WatchFirearmsServer) error {
+	var last int
+	if req.LastEventId != nil {
+		if *req.LastEventId < 0 {
+			return status.Error(codes.InvalidArgument, "last_event_id cannot be negative")
+		}
+		last = int(*req.LastEventId)
+	} else {
+		var err error
+		if last, err = latestChange(stream.Context(), s.db); err != nil {
+			return internalError(err)
+		}
+	}
+
+	// Actors name accounts and keys, so like /events only write callers get them
+	withActors := callerOf(stream.Context()).hasScope(ScopeWrite)
+	var sendErr error
+	err := followChanges(stream.Context(), s.db, last, nil, func(events []ChangeEvent) error {
+		for _, ev := range events {
+			if !withActors {
+				ev.Actor = ""
+			}
+			if sendErr = stream.Send(changeProto(ev)); sendErr != nil {
+				return sendErr
+			}
+		}
+		return nil
+	})
+	switch {
+	case sendErr != nil:
+		return sendErr
+	case err != nil:
+		return internalError(err)
+	}
+	return status.FromContextError(stream.Context().Err()).Err()
+}
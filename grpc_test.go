@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gundatabase/catalogpb"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newCatalogClient serves the catalog over an in-memory connection and returns a client for it
+func newCatalogClient(t *testing.T, db *sql.DB) catalogpb.FirearmCatalogClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := NewCatalogServer(db, testSessions(t))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///catalog",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return catalogpb.NewFirearmCatalogClient(conn)
+}
+
+func TestCatalogServer(t *testing.T) {
+	db := newTestDB(t)
+	addGraphQLFirearms(t, db)
+	client := newCatalogClient(t, db)
+	ctx := context.Background()
+
+	f, err := client.GetFirearm(ctx, &catalogpb.GetFirearmRequest{Id: 3})
+	if err != nil || f.Name != "P226" || f.Manufacturer != "Sig Sauer" {
+		t.Fatalf("GetFirearm = %v, %v", f, err)
+	}
+	if _, err := client.GetFirearm(ctx, &catalogpb.GetFirearmRequest{Id: 99}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetFirearm of a missing firearm got %v, want NotFound", err)
+	}
+	// Reads work anonymously, but a key that doesn't resolve is rejected
+	badKey := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer gk_nope")
+	if _, err := client.GetFirearm(badKey, &catalogpb.GetFirearmRequest{Id: 3}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("GetFirearm with an unknown key got %v, want Unauthenticated", err)
+	}
+
+	// Page through the pistols under 1000 two at a time
+	var names []string
+	req := &catalogpb.ListFirearmsRequest{Type: "pistol", MaxPrice: proto.Int32(1000), PageSize: 2}
+	for pages := 0; ; pages++ {
+		resp, err := client.ListFirearms(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TotalSize != 3 || pages > 1 {
+			t.Fatalf("ListFirearms = %v", resp)
+		}
+		for _, f := range resp.Firearms {
+			names = append(names, f.Name)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if len(names) != 3 || names[0] != "17" || names[2] != "M1911" {
+		t.Errorf("listed %v", names)
+	}
+	if _, err := client.ListFirearms(ctx, &catalogpb.ListFirearmsRequest{PageToken: "nope"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListFirearms with a bad token got %v, want InvalidArgument", err)
+	}
+
+	found, err := client.SearchFirearms(ctx, &catalogpb.SearchFirearmsRequest{Query: "glock 19"})
+	if err != nil || found.TotalSize != 1 || found.Firearms[0].Name != "19" {
+		t.Errorf("SearchFirearms = %v, %v", found, err)
+	}
+
+	stats, err := client.GetStats(ctx, &catalogpb.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 5 || stats.MinPrice != 550 || stats.MaxPrice != 1200 || stats.OldestYear != 1911 ||
+		stats.ByType[0].Value != "pistol" || stats.ByType[0].Count != 4 || stats.ByCaliber[0].Value != "9mm" {
+		t.Errorf("GetStats = %v", stats)
+	}
+}
+
+func TestWatchFirearms(t *testing.T) {
+	defer func(poll time.Duration) { eventPollInterval = poll }(eventPollInterval)
+	eventPollInterval = 10 * time.Millisecond
+
+	db := newTestDB(t)
+	client := newCatalogClient(t, db)
+	_, readSecret, err := createAPIKey(t.Context(), db, "replica", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writeSecret, err := createAPIKey(t.Context(), db, "editor", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+	r.DELETE("/firearms/:id", DeleteFirearm(db, testWrites))
+
+	if w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`); w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Replaying the changelog needs at least the read scope, and only write
+	// callers see who made a change
+	watch := func(md ...string) (catalogpb.FirearmCatalog_WatchFirearmsClient, *catalogpb.FirearmChange, error) {
+		t.Helper()
+		stream, err := client.WatchFirearms(metadata.AppendToOutgoingContext(ctx, md...), &catalogpb.WatchFirearmsRequest{LastEventId: proto.Int64(0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch, err := stream.Recv()
+		return stream, ch, err
+	}
+	if _, _, err := watch(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("anonymous watch got %v, want Unauthenticated", err)
+	}
+	if _, _, err := watch("x-api-key", "gk_nope"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("watch with an unknown key got %v, want Unauthenticated", err)
+	}
+	if _, ch, err := watch("authorization", "Bearer "+writeSecret); err != nil || ch.Actor != "anonymous" {
+		t.Errorf("watch with a write key = %v, %v, want the actor", ch, err)
+	}
+	stream, ch, err := watch("x-api-key", readSecret)
+	if err != nil || ch.Id != 1 || ch.Type != EventFirearmCreated || ch.Before != nil || ch.After.Name != "17" || ch.Actor != "" {
+		t.Fatalf("replayed change = %v, %v", ch, err)
+	}
+
+	if w := doRequest(r, http.MethodDelete, "/firearms/1", "", "If-Match", "*"); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+	ch, err = stream.Recv()
+	if err != nil || ch.Id != 2 || ch.Type != EventFirearmDeleted || ch.Before.Name != "17" || ch.After != nil {
+		t.Fatalf("live change = %v, %v", ch, err)
+	}
+}
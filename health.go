@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build details, set at link time with
+//
+//	go build -ldflags "-X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// and otherwise taken from the VCS stamp go build records
+var (
+	buildCommit string
+	buildTime   string
+)
+
+// readinessTimeout bounds the checks of a single /readyz probe
+const readinessTimeout = 2 * time.Second
+
+// Readiness tracks whether the server should get new traffic. It starts out
+// ready and is drained once shutdown begins, so /readyz fails while in-flight
+// requests finish. Streams like /events never finish on their own, so they
+// are told to end apart from the other requests.
+type Readiness struct {
+	draining     atomic.Bool
+	stopStreams  sync.Once
+	streamsEnded chan struct{}
+}
+
+// NewReadiness returns a Readiness that hasn't been drained
+func NewReadiness() *Readiness {
+	return &Readiness{streamsEnded: make(chan struct{})}
+}
+
+// Drain makes /readyz fail from now on
+func (r *Readiness) Drain() {
+	r.draining.Store(true)
+}
+
+// Draining reports whether Drain was called
+func (r *Readiness) Draining() bool {
+	return r.draining.Load()
+}
+
+// EndStreams tells the streaming responses still open to end
+func (r *Readiness) EndStreams() {
+	r.stopStreams.Do(func() { close(r.streamsEnded) })
+}
+
+// StreamsEnded is closed once EndStreams is called
+func (r *Readiness) StreamsEnded() <-chan struct{} {
+	return r.streamsEnded
+}
+
+// BuildInfo describes the running binary and the data it serves
+type BuildInfo struct {
+	Commit           string    `json:"commit"`
+	BuildTime        string    `json:"build_time"`
+	GoVersion        string    `json:"go_version"`
+	SchemaVersion    int       `json:"schema_version"`
+	DatasetVersion   int64     `json:"dataset_version"`
+	DatasetUpdatedAt time.Time `json:"dataset_updated_at"`
+}
+
+// buildDetails returns the commit and build time of the binary, from the
+// link-time variables or else the VCS stamp, "unknown" when neither has them
+func buildDetails() (commit, builtAt string) {
+	commit, builtAt = buildCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && builtAt == "":
+				builtAt = s.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if builtAt == "" {
+		builtAt = "unknown"
+	}
+	return commit, builtAt
+}
+
+// checkReadiness runs the readiness checks, returning the outcome of each and
+// whether they all passed
+func checkReadiness(ctx context.Context, db *sql.DB) (map[string]string, bool) {
+	checks := map[string]string{"database": "ok", "migrations": "ok", "seed_data": "ok"}
+	if err := db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		checks["migrations"] = "not checked"
+		checks["seed_data"] = "not checked"
+		return checks, false
+	}
+
+	ok := true
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		checks["migrations"], ok = err.Error(), false
+	} else if version != len(migrations) {
+		checks["migrations"], ok = fmt.Sprintf("schema version is %d, want %d", version, len(migrations)), false
+	}
+	var seeded bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM firearms WHERE deleted_at IS NULL)").Scan(&seeded); err != nil {
+		checks["seed_data"], ok = err.Error(), false
+	} else if !seeded {
+		checks["seed_data"], ok = "no firearms loaded", false
+	}
+	return checks, ok
+}
+
+// Healthz answers 200 as long as the process can serve requests at all
+func Healthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Readyz answers 200 when the database is reachable, fully migrated and has
+// firearms loaded, and 503 with the failing checks otherwise or once the
+// server has started shutting down
+func Readyz(db *sql.DB, readiness *Readiness) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if readiness.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+		checks, ok := checkReadiness(ctx, db)
+		if !ok {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+	}
+}
+
+// Version reports the build of the binary along with the schema and dataset
+// versions of the database it serves
+func Version(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := BuildInfo{GoVersion: runtime.Version()}
+		info.Commit, info.BuildTime = buildDetails()
+
+		var err error
+		if info.SchemaVersion, err = schemaVersion(db); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if info.DatasetVersion, info.DatasetUpdatedAt, err = tableVersion(c.Request.Context(), db, "firearms"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, info)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProbes(t *testing.T) {
+	db := newTestDB(t)
+	readiness := NewReadiness()
+	r := gin.New()
+	r.GET("/healthz", Healthz())
+	r.GET("/readyz", Readyz(db, readiness))
+	r.GET("/version", Version(db))
+
+	if w := doRequest(r, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("healthz got %d", w.Code)
+	}
+
+	// An empty catalog isn't ready to serve
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	w := doRequest(r, http.MethodGet, "/readyz", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusServiceUnavailable ||
+		body.Checks["database"] != "ok" || body.Checks["migrations"] != "ok" || body.Checks["seed_data"] != "no firearms loaded" {
+		t.Errorf("readyz without firearms got %d: %s", w.Code, w.Body)
+	}
+
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	if w := doRequest(r, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("readyz got %d: %s", w.Code, w.Body)
+	}
+
+	var info BuildInfo
+	w = doRequest(r, http.MethodGet, "/version", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || w.Code != http.StatusOK ||
+		info.SchemaVersion != len(migrations) || info.DatasetVersion < 1 || info.Commit == "" || info.GoVersion == "" {
+		t.Errorf("version got %d: %s", w.Code, w.Body)
+	}
+
+	// Once shutdown starts the server is taken out of rotation, though still alive
+	readiness.Drain()
+	if w := doRequest(r, http.MethodGet, "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining got %d", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("healthz while draining got %d", w.Code)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Revision actions
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// Revision is one recorded write to a firearm
+type Revision struct {
+	ID        int           `json:"id"`
+	FirearmID int           `json:"firearm_id"`
+	Action    string        `json:"action"`
+	Actor     string        `json:"actor,omitempty"`
+	CreatedAt string        `json:"created_at"`
+	Before    *Firearm      `json:"before"`
+	After     *Firearm      `json:"after"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// FieldChange is the old and new value of one field changed by a revision
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// actorOf names whoever made a request, for the audit log. Actors name user
+// accounts and API keys, so only callers with the write scope get to see
+// them, see showActors.
+func actorOf(c *gin.Context) string {
+	if claims, ok := currentUser(c); ok {
+		return "user:" + claims.Username
+	}
+	if k, ok := currentAPIKey(c); ok {
+		return "key:" + strconv.Itoa(k.ID) + ":" + k.Name
+	}
+	return "anonymous"
+}
+
+// showActors reports whether the caller may see who made changes
+func showActors(c *gin.Context) bool {
+	return hasScope(c, ScopeWrite)
+}
+
+// WriteOptions are the settings every write to the catalog shares
+type WriteOptions struct {
+	// Webhooks queues the webhook event announcing each change. It is
+	// features.webhooks, off when nothing would send the deliveries.
+	Webhooks bool
+}
+
+// recordRevision stores the snapshots of a write to a firearm and, with
+// opts.Webhooks, queues the webhook event announcing it. It runs on the same
+// transaction as the write so none of them can happen without the others.
+func recordRevision(ctx context.Context, db dbtx, opts WriteOptions, actor, action string, before, after *Firearm) error {
+	var firearmID int
+	var beforeJSON, afterJSON []byte
+	var err error
+	if before != nil {
+		firearmID = before.ID
+		if beforeJSON, err = json.Marshal(before); err != nil {
+			return fmt.Errorf("failed to encode revision: %w", err)
+		}
+	}
+	if after != nil {
+		firearmID = after.ID
+		if afterJSON, err = json.Marshal(after); err != nil {
+			return fmt.Errorf("failed to encode revision: %w", err)
+		}
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO firearm_revisions (firearm_id, action, actor, before, after) VALUES (?, ?, ?, ?, ?)",
+		firearmID, action, actor, nullableJSON(beforeJSON), nullableJSON(afterJSON))
+	if err != nil {
+		return fmt.Errorf("failed to record revision: %w", err)
+	}
+	if !opts.Webhooks {
+		return nil
+	}
+	revisionID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	rev, err := getRevision(ctx, db, firearmID, int(revisionID))
+	if err != nil {
+		return fmt.Errorf("failed to read revision: %w", err)
+	}
+	return enqueueWebhookEvent(ctx, db, changeEvent(rev))
+}
+
+// nullableJSON stores missing snapshots as NULL rather than an empty string
+func nullableJSON(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// revisionColumns lists the firearm_revisions columns in the order scanRevision expects them
+const revisionColumns = "id, firearm_id, action, actor, before, after, created_at"
+
+// scanRevision reads a single revision selected with revisionColumns and works out its changes
+func scanRevision(s rowScanner) (Revision, error) {
+	var r Revision
+	var before, after *string
+	if err := s.Scan(&r.ID, &r.FirearmID, &r.Action, &r.Actor, &before, &after, &r.CreatedAt); err != nil {
+		return Revision{}, err
+	}
+	for _, snap := range []struct {
+		raw  *string
+		dest **Firearm
+	}{{before, &r.Before}, {after, &r.After}} {
+		if snap.raw == nil {
+			continue
+		}
+		var f Firearm
+		if err := json.Unmarshal([]byte(*snap.raw), &f); err != nil {
+			return Revision{}, fmt.Errorf("failed to decode revision %d: %w", r.ID, err)
+		}
+		*snap.dest = &f
+	}
+	r.Changes = diffFirearms(r.Before, r.After)
+	return r, nil
+}
+
+// getRevision loads one revision of a firearm, returning sql.ErrNoRows when it doesn't exist
+func getRevision(ctx context.Context, db dbtx, firearmID, id int) (Revision, error) {
+	return scanRevision(db.QueryRowContext(ctx, "SELECT "+revisionColumns+" FROM firearm_revisions WHERE firearm_id = ? AND id = ?", firearmID, id))
+}
+
+// listRevisions returns every revision of a firearm, oldest first
+func listRevisions(ctx context.Context, db dbtx, firearmID int) ([]Revision, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+revisionColumns+" FROM firearm_revisions WHERE firearm_id = ? ORDER BY id", firearmID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return revisions, nil
+}
+
+// diffFirearms lists the catalog fields that differ between two snapshots, in
+// struct order. A missing snapshot counts as every field being null, and the
+// bookkeeping fields are left out.
+func diffFirearms(before, after *Firearm) []FieldChange {
+	changes := []FieldChange{}
+	t := reflect.TypeOf(Firearm{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if bookkeepingField(name) {
+			continue
+		}
+
+		var from, to any
+		if before != nil {
+			from = reflect.ValueOf(*before).Field(i).Interface()
+		}
+		if after != nil {
+			to = reflect.ValueOf(*after).Field(i).Interface()
+		}
+		if from != to {
+			changes = append(changes, FieldChange{Field: name, From: from, To: to})
+		}
+	}
+	return changes
+}
+
+// jsonName returns the name a struct field is encoded under
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name
+}
+
+// bookkeepingField reports whether a Firearm field is maintained by the store
+// rather than being part of the catalog
+func bookkeepingField(name string) bool {
+	switch name {
+	case "id", "created_at", "updated_at", "version", "deleted_at":
+		return true
+	}
+	return false
+}
+
+// GetFirearmHistory lists every revision of a firearm with its field-level
+// changes. Deleted and purged firearms keep their history, but like the
+// firearms themselves only admins get to see it.
+func GetFirearmHistory(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := firearmIDParam(c)
+		if !ok {
+			return
+		}
+
+		_, err := scanFirearm(db.QueryRowContext(c.Request.Context(), firearmsWhere(includeDeleted(c), "id = ?"), id))
+		if err == sql.ErrNoRows && !isAdmin(c) {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no firearm found with id: %d", id)})
+			return
+		}
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+
+		revisions, err := listRevisions(c.Request.Context(), db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(revisions) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no history found for firearm with id: %d", id)})
+			return
+		}
+		if !showActors(c) {
+			for i := range revisions {
+				revisions[i].Actor = ""
+			}
+		}
+
+		c.JSON(http.StatusOK, revisions)
+	}
+}
+
+// RestoreFirearm brings back a soft deleted firearm, or with {"revision"} puts
+// a firearm back the way it was after that revision. A live firearm needs
+// If-Match like any other write; a deleted one doesn't, and one that has been
+// purged is recreated with its old ID.
+func RestoreFirearm(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := firearmIDParam(c)
+		if !ok {
+			return
+		}
+		// The body is optional when only undeleting
+		var req struct {
+			Revision int `json:"revision"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+
+		current, err := getAnyFirearm(c.Request.Context(), db, id)
+		exists := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+		deleted := exists && current.DeletedAt != nil
+
+		// Without a revision the firearm comes back exactly as it was deleted
+		target := current
+		if req.Revision == 0 {
+			if !exists {
+				c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no firearm found with id: %d", id)})
+				return
+			}
+			if !deleted {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("firearm %d is not deleted", id)})
+				return
+			}
+		} else {
+			rev, err := getRevision(c.Request.Context(), db, id, req.Revision)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no revision %d found for firearm with id: %d", req.Revision, id)})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+				return
+			}
+			if rev.After == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("revision %d deleted the firearm, restore an earlier revision instead", rev.ID)})
+				return
+			}
+			target = *rev.After
+		}
+		if exists && !deleted && !checkIfMatch(c, current) {
+			return
+		}
+
+		var restored Firearm
+		err = inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			// Deleted and purged firearms weren't in the catalog, so like a
+			// creation the revision has nothing before it
+			var before *Firearm
+			switch {
+			case !exists:
+				target.ID = id
+				if _, err := insertFirearm(c.Request.Context(), tx, target); err != nil {
+					return err
+				}
+			case deleted:
+				if err := undeleteFirearm(c.Request.Context(), tx, id, current.Version); err != nil {
+					return err
+				}
+				if req.Revision != 0 {
+					target.ID, target.Version = id, current.Version+1
+					if err := updateFirearm(c.Request.Context(), tx, target); err != nil {
+						return err
+					}
+				}
+			default:
+				target.ID, target.Version = id, current.Version
+				if err := updateFirearm(c.Request.Context(), tx, target); err != nil {
+					return err
+				}
+				before = &current
+			}
+
+			var err error
+			if restored, err = getFirearm(c.Request.Context(), tx, id); err != nil {
+				return fmt.Errorf("failed to query database: %w", err)
+			}
+			return recordRevision(c.Request.Context(), tx, opts, actorOf(c), RevisionRestore, before, &restored)
+		})
+		if err != nil {
+			c.JSON(writeStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		writeValidators(c, firearmValidators(restored))
+		c.JSON(http.StatusOK, restored)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFirearmHistory(t *testing.T) {
+	db := newTestDB(t)
+	_, writeSecret, err := createAPIKey(t.Context(), db, "editor", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, adminSecret, err := createAPIKey(t.Context(), db, "admin", []string{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)), IncludeDeleted())
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+	r.PATCH("/firearms/:id", UpdateFirearm(db, testWrites))
+	r.DELETE("/firearms/:id", DeleteFirearm(db, testWrites))
+	r.GET("/firearms/:id/history", GetFirearmHistory(db))
+	r.POST("/firearms/:id/restore", RestoreFirearm(db, testWrites))
+
+	w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	id := "1"
+	w = doRequest(r, http.MethodPatch, "/firearms/"+id, `{"price": 600, "name": "17 Gen5"}`, "If-Match", w.Header().Get("ETag"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodDelete, "/firearms/"+id, "", "If-Match", w.Header().Get("ETag")); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+
+	// The history of a deleted firearm is as hidden as the firearm
+	for _, headers := range [][]string{nil, {"X-API-Key", writeSecret}} {
+		if w := doRequest(r, http.MethodGet, "/firearms/"+id+"/history", "", headers...); w.Code != http.StatusNotFound {
+			t.Errorf("history of a deleted firearm with %v got %d, want 404", headers, w.Code)
+		}
+	}
+	w = doRequest(r, http.MethodGet, "/firearms/"+id+"/history", "", "X-API-Key", adminSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("history got %d: %s", w.Code, w.Body)
+	}
+	var revisions []Revision
+	if err := json.Unmarshal(w.Body.Bytes(), &revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[0].Action != RevisionCreate || revisions[1].Action != RevisionUpdate || revisions[2].Action != RevisionDelete {
+		t.Fatalf("history is %+v, want create, update and delete", revisions)
+	}
+	if revisions[1].Actor != "anonymous" || revisions[1].Before.Price != 550 || revisions[1].After.Price != 600 {
+		t.Errorf("update revision is %+v, want an anonymous change from 550 to 600", revisions[1])
+	}
+	changes := revisions[1].Changes
+	if len(changes) != 2 || changes[0].Field != "name" || changes[0].From != "17" || changes[0].To != "17 Gen5" || changes[1].Field != "price" {
+		t.Errorf("update changes are %+v, want name and price", changes)
+	}
+
+	// The delete can't be restored to, but the revision before it brings the firearm back
+	restore := func(rev int, headers ...string) *Firearm {
+		t.Helper()
+		w := doRequest(r, http.MethodPost, "/firearms/"+id+"/restore", `{"revision": `+strconv.Itoa(rev)+`}`, headers...)
+		if w.Code != http.StatusOK {
+			t.Fatalf("restoring revision %d got %d: %s", rev, w.Code, w.Body)
+		}
+		var f Firearm
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+			t.Fatal(err)
+		}
+		return &f
+	}
+	if w := doRequest(r, http.MethodPost, "/firearms/"+id+"/restore", `{"revision": 3}`); w.Code != http.StatusBadRequest {
+		t.Errorf("restoring the delete got %d, want 400", w.Code)
+	}
+	f := restore(revisions[1].ID)
+	if f.ID != 1 || f.Name != "17 Gen5" || f.Price != 600 {
+		t.Errorf("restored deleted firearm is %+v, want id 1 as 17 Gen5 at 600", f)
+	}
+	// Actors name accounts and keys, so they are hidden from readers
+	w = doRequest(r, http.MethodGet, "/firearms/"+id+"/history", "")
+	var public []Revision
+	if err := json.Unmarshal(w.Body.Bytes(), &public); err != nil || len(public) != 4 || public[1].Actor != "" {
+		t.Errorf("anonymous history got %d: %s", w.Code, w.Body)
+	}
+
+	// Restoring a live firearm is a write like any other and needs If-Match
+	if w := doRequest(r, http.MethodPost, "/firearms/"+id+"/restore", `{"revision": 1}`); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("restoring a live firearm without If-Match got %d, want 428", w.Code)
+	}
+	f = restore(revisions[0].ID, "If-Match", firearmValidators(*f).ETag)
+	if f.Name != "17" || f.Price != 550 {
+		t.Errorf("firearm restored to its creation is %+v, want 17 at 550", f)
+	}
+	if revisions, err := listRevisions(t.Context(), db, 1); err != nil || len(revisions) != 5 || revisions[4].Action != RevisionRestore {
+		t.Errorf("history after two restores has %d revisions, %v, want 5 ending in a restore", len(revisions), err)
+	}
+
+	// Purging keeps the history, still only for admins, who can restore from it
+	if err := deleteFirearm(t.Context(), db, f.ID, f.Version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := purgeFirearms(t.Context(), db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, "/firearms/"+id+"/history", ""); w.Code != http.StatusNotFound {
+		t.Errorf("anonymous history of a purged firearm got %d, want 404", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/firearms/"+id+"/history", "", "X-API-Key", adminSecret); w.Code != http.StatusOK {
+		t.Errorf("admin history of a purged firearm got %d, want 200", w.Code)
+	}
+	if f := restore(revisions[1].ID); f.ID != 1 || f.Name != "17 Gen5" {
+		t.Errorf("restored purged firearm is %+v, want id 1 as 17 Gen5", f)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errInvalidToken is returned for access tokens that are malformed, forged or expired
+var errInvalidToken = errors.New("invalid or expired access token")
+
+// jwtHeader is the only header this server issues or accepts
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims is the payload of an access token
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	UserID    int    `json:"uid"`
+	Username  string `json:"name"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Sessions issues and verifies the HS256 JWTs and refresh tokens of user logins
+type Sessions struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	secret []byte
+	now    func() time.Time
+}
+
+// NewSessions returns sessions signed with secret. An empty secret generates a
+// random one, which means tokens stop working when the server restarts.
+func NewSessions(secret string) (*Sessions, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate session secret: %w", err)
+		}
+	}
+	return &Sessions{
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 30 * 24 * time.Hour,
+		secret:     key,
+		now:        time.Now,
+	}, nil
+}
+
+// sign returns the base64url HMAC-SHA256 of a token's header and payload
+func (s *Sessions) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueAccessToken returns a signed access token for the user
+func (s *Sessions) issueAccessToken(u User) (string, error) {
+	now := s.now()
+	payload, err := json.Marshal(Claims{
+		Issuer:    "gunapi",
+		Subject:   fmt.Sprint(u.ID),
+		UserID:    u.ID,
+		Username:  u.Username,
+		Role:      u.Role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.AccessTTL).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token claims: %w", err)
+	}
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + s.sign(signingInput), nil
+}
+
+// verifyAccessToken checks a token's signature and expiry and returns its claims
+func (s *Sessions) verifyAccessToken(token string) (Claims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return Claims{}, errInvalidToken
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(header+"."+payload))) {
+		return Claims{}, errInvalidToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Claims{}, errInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return Claims{}, errInvalidToken
+	}
+	if s.now().Unix() >= claims.ExpiresAt {
+		return Claims{}, errInvalidToken
+	}
+	return claims, nil
+}
+
+// looksLikeJWT reports whether a bearer token has the three parts of a JWT,
+// which API keys never do
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const keysUsage = `usage:
+  keys create -name <name> -scopes read,write,admin [-daily <n>] [-monthly <n>]
+  keys list
+  keys quota <id> -daily <n> -monthly <n>
+  keys rotate <id>
+  keys revoke <id>`
+
+// runKeysCommand manages API keys from the command line, writing results to out
+func runKeysCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		fs.SetOutput(out)
+		name := fs.String("name", "", "name describing who the key is for")
+		scopeList := fs.String("scopes", ScopeRead, "comma separated scopes: "+strings.Join(scopeOrder, ", "))
+		daily := fs.Int("daily", 0, "requests allowed per day, 0 for unlimited")
+		monthly := fs.Int("monthly", 0, "requests allowed per month, 0 for unlimited")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if strings.TrimSpace(*name) == "" {
+			return errors.New("-name is required")
+		}
+		scopes, err := parseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		if *daily < 0 || *monthly < 0 {
+			return errors.New("quotas cannot be negative")
+		}
+		k, secret, err := createAPIKey(context.Background(), db, strings.TrimSpace(*name), scopes)
+		if err != nil {
+			return err
+		}
+		if err := setAPIKeyQuota(context.Background(), db, k.ID, *daily, *monthly); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created key %d (%s) with scopes %s\n", k.ID, k.Name, strings.Join(k.Scopes, ","))
+		fmt.Fprintf(out, "secret: %s\nstore it now, it cannot be shown again\n", secret)
+
+	case "list":
+		keys, err := listAPIKeys(context.Background(), db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tQUOTA DAY/MONTH\tCREATED\tLAST USED\tSTATUS")
+		for _, k := range keys {
+			lastUsed, status := "never", "active"
+			if k.LastUsedAt != nil {
+				lastUsed = *k.LastUsedAt
+			}
+			if k.RevokedAt != nil {
+				status = "revoked " + *k.RevokedAt
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s/%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","),
+				quotaString(k.DailyQuota), quotaString(k.MonthlyQuota), k.CreatedAt, lastUsed, status)
+		}
+		return tw.Flush()
+
+	case "quota":
+		if len(args) < 2 {
+			return errors.New(keysUsage)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("id must be a valid integer: %q", args[1])
+		}
+		fs := flag.NewFlagSet("keys quota", flag.ContinueOnError)
+		fs.SetOutput(out)
+		daily := fs.Int("daily", 0, "requests allowed per day, 0 for unlimited")
+		monthly := fs.Int("monthly", 0, "requests allowed per month, 0 for unlimited")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		if *daily < 0 || *monthly < 0 {
+			return errors.New("quotas cannot be negative")
+		}
+		if err := setAPIKeyQuota(context.Background(), db, id, *daily, *monthly); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %d may now make %s requests a day and %s a month\n", id, quotaString(*daily), quotaString(*monthly))
+
+	case "rotate", "revoke":
+		if len(args) != 2 {
+			return errors.New(keysUsage)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("id must be a valid integer: %q", args[1])
+		}
+		if args[0] == "revoke" {
+			if err := revokeAPIKey(context.Background(), db, id); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "revoked key %d\n", id)
+			return nil
+		}
+		k, secret, err := rotateAPIKey(context.Background(), db, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rotated key %d (%s), the old secret no longer works\n", k.ID, k.Name)
+		fmt.Fprintf(out, "secret: %s\nstore it now, it cannot be shown again\n", secret)
+
+	default:
+		return fmt.Errorf("unknown keys command %q\n%s", args[0], keysUsage)
+	}
+	return nil
+}
+
+// quotaString formats a quota for display, where 0 means unlimited
+func quotaString(quota int) string {
+	if quota == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(quota)
+}
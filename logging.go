@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Context keys of the request ID and the number of results a handler returned
+const (
+	requestIDKey   = "request_id"
+	resultCountKey = "result_count"
+)
+
+// maxRequestIDLength bounds the X-Request-ID values taken from clients
+const maxRequestIDLength = 128
+
+// newLogger returns the logger everything logs through, JSON unless the text
+// format is configured, and makes it the default so the log package and gin's
+// debug output go through it too
+func newLogger(w io.Writer, cfg LogConfig) *slog.Logger {
+	opts := &slog.HandlerOptions{}
+	var level slog.Level
+	if level.UnmarshalText([]byte(cfg.Level)) == nil {
+		opts.Level = level
+	}
+	var handler slog.Handler = slog.NewJSONHandler(w, opts)
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		logger.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
+	gin.DebugPrintRouteFunc = func(method, path, handler string, _ int) {
+		logger.Debug("route", "method", method, "path", path, "handler", handler)
+	}
+	return logger
+}
+
+// validRequestID reports whether a client's X-Request-ID is safe to reuse in
+// headers and logs: short and made of letters, digits and -._:
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID RequestLog gave the request, empty outside it
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// requestLogger returns the logger with the request's ID attached
+func requestLogger(c *gin.Context) *slog.Logger {
+	return slog.Default().With(requestIDKey, requestID(c))
+}
+
+// setResultCount records how many results a handler returned, for the access log
+func setResultCount(c *gin.Context, n int) {
+	c.Set(resultCountKey, n)
+}
+
+// errorBodyWriter holds back JSON error responses so RequestLog can add the
+// request ID to them. Everything else passes straight through.
+type errorBodyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Unwrap lets http.ResponseController reach the connection, for /events to lift its write deadline
+func (w *errorBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *errorBodyWriter) holding() bool {
+	return w.Status() >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+}
+
+func (w *errorBodyWriter) Write(b []byte) (int, error) {
+	if w.holding() {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorBodyWriter) WriteString(s string) (int, error) {
+	if w.holding() {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// release writes out a held error response with the request ID added,
+// returning its error message for the log
+func (w *errorBodyWriter) release(id string) string {
+	if w.body.Len() == 0 {
+		return ""
+	}
+	body := w.body.Bytes()
+	var fields map[string]any
+	if json.Unmarshal(body, &fields) == nil {
+		fields[requestIDKey] = id
+		if b, err := json.Marshal(fields); err == nil {
+			body = b
+		}
+	}
+	w.ResponseWriter.Write(body)
+
+	msg, _ := fields["error"].(string)
+	if msg == "" {
+		msg, _ = fields["message"].(string)
+	}
+	return msg
+}
+
+// RequestLog gives every request an ID, taken from a valid X-Request-ID header
+// or generated, and sends it back in X-Request-ID and in every JSON error
+// response. Once the request is done it logs one line with its method, route,
+// status, latency, result count and any error, all tagged with the ID and,
+// when the request is traced, its trace and span IDs.
+func RequestLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+
+		w := &errorBodyWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		errMsg := w.release(id)
+
+		status := c.Writer.Status()
+		attrs := []any{
+			requestIDKey, id,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		}
+		if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+			attrs = append(attrs, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+		}
+		if n, ok := c.Get(resultCountKey); ok {
+			attrs = append(attrs, resultCountKey, n)
+		}
+		// Errors from handlers that had already sent their status, like a broken stream
+		errs := c.Errors.Errors()
+		if errMsg != "" {
+			errs = append([]string{errMsg}, errs...)
+		}
+		if len(errs) > 0 {
+			attrs = append(attrs, "error", strings.Join(errs, "; "))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		logger.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recover turns a panic in a handler into a 500 and logs it with its stack,
+// in place of gin's plain text recovery output
+func Recover() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		requestLogger(c).Error("panic", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+	})
+}
+
+// sliceLen returns the length of a slice body, and false for anything else
+func sliceLen(body any) (int, bool) {
+	v := reflect.ValueOf(body)
+	if v.Kind() != reflect.Slice {
+		return 0, false
+	}
+	return v.Len(), true
+}
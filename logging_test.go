@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logLines decodes JSON log output, one entry per line
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	out.Reset()
+	return lines
+}
+
+func TestRequestLog(t *testing.T) {
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	var out bytes.Buffer
+	logger := newLogger(&out, LogConfig{})
+
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Glock", "19", 1988, 560)
+	r := gin.New()
+	r.Use(RequestLog(logger), Recover())
+	r.GET("/brand/:brand", GetFirearmsByBrand(db))
+	r.GET("/id/:id", GetFirearmByID(db))
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	logLines(t, &out) // drop route registration
+
+	// A client's request ID is kept and the result count logged
+	w := doRequest(r, http.MethodGet, "/brand/glock", "", "X-Request-ID", "req-42")
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-ID") != "req-42" {
+		t.Fatalf("got %d with request id %q", w.Code, w.Header().Get("X-Request-ID"))
+	}
+	lines := logLines(t, &out)
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line["msg"] != "request" || line["level"] != "INFO" || line["request_id"] != "req-42" || line["route"] != "/brand/:brand" ||
+		line["status"] != float64(200) || line["result_count"] != float64(2) || line["latency_ms"] == nil {
+		t.Errorf("logged %v", line)
+	}
+	// A single firearm counts as one result
+	if w := doRequest(r, http.MethodGet, "/id/1", ""); w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("get by id got %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	if line := logLines(t, &out)[0]; line["result_count"] != float64(1) {
+		t.Errorf("get by id logged %v", line)
+	}
+
+	// A missing or unusable one is replaced, and error responses carry it
+	w = doRequest(r, http.MethodGet, "/id/abc", "", "X-Request-ID", "bad id\n")
+	id := w.Header().Get("X-Request-ID")
+	if id == "" || id == "bad id\n" {
+		t.Fatalf("request id = %q", id)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["request_id"] != id || body["message"] == nil {
+		t.Errorf("error response = %s", w.Body)
+	}
+	line = logLines(t, &out)[0]
+	if line["level"] != "WARN" || line["request_id"] != id || line["error"] != body["message"] {
+		t.Errorf("logged %v", line)
+	}
+
+	w = doRequest(r, http.MethodGet, "/panic", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusInternalServerError || body["request_id"] == nil {
+		t.Errorf("panic got %d: %s", w.Code, w.Body)
+	}
+	lines = logLines(t, &out)
+	if len(lines) != 2 || lines[0]["msg"] != "panic" || lines[0]["stack"] == nil || lines[1]["level"] != "ERROR" ||
+		lines[0]["request_id"] != lines[1]["request_id"] {
+		t.Errorf("panic logged %v", lines)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLookupKeys caps how many firearms a single lookup may ask for
+const maxLookupKeys = 100
+
+// LookupKey names a firearm either by ID or by its brand and name
+type LookupKey struct {
+	ID    int    `json:"id,omitempty"`
+	Brand string `json:"brand,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// LookupRequest is the body of POST /firearms/lookup. IDs and Keys may be
+// combined, in which case the IDs are looked up first.
+type LookupRequest struct {
+	IDs  []int       `json:"ids"`
+	Keys []LookupKey `json:"keys"`
+}
+
+// LookupResult is the answer for one requested key. Firearm is nil and Found
+// is false when nothing matches the key.
+type LookupResult struct {
+	Key     LookupKey `json:"key"`
+	Found   bool      `json:"found"`
+	Firearm *Firearm  `json:"firearm"`
+
+	// Sources holds the citations of the firearm's fields with ?include=sources
+	Sources map[string][]Citation `json:"sources,omitempty"`
+}
+
+// LookupResponse lists one result per requested key, in request order
+type LookupResponse struct {
+	Found   int            `json:"found"`
+	Missing int            `json:"missing"`
+	Results []LookupResult `json:"results"`
+}
+
+// brandNameKey is how firearms are matched to brand and name keys, ignoring case
+func brandNameKey(brand, name string) string {
+	return strings.ToLower(brand) + "\x00" + strings.ToLower(name)
+}
+
+// lookupFirearms fetches every firearm named by keys with a single query and
+// returns the results in the order of keys, repeating any duplicate keys
+func lookupFirearms(ctx context.Context, db dbtx, keys []LookupKey, includeDeleted bool) (LookupResponse, error) {
+	var conds []string
+	var args []any
+	var ids []string
+	for _, k := range keys {
+		if k.ID != 0 {
+			ids = append(ids, "?")
+			args = append(args, k.ID)
+		}
+	}
+	if len(ids) > 0 {
+		conds = append(conds, "id IN ("+strings.Join(ids, ", ")+")")
+	}
+	for _, k := range keys {
+		if k.ID == 0 {
+			conds = append(conds, "(brand = ? COLLATE NOCASE AND name = ? COLLATE NOCASE)")
+			args = append(args, k.Brand, k.Name)
+		}
+	}
+
+	firearms, err := queryFirearms(ctx, db, firearmsWhere(includeDeleted, strings.Join(conds, " OR ")), args...)
+	if err != nil {
+		return LookupResponse{}, err
+	}
+
+	byID := make(map[int]*Firearm, len(firearms))
+	byBrandName := make(map[string]*Firearm, len(firearms))
+	for i := range firearms {
+		byID[firearms[i].ID] = &firearms[i]
+		byBrandName[brandNameKey(firearms[i].Brand, firearms[i].Name)] = &firearms[i]
+	}
+
+	resp := LookupResponse{Results: make([]LookupResult, len(keys))}
+	for i, k := range keys {
+		f := byBrandName[brandNameKey(k.Brand, k.Name)]
+		if k.ID != 0 {
+			f = byID[k.ID]
+		}
+		resp.Results[i] = LookupResult{Key: k, Found: f != nil, Firearm: f}
+		if f != nil {
+			resp.Found++
+		} else {
+			resp.Missing++
+		}
+	}
+	return resp, nil
+}
+
+// citeLookup adds the citations of every firearm found by a lookup to its result
+func citeLookup(ctx context.Context, db dbtx, resp *LookupResponse) error {
+	var ids []int
+	for _, r := range resp.Results {
+		if r.Firearm != nil {
+			ids = append(ids, r.Firearm.ID)
+		}
+	}
+	cited, err := citationsFor(ctx, db, ids)
+	if err != nil {
+		return err
+	}
+	for i, r := range resp.Results {
+		if r.Firearm != nil {
+			resp.Results[i].Sources = fieldCitations(cited, r.Firearm.ID)
+		}
+	}
+	return nil
+}
+
+// parseIDList parses a comma separated list of firearm IDs
+func parseIDList(s string) ([]LookupKey, error) {
+	var keys []LookupKey
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid id %q, ids must be positive integers", part)
+		}
+		keys = append(keys, LookupKey{ID: id})
+	}
+	return keys, nil
+}
+
+// checkLookupSize validates the number of keys in a lookup
+func checkLookupSize(keys []LookupKey) error {
+	if len(keys) == 0 {
+		return errors.New("at least one id or key is required")
+	}
+	if len(keys) > maxLookupKeys {
+		return fmt.Errorf("a lookup may contain at most %d keys", maxLookupKeys)
+	}
+	return nil
+}
+
+// GetFirearmsByIDs retrieves the firearms listed in the ids query parameter,
+// with the citations of their fields when asked for ?include=sources
+func GetFirearmsByIDs(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := parseIDList(c.Query("ids"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := checkLookupSize(keys); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		withSources, ok := includeSources(c)
+		if !ok {
+			return
+		}
+
+		resp, err := lookupFirearms(c.Request.Context(), db, keys, includeDeleted(c))
+		if err == nil && withSources {
+			err = citeLookup(c.Request.Context(), db, &resp)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		respondOK(c, resp)
+	}
+}
+
+// LookupFirearms retrieves the firearms named by a list of IDs and brand and
+// name pairs, with the citations of their fields when asked for ?include=sources
+func LookupFirearms(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		withSources, ok := includeSources(c)
+		if !ok {
+			return
+		}
+		var req LookupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+
+		keys := make([]LookupKey, 0, len(req.IDs)+len(req.Keys))
+		for _, id := range req.IDs {
+			if id <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid id %d, ids must be positive integers", id)})
+				return
+			}
+			keys = append(keys, LookupKey{ID: id})
+		}
+		for i, k := range req.Keys {
+			k.Brand, k.Name = strings.TrimSpace(k.Brand), strings.TrimSpace(k.Name)
+			switch {
+			case k.ID < 0:
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("keys[%d]: invalid id %d, ids must be positive integers", i, k.ID)})
+				return
+			case k.ID == 0 && (k.Brand == "" || k.Name == ""):
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("keys[%d]: either id or both brand and name are required", i)})
+				return
+			case k.ID != 0 && (k.Brand != "" || k.Name != ""):
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("keys[%d]: give either id or brand and name, not both", i)})
+				return
+			}
+			keys = append(keys, k)
+		}
+		if err := checkLookupSize(keys); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp, err := lookupFirearms(c.Request.Context(), db, keys, includeDeleted(c))
+		if err == nil && withSources {
+			err = citeLookup(c.Request.Context(), db, &resp)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
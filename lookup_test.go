@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLookupFirearms(t *testing.T) {
+	db := newTestDB(t)
+	glock := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	colt := addTestFirearm(t, db, "Colt", "M1911", 1911, 900)
+	r := gin.New()
+	r.GET("/firearms", GetFirearmsByIDs(db))
+	r.POST("/firearms/lookup", LookupFirearms(db))
+
+	decode := func(body []byte) LookupResponse {
+		t.Helper()
+		var resp LookupResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	w := doRequest(r, http.MethodGet, "/firearms?ids=2,99,1,2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /firearms got %d: %s", w.Code, w.Body)
+	}
+	resp := decode(w.Body.Bytes())
+	if resp.Found != 3 || resp.Missing != 1 || len(resp.Results) != 4 {
+		t.Fatalf("got %d found and %d missing in %d results, want 3, 1 and 4", resp.Found, resp.Missing, len(resp.Results))
+	}
+	wantIDs := []int{colt.ID, 0, glock.ID, colt.ID}
+	for i, res := range resp.Results {
+		got := 0
+		if res.Firearm != nil {
+			got = res.Firearm.ID
+		}
+		if got != wantIDs[i] || res.Found != (wantIDs[i] != 0) {
+			t.Errorf("result %d is firearm %d with found %v, want firearm %d", i, got, res.Found, wantIDs[i])
+		}
+	}
+
+	body := `{"ids": [1], "keys": [{"brand": "colt", "name": "m1911"}, {"brand": "Glock", "name": "19"}]}`
+	w = doRequest(r, http.MethodPost, "/firearms/lookup", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /firearms/lookup got %d: %s", w.Code, w.Body)
+	}
+	resp = decode(w.Body.Bytes())
+	if resp.Found != 2 || resp.Results[0].Firearm.ID != glock.ID || resp.Results[1].Firearm.ID != colt.ID || resp.Results[2].Found {
+		t.Errorf("lookup by ids and keys answered %+v, want Glock 17, Colt M1911 and a missing Glock 19", resp.Results)
+	}
+	if resp.Results[2].Key.Brand != "Glock" || resp.Results[2].Key.Name != "19" {
+		t.Errorf("missing result echoed key %+v, want Glock 19", resp.Results[2].Key)
+	}
+
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodGet, "/firearms", ""},
+		{http.MethodGet, "/firearms?ids=1,abc", ""},
+		{http.MethodPost, "/firearms/lookup", `{}`},
+		{http.MethodPost, "/firearms/lookup", `{"keys": [{"brand": "Glock"}]}`},
+		{http.MethodPost, "/firearms/lookup", `{"keys": [{"id": 1, "brand": "Glock", "name": "17"}]}`},
+	} {
+		if w := doRequest(r, tt.method, tt.target, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %s got %d, want 400", tt.method, tt.target, tt.body, w.Code)
+		}
+	}
+}
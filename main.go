@@ -1,25 +1,46 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-// InitDB initializes the SQLite3 database with the firearms table
+// InitDB opens the SQLite3 database and brings it up to the current schema
 func InitDB(dbPath string) (*sql.DB, error) {
-	// Open SQLite3 database connection
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := openDatabase(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
+	// Bring older databases up to the current schema
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openDatabase opens the SQLite3 database and creates the base firearms
+// schema if it's missing, leaving later migrations pending
+func openDatabase(dbPath string) (*sql.DB, error) {
+	// Open SQLite3 database connection, with its statements instrumented for /metrics
+	db := openDB(dbPath)
+
 	// Create firearms table and indexes
 	createTableQuery := `
 	-- Creating firearms table with specified and additional relevant columns
@@ -48,14 +69,34 @@ func InitDB(dbPath string) (*sql.DB, error) {
 
 	-- Creating index on brand and name for common queries
 	CREATE INDEX IF NOT EXISTS idx_firearms_brand_name ON firearms(brand, name);
+
+	-- Creating a change counter per table so list endpoints can emit ETags
+	CREATE TABLE IF NOT EXISTS table_versions (
+		name TEXT PRIMARY KEY,
+		version INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT OR IGNORE INTO table_versions (name, updated_at)
+		VALUES ('firearms', COALESCE((SELECT MAX(updated_at) FROM firearms), CURRENT_TIMESTAMP));
+
+	-- Bumping the firearms version on every write
+	CREATE TRIGGER IF NOT EXISTS trg_firearms_version_insert AFTER INSERT ON firearms BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'firearms';
+	END;
+	CREATE TRIGGER IF NOT EXISTS trg_firearms_version_update AFTER UPDATE ON firearms BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'firearms';
+	END;
+	CREATE TRIGGER IF NOT EXISTS trg_firearms_version_delete AFTER DELETE ON firearms BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'firearms';
+	END;
 	`
 
 	// migration code, only used if the table already exists
 	// createTableDuplicateQuery := `
 	// 	-- Check for duplicates
-	// 	SELECT brand, name, COUNT(*) as count 
-	// 	FROM firearms 
-	// 	GROUP BY brand, name 
+	// 	SELECT brand, name, COUNT(*) as count
+	// 	FROM firearms
+	// 	GROUP BY brand, name
 	// 	HAVING count > 1;
 
 	// 	-- Rename existing table
@@ -84,21 +125,21 @@ func InitDB(dbPath string) (*sql.DB, error) {
 
 	// 	-- Migrate data, ignoring duplicates
 	// 	INSERT OR IGNORE INTO firearms (
-	// 		id, brand, name, caliber, type, magazine_capacity, effective_range, 
-	// 		year, price, manufacturer, weight, barrel_length, action, country_of_origin, 
+	// 		id, brand, name, caliber, type, magazine_capacity, effective_range,
+	// 		year, price, manufacturer, weight, barrel_length, action, country_of_origin,
+	// 		created_at, updated_at
+	// 	) SELECT
+	// 		id, brand, name, caliber, type, magazine_capacity, effective_range,
+	// 		year, price, manufacturer, weight, barrel_length, action, country_of_origin,
 	// 		created_at, updated_at
-	// 	) SELECT 
-	// 		id, brand, name, caliber, type, magazine_capacity, effective_range, 
-	// 		year, price, manufacturer, weight, barrel_length, action, country_of_origin, 
-	// 		created_at, updated_at 
 	// 	FROM firearms_old;
 
 	// 	-- Drop old table
 	// 	DROP TABLE firearms_old;
-	// ` 
+	// `
 
 	// Execute table creation query
-	_, err = db.Exec(createTableQuery)
+	_, err := db.Exec(createTableQuery)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to create firearms table: %w", err)
@@ -107,9 +148,11 @@ func InitDB(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
-
-// InsertFirearms adds predefined firearms to the firearms table
-func InsertFirearms(db *sql.DB) error {
+// InsertFirearms adds the predefined firearms in one transaction, recording a
+// revision for each the way an import does, so the history, /sync and
+// webhooks see them. Firearms whose brand and name already exist are left
+// alone. It returns how many were added.
+func InsertFirearms(ctx context.Context, db *sql.DB, opts WriteOptions) (int, error) {
 	// Define the firearms data
 	firearms := []struct {
 		brand           string
@@ -203,47 +246,64 @@ func InsertFirearms(db *sql.DB) error {
 		{"SIG Sauer", "SG553", "5.56x45mm NATO", "Rifle", 30, 400, 2009, 2300, "Swiss Arms", 3.2, 34.7, "Select-Fire", "Switzerland"},
 	}
 
-	// SQL INSERT query template
-	query := `
-		INSERT OR IGNORE INTO firearms (
-			brand, name, caliber, type, magazine_capacity, effective_range, 
-			year, price, manufacturer, weight, barrel_length, action, country_of_origin
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+	added := 0
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, gun := range firearms {
+			_, err := getFirearmByBrandName(ctx, tx, gun.brand, gun.name)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("failed to query database: %w", err)
+			}
 
-	// Execute INSERT for each firearm
-	for _, gun := range firearms {
-		_, err := db.Exec(query,
-			gun.brand, gun.name, gun.caliber, gun.type_, gun.magazineCap,
-			gun.effectiveRange, gun.year, gun.price, gun.manufacturer, gun.weight,
-			gun.barrelLength, gun.action, gun.countryOfOrigin,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to insert firearm %s %s: %w", gun.brand, gun.name, err)
+			id, err := insertFirearm(ctx, tx, Firearm{
+				Brand: gun.brand, Name: gun.name, Caliber: gun.caliber, Type: gun.type_,
+				MagazineCapacity: gun.magazineCap, EffectiveRange: gun.effectiveRange,
+				Year: gun.year, Price: gun.price, Manufacturer: gun.manufacturer,
+				Weight: gun.weight, BarrelLength: gun.barrelLength, Action: gun.action,
+				CountryOfOrigin: gun.countryOfOrigin,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to insert firearm %s %s: %w", gun.brand, gun.name, err)
+			}
+			created, err := getFirearm(ctx, tx, id)
+			if err != nil {
+				return fmt.Errorf("failed to query database: %w", err)
+			}
+			if err := recordRevision(ctx, tx, opts, cliActor, RevisionCreate, nil, &created); err != nil {
+				return err
+			}
+			added++
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-
-	return nil
+	return added, nil
 }
 
 // Firearm represents the structure of a firearm record
 type Firearm struct {
-	ID              int     `json:"id"`
-	Brand           string  `json:"brand"`
-	Name            string  `json:"name"`
-	Caliber         string  `json:"caliber"`
-	Type            string  `json:"type"`
+	ID               int     `json:"id"`
+	Brand            string  `json:"brand"`
+	Name             string  `json:"name"`
+	Caliber          string  `json:"caliber"`
+	Type             string  `json:"type"`
 	MagazineCapacity int     `json:"magazine_capacity"`
-	EffectiveRange  int     `json:"effective_range"`
-	Year            int     `json:"year"`
-	Price           int     `json:"price"`
-	Manufacturer    string  `json:"manufacturer"`
-	Weight          float64 `json:"weight"`
-	BarrelLength    float64 `json:"barrel_length"`
-	Action          string  `json:"action"`
-	CountryOfOrigin string  `json:"country_of_origin"`
-	CreatedAt       string  `json:"created_at"`
-	UpdatedAt       string  `json:"updated_at"`
+	EffectiveRange   int     `json:"effective_range"`
+	Year             int     `json:"year"`
+	Price            int     `json:"price"`
+	Manufacturer     string  `json:"manufacturer"`
+	Weight           float64 `json:"weight"`
+	BarrelLength     float64 `json:"barrel_length"`
+	Action           string  `json:"action"`
+	CountryOfOrigin  string  `json:"country_of_origin"`
+	CreatedAt        string  `json:"created_at"`
+	UpdatedAt        string  `json:"updated_at"`
+	Version          int     `json:"version"`
+	DeletedAt        *string `json:"deleted_at,omitempty"`
 }
 
 // GetFirearmsByBrand retrieves firearms by brand
@@ -256,28 +316,9 @@ func GetFirearmsByBrand(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use parameterized query to prevent SQL injection
-		rows, err := db.Query("SELECT * FROM firearms WHERE brand = ?", strings.Title(brand))
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "brand = ?"), strings.Title(brand))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -286,7 +327,7 @@ func GetFirearmsByBrand(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -299,28 +340,9 @@ func GetFirearmsByName(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use parameterized query to prevent SQL injection
-		rows, err := db.Query("SELECT * FROM firearms WHERE name LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(name))
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "name LIKE '%' || ? || '%' COLLATE NOCASE"), strings.Title(name))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -329,7 +351,7 @@ func GetFirearmsByName(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -343,28 +365,9 @@ func GetFirearmsByCaliber(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use LIKE for partial, case-insensitive matching
-		rows, err := db.Query("SELECT * FROM firearms WHERE caliber LIKE '%' || ? || '%' COLLATE NOCASE", caliber)
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "caliber LIKE '%' || ? || '%' COLLATE NOCASE"), caliber)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -373,7 +376,7 @@ func GetFirearmsByCaliber(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -405,28 +408,9 @@ func GetFirearmsByPrice(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Query using BETWEEN for price range
-		rows, err := db.Query("SELECT * FROM firearms WHERE price BETWEEN ? AND ?", minPrice, maxPrice)
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "price BETWEEN ? AND ?"), minPrice, maxPrice)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -435,7 +419,7 @@ func GetFirearmsByPrice(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -448,28 +432,9 @@ func GetFirearmsByCountry(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use LIKE for partial, case-insensitive matching
-		rows, err := db.Query("SELECT * FROM firearms WHERE country_of_origin LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(country))
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "country_of_origin LIKE '%' || ? || '%' COLLATE NOCASE"), strings.Title(country))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -478,7 +443,7 @@ func GetFirearmsByCountry(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -491,28 +456,9 @@ func GetFirearmsByYear(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use LIKE for partial, case-insensitive matching
-		rows, err := db.Query("SELECT * FROM firearms WHERE year = ?", year)
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "year = ?"), year)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -521,7 +467,7 @@ func GetFirearmsByYear(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
@@ -534,28 +480,9 @@ func GetFirearmsByType(db *sql.DB) gin.HandlerFunc {
 		}
 
 		// Use LIKE for partial, case-insensitive matching
-		rows, err := db.Query("SELECT * FROM firearms WHERE type LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(weptype))
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), "type LIKE '%' || ? || '%' COLLATE NOCASE"), strings.Title(weptype))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
-			return
-		}
-		defer rows.Close()
-
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
-				return
-			}
-			firearms = append(firearms, f)
-		}
-
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -564,11 +491,12 @@ func GetFirearmsByType(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, firearms)
+		respondOK(c, firearms)
 	}
 }
 
-// GetFirearmByID retrieves a firearm by ID
+// GetFirearmByID retrieves a firearm by ID, with the citations of its fields
+// keyed by field name when asked for ?include=sources
 func GetFirearmByID(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
@@ -577,12 +505,7 @@ func GetFirearmByID(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		var f Firearm
-		err := db.QueryRow("SELECT * FROM firearms WHERE id = ?", id).Scan(
-			&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-			&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-			&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt,
-		)
+		f, err := scanFirearm(db.QueryRowContext(c.Request.Context(), firearmsWhere(includeDeleted(c), "id = ?"), id))
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no firearm found with id: %s", id)})
 			return
@@ -592,73 +515,318 @@ func GetFirearmByID(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, f)
-	}
-}
-
-// GetAllFirearms retrieves all firearms
-func GetAllFirearms(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		rows, err := db.Query("SELECT * FROM firearms")
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+		withSources, ok := includeSources(c)
+		if !ok {
 			return
 		}
-		defer rows.Close()
 
-		var firearms []Firearm
-		for rows.Next() {
-			var f Firearm
-			err := rows.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
-				&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
-				&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to scan row: %v", err)})
+		// Answer conditional requests from the row's updated_at before sending the body
+		v := firearmValidators(f)
+		if withSources {
+			if v, err = withCitationsVersion(c.Request.Context(), db, v); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			firearms = append(firearms, f)
 		}
+		if notModified(c, v) {
+			return
+		}
+		c.Set(validatorsKey, v)
+		setResultCount(c, 1)
 
-		if err := rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error iterating rows: %v", err)})
+		if !withSources {
+			respondOK(c, f)
 			return
 		}
+		cited, err := citationsFor(c.Request.Context(), db, []int{f.ID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondOK(c, CitedFirearm{Firearm: f, Sources: fieldCitations(cited, f.ID)})
+	}
+}
 
-		c.JSON(http.StatusOK, firearms)
+// GetAllFirearms retrieves all firearms
+func GetAllFirearms(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		firearms, err := queryFirearms(c.Request.Context(), db, firearmsWhere(includeDeleted(c), ""))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		respondOK(c, firearms)
 	}
 }
-	
+
 func main() {
-	db, err := InitDB("gundatabase.db")
-	if err != nil {
-		fmt.Println("Error initializing database:", err)
+	// Settings come from the defaults, a config file, GUNAPI_* variables and
+	// flags, in that order, and nothing runs with invalid ones
+	cfg, args, err := LoadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
 		return
 	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+	logger := newLogger(os.Stderr, cfg.Log)
+
+	// The command follows the global flags and shares their configuration,
+	// go run . -database.dsn other.db export csv for instance. Without one
+	// the server starts.
+	name, args := "serve", args
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "serve" {
+		err = runServeCommand(cfg, logger, args)
+	} else {
+		err = runCommand(cfg, name, args, os.Stdout)
+	}
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUnknownCommand):
+		fmt.Fprintf(os.Stderr, "%v\n%s", err, cliUsage)
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runServeCommand serves the API until SIGTERM or SIGINT, then shuts down
+// gracefully, returning an error if anything failed along the way
+func runServeCommand(cfg Config, logger *slog.Logger, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("serve takes no arguments, got %q", args)
+	}
+	db, err := InitDB(cfg.Database.DSN)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
 	defer db.Close()
+	configurePool(db, cfg.Database)
+
+	// Without auth.jwt_secret a random secret is used and logins end on restart
+	sessions, err := NewSessions(cfg.Auth.JWTSecret)
+	if err != nil {
+		return fmt.Errorf("failed to set up sessions: %w", err)
+	}
+
+	// Spans go to the exporter named by tracing.exporter, if any
+	shutdownTracing, err := initTracing(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	// The server shuts down gracefully on SIGTERM or SIGINT, a second one kills it
+	stopping, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serverOpts := cfg.HTTP.ServerOptions()
+	readiness := NewReadiness()
+
+	// Deliveries are sent in the background, after the writes queueing them commit
+	dispatching, stopDispatching := context.WithCancel(context.Background())
+	defer stopDispatching()
+	dispatched := make(chan struct{})
+	go func() {
+		if cfg.Features.Webhooks {
+			NewWebhookDispatcher(db).Run(dispatching)
+		}
+		close(dispatched)
+	}()
+
+	// Internal services read the catalog over gRPC, on a port of its own
+	var grpcServer *CatalogServer
+	var grpcLis net.Listener
+	if cfg.Features.GRPC {
+		if grpcLis, err = net.Listen("tcp", cfg.GRPC.Addr); err != nil {
+			return fmt.Errorf("failed to listen for gRPC: %w", err)
+		}
+		grpcServer = NewCatalogServer(db, sessions)
+	}
+
+	// Requests are traced, then logged as JSON, one line each, tagged with
+	// their request ID and trace ID
+	r := gin.New()
+	r.Use(Tracing(), RequestLog(logger), Recover())
+
+	// Requests are counted and timed by route template, and the pool stats
+	// exported alongside the query metrics
+	if cfg.Features.Metrics {
+		registerDBStats(db)
+		r.Use(Metrics())
+		r.GET("/metrics", MetricsHandler())
+	}
+
+	// Browsers on the allowed origins may call the API, preflights included
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		r.Use(CORS(cfg.CORS))
+	}
+
+	// Probes for the orchestrator, left out of authentication and rate limits
+	r.GET("/healthz", Healthz())
+	r.GET("/readyz", Readyz(db, readiness))
+	r.GET("/version", Version(db))
+	r.SetFuncMap(catalogFuncs)
+	r.LoadHTMLGlob(cfg.Web.Templates)
+	if cfg.Web.StaticDir != "" {
+		r.Static("/static", cfg.Web.StaticDir)
+	}
 
-	// Uncomment/Comment based on new entries or not
-	// err = InsertFirearms(db)
-	// if err != nil {
-	// 	fmt.Println("Error inserting firearms:", err)
-	// 	return
-	// }
-
-	r := gin.Default()
-	r.LoadHTMLGlob("**/*.html")
-	r.Static("/static", "./static")
-
-	r.GET("/brand/:brand", GetFirearmsByBrand(db))
-	r.GET("/name/:name", GetFirearmsByName(db))
-	r.GET("/caliber/:caliber", GetFirearmsByCaliber(db))
-	r.GET("/year/:year", GetFirearmsByYear(db))
-	r.GET("/type/:type", GetFirearmsByType(db))
-	r.GET("/country/:country", GetFirearmsByCountry(db))
-	r.GET("/price/:min/:max", GetFirearmsByPrice(db))
-	r.GET("/id/:id", GetFirearmByID(db))
-	r.GET("/all", GetAllFirearms(db))
-
-	err = r.Run(":4000")
+	// Reads stay anonymous, but a key or token that is sent must be valid. Clients
+	// are throttled per key or user, or per IP without one, and keys count
+	// against their quotas. Admins may add ?include_deleted=true to reads.
+	r.Use(Authenticate(db, sessions), RateLimit(db, NewRateLimiter(cfg.RateLimit.PerMinute, cfg.RateLimit.Burst)), IncludeDeleted())
+
+	r.POST("/auth/login", Login(db, sessions))
+	r.POST("/auth/refresh", Refresh(db, sessions))
+	r.POST("/auth/logout", Logout(db))
+	r.GET("/auth/me", RequireRole(RoleViewer), GetCurrentUser(db))
+
+	// List routes share the firearms table version as their ETag, so they can
+	// be answered with 304 before any query runs
+	lists := r.Group("/", CacheControl(time.Duration(cfg.Cache.ListMaxAge)), ConditionalList(db))
+	lists.GET("/brand/:brand", GetFirearmsByBrand(db))
+	lists.GET("/name/:name", GetFirearmsByName(db))
+	lists.GET("/caliber/:caliber", GetFirearmsByCaliber(db))
+	lists.GET("/year/:year", GetFirearmsByYear(db))
+	lists.GET("/type/:type", GetFirearmsByType(db))
+	lists.GET("/country/:country", GetFirearmsByCountry(db))
+	lists.GET("/price/:min/:max", GetFirearmsByPrice(db))
+	lists.GET("/all", GetAllFirearms(db))
+	lists.GET("/firearms", GetFirearmsByIDs(db))
+
+	r.GET("/id/:id", CacheControl(time.Duration(cfg.Cache.FirearmMaxAge)), GetFirearmByID(db))
+
+	// The HTML catalog is built from the same queries as the JSON routes
+	r.GET("/", func(c *gin.Context) { c.Redirect(http.StatusFound, "/catalog") })
+	catalog := r.Group("/catalog", CacheControl(time.Duration(cfg.Cache.CatalogMaxAge)), ConditionalCatalog(db))
+	catalog.GET("", CatalogIndex(db))
+	catalog.GET("/firearms/:id", CatalogFirearm(db))
+	catalog.GET("/compare", CatalogCompare(db))
+	for path := range catalogListings {
+		catalog.GET("/"+path, CatalogListing(db, path))
+	}
+
+	r.POST("/firearms/lookup", LookupFirearms(db))
+	r.GET("/firearms/:id/history", GetFirearmHistory(db))
+	// Feeds replicating the whole catalog need at least a read key or session
+	if cfg.Features.Events {
+		r.GET("/events", RequireScope(ScopeRead), StreamEvents(db, readiness.StreamsEnded()))
+	}
+	r.GET("/sync", RequireScope(ScopeRead), SyncFirearms(db))
+	if cfg.Features.GraphQL {
+		r.GET("/graphql", GraphQL(db))
+		r.POST("/graphql", GraphQL(db))
+		r.GET("/graphql/schema", GraphQLSchema(db))
+	}
+
+	// Writes need a key with the write scope or an editor session, and writes
+	// other than creation require an If-Match header with the current ETag.
+	// Their changes only queue webhook deliveries when something sends them.
+	writeOpts := WriteOptions{Webhooks: cfg.Features.Webhooks}
+	writes := r.Group("/firearms", RequireScope(ScopeWrite))
+	writes.POST("", CreateFirearm(db, writeOpts))
+	writes.POST("/batch", BatchFirearms(db, writeOpts))
+	writes.PATCH("/:id", UpdateFirearm(db, writeOpts))
+	writes.DELETE("/:id", DeleteFirearm(db, writeOpts))
+	writes.POST("/:id/restore", RestoreFirearm(db, writeOpts))
+
+	// Contributors can't change firearms, but can add the sources backing
+	// their fields
+	cite := RequireRoleOrScope(RoleContributor, ScopeWrite)
+	r.POST("/firearms/:id/citations", cite, AddCitation(db))
+	r.DELETE("/firearms/:id/citations/:citation", cite, DeleteCitation(db))
+
+	sources := r.Group("/sources")
+	sources.GET("", ListSources(db))
+	sources.GET("/:id", GetSource(db))
+	sources.POST("", cite, CreateSource(db))
+
+	// Anyone can suggest a correction, editors decide which ones get applied
+	r.POST("/firearms/:id/suggestions", SubmitSuggestion(db))
+	suggestions := r.Group("/suggestions", RequireScope(ScopeWrite))
+	suggestions.GET("", ListSuggestions(db))
+	suggestions.POST("/:id/approve", ApproveSuggestion(db, writeOpts))
+	suggestions.POST("/:id/reject", RejectSuggestion(db))
+
+	admin := r.Group("/admin", RequireScope(ScopeAdmin))
+	admin.GET("/keys", ListAPIKeys(db))
+	admin.GET("/usage", GetKeyUsage(db))
+	admin.POST("/keys", CreateAPIKey(db))
+	admin.POST("/keys/:id/rotate", RotateAPIKey(db))
+	admin.DELETE("/keys/:id", RevokeAPIKey(db))
+
+	if cfg.Features.Webhooks {
+		admin.GET("/webhooks", ListWebhooks(db))
+		admin.POST("/webhooks", CreateWebhook(db))
+		admin.DELETE("/webhooks/:id", DeleteWebhook(db))
+		admin.GET("/webhooks/:id/deliveries", ListWebhookDeliveries(db))
+		admin.GET("/dead-letters", ListDeadLetters(db))
+		admin.POST("/dead-letters/:id/retry", RetryDeadLetter(db))
+	}
+
+	// Only admin users manage accounts, admin API keys can't
+	users := admin.Group("/users", RequireRole(RoleAdmin))
+	users.GET("", ListUsers(db))
+	users.POST("", CreateUser(db))
+	users.PATCH("/:id", UpdateUser(db))
+	users.DELETE("/:id", DisableUser(db))
+
+	httpLis, err := listen(serverOpts.Addr)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to listen for HTTP: %w", err)
+	}
+	server := NewServer(r, serverOpts, readiness)
+
+	stopped := make(chan error, 2)
+	go func() { stopped <- server.Serve(httpLis) }()
+	if grpcServer != nil {
+		go func() { stopped <- grpcServer.Serve(grpcLis) }()
 	}
-}
\ No newline at end of file
+	slog.Info("serving", "http", serverOpts.Addr, "tls", serverOpts.TLSCertFile != "", "grpc", grpcServer != nil, "grpc_addr", cfg.GRPC.Addr)
+
+	failed := false
+	select {
+	case <-stopping.Done():
+		slog.Info("shutting down")
+	case err := <-stopped:
+		slog.Error("server stopped", "error", err)
+		failed = true
+	}
+	stop()
+
+	// HTTP drains first while gRPC keeps serving, then gRPC gets the same
+	// deadline, and the dispatcher, traces and database are closed last
+	ctx, cancel := context.WithTimeout(context.Background(), serverOpts.DrainDelay+serverOpts.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP shutdown", "error", err)
+		failed = true
+	}
+	grpcCtx, cancelGRPC := context.WithTimeout(context.Background(), serverOpts.ShutdownTimeout)
+	defer cancelGRPC()
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(grpcCtx); err != nil {
+			slog.Error("gRPC shutdown", "error", err)
+			failed = true
+		}
+	}
+	stopDispatching()
+	<-dispatched
+	if err := shutdownTracing(grpcCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close database", "error", err)
+		failed = true
+	}
+	if failed {
+		return errors.New("server did not shut down cleanly")
+	}
+	slog.Info("shut down cleanly")
+	return nil
+}
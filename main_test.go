@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	bcryptCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// testWrites are the WriteOptions of the default configuration
+var testWrites = WriteOptions{Webhooks: true}
+
+// newTestDB returns an empty, fully migrated database that is removed when the test ends
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testSessions returns sessions signed with a fixed secret
+func testSessions(t *testing.T) *Sessions {
+	t.Helper()
+	s, err := NewSessions("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addTestFirearm stores a firearm and returns it as the API reads it back
+func addTestFirearm(t *testing.T, db *sql.DB, brand, name string, year, price int) Firearm {
+	t.Helper()
+	id, err := insertFirearm(t.Context(), db, Firearm{
+		Brand: brand, Name: name, Caliber: "9mm", Type: "pistol",
+		MagazineCapacity: 15, EffectiveRange: 50, Year: year, Price: price,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := getFirearm(t.Context(), db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// doRequest sends a request to h and returns the recorded response. headers are
+// name, value pairs.
+func doRequest(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricsRegistry holds everything served at /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+// Route labels come from gin's route templates, never raw paths, so a
+// crawler can't create a series per firearm ID. Handler labels name the
+// route or gRPC method a query ran for, see withQueryHandler.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gundatabase",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gundatabase",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route template and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gundatabase",
+		Name:      "db_query_duration_seconds",
+		Help:      "SQLite statement durations by handler and kind (query or exec). Queries are timed until their rows are closed.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+	}, []string{"handler", "kind"})
+
+	dbRowsReturned = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gundatabase",
+		Name:      "db_rows_returned",
+		Help:      "Rows read per SQLite query by handler.",
+		Buckets:   []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"handler"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gundatabase",
+		Name:      "cache_requests_total",
+		Help:      "Cacheable requests by route template and result: hit when answered with 304 Not Modified, miss otherwise.",
+	}, []string{"route", "result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, dbQueryDuration, dbRowsReturned, cacheRequests,
+	)
+}
+
+// routeLabel returns the route template of a request, or "unmatched" for
+// requests no route handled
+func routeLabel(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// Metrics counts and times every request by method, route template and
+// status, and labels the queries it runs with its route
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Request = c.Request.WithContext(withQueryHandler(c.Request.Context(), routeLabel(c)))
+		c.Next()
+		labels := prometheus.Labels{
+			"method": c.Request.Method,
+			"route":  routeLabel(c),
+			"status": strconv.Itoa(c.Writer.Status()),
+		}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordCacheResult counts whether a cacheable request was answered from the client's cache
+func recordCacheResult(c *gin.Context, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(routeLabel(c), result).Inc()
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// registerDBStats exports the connection pool stats of the server's database
+func registerDBStats(db *sql.DB) {
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(db, "gundatabase"))
+}
+
+// queryHandlerKey is the context key of the handler label of the queries run with it
+type queryHandlerKey struct{}
+
+// withQueryHandler labels the queries run with ctx as run for handler, a route
+// template or gRPC method, so the label can't blow up
+func withQueryHandler(ctx context.Context, handler string) context.Context {
+	return context.WithValue(ctx, queryHandlerKey{}, handler)
+}
+
+// queryHandler returns the handler label of a query, "background" for those
+// run outside a request, like the webhook dispatcher's
+func queryHandler(ctx context.Context) string {
+	if handler, ok := ctx.Value(queryHandlerKey{}).(string); ok {
+		return handler
+	}
+	return "background"
+}
+
+// dbConnector opens SQLite connections that time and trace their statements
+type dbConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (mc dbConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := mc.driver.Open(mc.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{SQLiteConn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+func (mc dbConnector) Driver() driver.Driver { return mc.driver }
+
+// openDB opens a SQLite database whose statements are recorded in the db_*
+// metrics and traced as part of the request that runs them
+func openDB(dsn string) *sql.DB {
+	return sql.OpenDB(dbConnector{dsn: dsn, driver: &sqlite3.SQLiteDriver{}})
+}
+
+// instrumentedConn is a SQLite connection that times and traces its queries and execs
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start, handler, span := time.Now(), queryHandler(ctx), startQuerySpan(ctx, query)
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		dbQueryDuration.WithLabelValues(handler, "query").Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+		return nil, err
+	}
+	return &instrumentedRows{Rows: rows, handler: handler, start: start, span: span}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start, span := time.Now(), startQuerySpan(ctx, query)
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	dbQueryDuration.WithLabelValues(queryHandler(ctx), "exec").Observe(time.Since(start).Seconds())
+	if err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			span.SetAttributes(attribute.Int64("db.rows_affected", n))
+		}
+	}
+	endSpan(span, err)
+	return res, err
+}
+
+// instrumentedRows counts the rows read off a query and records it once closed
+type instrumentedRows struct {
+	driver.Rows
+	handler string
+	start   time.Time
+	span    trace.Span
+	count   int
+	closed  bool
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		dbQueryDuration.WithLabelValues(r.handler, "query").Observe(time.Since(r.start).Seconds())
+		dbRowsReturned.WithLabelValues(r.handler).Observe(float64(r.count))
+		r.span.SetAttributes(attribute.Int("db.rows_returned", r.count))
+		r.span.End()
+	}
+	return r.Rows.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramSamples returns how many observations and their sum a histogram series has
+func histogramSamples(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestMetrics(t *testing.T) {
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Glock", "19", 1988, 560)
+	r := gin.New()
+	r.Use(Metrics())
+	r.GET("/metrics", MetricsHandler())
+	lists := r.Group("/", ConditionalList(db))
+	lists.GET("/brand/:brand", GetFirearmsByBrand(db))
+
+	requests := httpRequests.WithLabelValues(http.MethodGet, "/brand/:brand", "200")
+	notFound := httpRequests.WithLabelValues(http.MethodGet, "/brand/:brand", "404")
+	notModified := httpRequests.WithLabelValues(http.MethodGet, "/brand/:brand", "304")
+	unmatched := httpRequests.WithLabelValues(http.MethodGet, "unmatched", "404")
+	hits := cacheRequests.WithLabelValues("/brand/:brand", "hit")
+	misses := cacheRequests.WithLabelValues("/brand/:brand", "miss")
+	before := []float64{testutil.ToFloat64(requests), testutil.ToFloat64(notFound), testutil.ToFloat64(notModified), testutil.ToFloat64(unmatched),
+		testutil.ToFloat64(hits), testutil.ToFloat64(misses)}
+	queries, _ := histogramSamples(t, dbQueryDuration.WithLabelValues("/brand/:brand", "query"))
+	rowQueries, rows := histogramSamples(t, dbRowsReturned.WithLabelValues("/brand/:brand"))
+
+	// Each brand is counted under the route template, not its own path, and
+	// the brand with no firearms gets a 404
+	w := doRequest(r, http.MethodGet, "/brand/glock", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	doRequest(r, http.MethodGet, "/brand/colt", "")
+	doRequest(r, http.MethodGet, "/brand/glock", "", "If-None-Match", w.Header().Get("ETag"))
+	doRequest(r, http.MethodGet, "/no/such/route", "")
+
+	after := []float64{testutil.ToFloat64(requests), testutil.ToFloat64(notFound), testutil.ToFloat64(notModified), testutil.ToFloat64(unmatched),
+		testutil.ToFloat64(hits), testutil.ToFloat64(misses)}
+	for i, want := range []float64{1, 1, 1, 1, 1, 2} {
+		if got := after[i] - before[i]; got != want {
+			t.Errorf("counter %d went up by %v, want %v", i, got, want)
+		}
+	}
+
+	// The queries are put down to the route that ran them, with their rows:
+	// the table version read by every request and the brand query by the two
+	// not answered with a 304
+	if n, _ := histogramSamples(t, dbQueryDuration.WithLabelValues("/brand/:brand", "query")); n-queries != 5 {
+		t.Errorf("recorded %d queries for /brand/:brand, want 5", n-queries)
+	}
+	if n, sum := histogramSamples(t, dbRowsReturned.WithLabelValues("/brand/:brand")); n-rowQueries != 5 || sum-rows != 5 {
+		t.Errorf("recorded %d queries returning %v rows, want 5 returning 5", n-rowQueries, sum-rows)
+	}
+
+	w = doRequest(r, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics got %d", w.Code)
+	}
+	out := w.Body.String()
+	for _, want := range []string{
+		`gundatabase_http_requests_total{method="GET",route="/brand/:brand",status="200"}`,
+		`gundatabase_http_request_duration_seconds_bucket{method="GET",route="/brand/:brand",status="200",le="+Inf"}`,
+		`gundatabase_db_query_duration_seconds_count{handler="/brand/:brand",kind="query"}`,
+		`gundatabase_cache_requests_total{result="hit",route="/brand/:brand"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+	if strings.Contains(out, "/brand/glock") {
+		t.Error("metrics are labeled with a raw path")
+	}
+}
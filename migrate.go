@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order on top of the base schema created by InitDB.
+// PRAGMA user_version records how many of them have already run, so entries
+// must only ever be appended.
+var migrations = []string{
+	// 1: version counter used for optimistic concurrency on writes
+	`ALTER TABLE firearms ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+	// 2: API keys, stored as SHA-256 hashes of the secret
+	`CREATE TABLE api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);`,
+	// 3: per key request quotas and the counters they are checked against,
+	// one row per key and day or month. A quota of 0 means unlimited.
+	`ALTER TABLE api_keys ADD COLUMN daily_quota INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE api_keys ADD COLUMN monthly_quota INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE api_key_usage (
+		key_id INTEGER NOT NULL REFERENCES api_keys(id),
+		period TEXT NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_id, period)
+	);`,
+	// 4: user accounts with bcrypt passwords, and the refresh tokens of their
+	// sessions stored as SHA-256 hashes with a unix expiry
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		disabled_at TIMESTAMP
+	);
+	CREATE TABLE refresh_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		token_hash TEXT NOT NULL UNIQUE,
+		expires_at INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	);`,
+	// 5: full before and after JSON snapshots of every firearm write. before is
+	// NULL for creations and after is NULL for deletions.
+	`CREATE TABLE firearm_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		firearm_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		before TEXT,
+		after TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_firearm_revisions_firearm ON firearm_revisions(firearm_id, id);`,
+	// 6: soft deletes, rows with a deleted_at are hidden from reads until restored or purged
+	`ALTER TABLE firearms ADD COLUMN deleted_at TIMESTAMP;
+	CREATE INDEX idx_firearms_deleted_at ON firearms(deleted_at);`,
+	// 7: community suggested corrections waiting for an editor to approve or
+	// reject them. changes holds the proposed fields as JSON.
+	`CREATE TABLE firearm_suggestions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		firearm_id INTEGER NOT NULL,
+		changes TEXT NOT NULL,
+		source TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		base_version INTEGER NOT NULL,
+		submitted_by TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		decided_by TEXT,
+		decision_note TEXT,
+		decided_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_firearm_suggestions_status ON firearm_suggestions(status, id);`,
+	// 8: sources and the citations linking a firearm's fields to them. The
+	// citations table version lets responses that include them emit ETags, and
+	// citations go away with their firearm when it is purged.
+	`CREATE TABLE sources (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		publisher TEXT NOT NULL DEFAULT '',
+		url TEXT,
+		isbn TEXT,
+		accessed_on TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE firearm_citations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		firearm_id INTEGER NOT NULL,
+		field TEXT NOT NULL,
+		source_id INTEGER NOT NULL REFERENCES sources(id),
+		confidence TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(firearm_id, field, source_id)
+	);
+	INSERT INTO table_versions (name) VALUES ('citations');
+	CREATE TRIGGER trg_citations_version_insert AFTER INSERT ON firearm_citations BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'citations';
+	END;
+	CREATE TRIGGER trg_citations_version_update AFTER UPDATE ON firearm_citations BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'citations';
+	END;
+	CREATE TRIGGER trg_citations_version_delete AFTER DELETE ON firearm_citations BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'citations';
+	END;
+	CREATE TRIGGER trg_sources_version_update AFTER UPDATE ON sources BEGIN
+		UPDATE table_versions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE name = 'citations';
+	END;
+	CREATE TRIGGER trg_firearms_purge_citations AFTER DELETE ON firearms BEGIN
+		DELETE FROM firearm_citations WHERE firearm_id = OLD.id;
+	END;`,
+	// 9: webhook subscriptions and their outbox of deliveries. Deliveries are
+	// written in the same transaction as the change they announce and sent
+	// once it commits; next_attempt_at is a unix time.
+	`CREATE TABLE webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		disabled_at TIMESTAMP
+	);
+	CREATE TABLE webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id),
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_status_code INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);`,
+}
+
+// schemaVersion returns the number of migrations applied to the database
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies every pending migration, each in its own transaction
+func migrate(db *sql.DB) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
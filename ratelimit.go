@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdleBuckets is how many buckets the limiter keeps before it forgets the
+// ones that have refilled completely
+const maxIdleBuckets = 10000
+
+// errQuotaExceeded is reported when a key has used up its daily or monthly quota
+var errQuotaExceeded = errors.New("request quota exceeded")
+
+// RateLimiter is an in-memory token bucket per client. Every client may burst
+// up to Burst requests and regains PerMinute tokens a minute.
+type RateLimiter struct {
+	PerMinute int
+	Burst     int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateDecision is the outcome of taking a token from a bucket
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next token, when not allowed
+}
+
+// NewRateLimiter returns a limiter granting perMinute requests a minute with bursts of up to burst
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	return &RateLimiter{
+		PerMinute: perMinute,
+		Burst:     burst,
+		buckets:   make(map[string]*bucket),
+		now:       time.Now,
+	}
+}
+
+// take spends a token from the client's bucket if it has one
+func (l *RateLimiter) take(client string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	perSecond := float64(l.PerMinute) / 60
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep(now, perSecond)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	d := rateDecision{allowed: b.tokens >= 1}
+	if d.allowed {
+		b.tokens--
+	} else {
+		d.retryAfter = secondsDuration((1 - b.tokens) / perSecond)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = secondsDuration((float64(l.Burst) - b.tokens) / perSecond)
+	return d
+}
+
+// sweep forgets buckets that have refilled, since they behave like new ones
+func (l *RateLimiter) sweep(now time.Time, perSecond float64) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*perSecond >= float64(l.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ceilSeconds formats a duration as whole seconds rounded up, as the rate limit headers expect
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// usagePeriods returns the day and month usage rows a request at t counts towards,
+// along with when each of them ends
+func usagePeriods(t time.Time) (day, month string, dayEnd, monthEnd time.Time) {
+	t = t.UTC()
+	dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return "day:" + dayStart.Format("2006-01-02"), "month:" + monthStart.Format("2006-01"),
+		dayStart.AddDate(0, 0, 1), monthStart.AddDate(0, 1, 0)
+}
+
+// countKeyRequest records a request against the key's daily and monthly usage.
+// When either quota is already used up nothing is recorded and errQuotaExceeded
+// is returned along with how long until the quota resets.
+func countKeyRequest(ctx context.Context, db *sql.DB, k APIKey, now time.Time) (time.Duration, error) {
+	day, month, dayEnd, monthEnd := usagePeriods(now)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Each period is counted by an upsert that leaves a used up quota alone
+	// and then returns no row. The transaction starts with a write, so it
+	// holds the write lock from the start and concurrent requests queue up
+	// for it rather than racing for the last request of a quota.
+	for _, q := range []struct {
+		period string
+		quota  int
+		end    time.Time
+	}{{month, k.MonthlyQuota, monthEnd}, {day, k.DailyQuota, dayEnd}} {
+		var used int
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO api_key_usage (key_id, period, requests) VALUES (?, ?, 1)
+			ON CONFLICT (key_id, period) DO UPDATE SET requests = requests + 1
+			WHERE ? = 0 OR requests < ?
+			RETURNING requests`, k.ID, q.period, q.quota, q.quota).Scan(&used)
+		if err == sql.ErrNoRows {
+			return q.end.Sub(now), errQuotaExceeded
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to record API key usage: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit API key usage: %w", err)
+	}
+	return 0, nil
+}
+
+// RateLimit throttles requests per API key or user, or per client IP for
+// anonymous requests, and enforces the quotas of API keys. It must run after Authenticate.
+func RateLimit(db *sql.DB, l *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := "ip:" + c.ClientIP()
+		k, hasKey := currentAPIKey(c)
+		if hasKey {
+			client = "key:" + strconv.Itoa(k.ID)
+		} else if claims, ok := currentUser(c); ok {
+			client = "user:" + strconv.Itoa(claims.UserID)
+		}
+
+		d := l.take(client)
+		c.Header("RateLimit-Limit", strconv.Itoa(l.Burst))
+		c.Header("RateLimit-Remaining", strconv.Itoa(d.remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(d.reset))
+		if !d.allowed {
+			c.Header("Retry-After", ceilSeconds(d.retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded, slow down"})
+			return
+		}
+
+		if hasKey {
+			retryAfter, err := countKeyRequest(c.Request.Context(), db, k, l.now())
+			if err == errQuotaExceeded {
+				c.Header("Retry-After", ceilSeconds(retryAfter))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// KeyUsage reports how much of its quotas a key has used in the current day and month
+type KeyUsage struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	DailyUsed    int    `json:"daily_used"`
+	DailyQuota   int    `json:"daily_quota"`
+	MonthlyUsed  int    `json:"monthly_used"`
+	MonthlyQuota int    `json:"monthly_quota"`
+}
+
+// listKeyUsage returns the current usage of every active key
+func listKeyUsage(ctx context.Context, db dbtx, now time.Time) ([]KeyUsage, error) {
+	day, month, _, _ := usagePeriods(now)
+	rows, err := db.QueryContext(ctx, `
+		SELECT k.id, k.name, COALESCE(d.requests, 0), k.daily_quota, COALESCE(m.requests, 0), k.monthly_quota
+		FROM api_keys k
+		LEFT JOIN api_key_usage d ON d.key_id = k.id AND d.period = ?
+		LEFT JOIN api_key_usage m ON m.key_id = k.id AND m.period = ?
+		WHERE k.revoked_at IS NULL
+		ORDER BY k.id`, day, month)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API key usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := []KeyUsage{}
+	for rows.Next() {
+		var u KeyUsage
+		if err := rows.Scan(&u.ID, &u.Name, &u.DailyUsed, &u.DailyQuota, &u.MonthlyUsed, &u.MonthlyQuota); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		usage = append(usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return usage, nil
+}
+
+// setAPIKeyQuota changes the daily and monthly quotas of an active key
+func setAPIKeyQuota(ctx context.Context, db dbtx, id, daily, monthly int) error {
+	res, err := db.ExecContext(ctx, "UPDATE api_keys SET daily_quota = ?, monthly_quota = ? WHERE id = ? AND revoked_at IS NULL", daily, monthly, id)
+	if err != nil {
+		return fmt.Errorf("failed to set API key quota: %w", err)
+	}
+	return expectKeyRow(res)
+}
+
+// GetKeyUsage lists the current day and month usage of every active key
+func GetKeyUsage(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		usage, err := listKeyUsage(c.Request.Context(), db, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 31, 23, 59, 0, 0, time.UTC)
+	l := NewRateLimiter(60, 2)
+	l.now = func() time.Time { return now }
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)), RateLimit(db, l))
+	r.GET("/all", GetAllFirearms(db))
+
+	for i, want := range []string{"1", "0"} {
+		w := doRequest(r, http.MethodGet, "/all", "")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != want {
+			t.Fatalf("request %d got %d with %q remaining, want 200 with %s", i+1, w.Code, w.Header().Get("RateLimit-Remaining"), want)
+		}
+	}
+	w := doRequest(r, http.MethodGet, "/all", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("third request got %d with Retry-After %q and limit %q, want 429, 1 and 2",
+			w.Code, w.Header().Get("Retry-After"), w.Header().Get("RateLimit-Limit"))
+	}
+
+	// An API key has its own bucket, separate from its IP
+	k, secret, err := createAPIKey(t.Context(), db, "quota", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setAPIKeyQuota(t.Context(), db, k.ID, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, "/all", "", "X-API-Key", secret); w.Code != http.StatusOK {
+		t.Fatalf("first keyed request got %d, want 200", w.Code)
+	}
+
+	// The bucket has refilled, but the daily quota of 1 is used up until midnight
+	now = now.Add(30 * time.Second)
+	w = doRequest(r, http.MethodGet, "/all", "", "X-API-Key", secret)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("over quota got %d with Retry-After %q, want 429 and 30", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := doRequest(r, http.MethodGet, "/all", ""); w.Code != http.StatusOK {
+		t.Errorf("anonymous request after the refill got %d, want 200", w.Code)
+	}
+
+	usage, err := listKeyUsage(t.Context(), db, now)
+	if err != nil || len(usage) != 1 || usage[0].DailyUsed != 1 || usage[0].MonthlyUsed != 1 {
+		t.Fatalf("usage is %+v, %v, want one key with 1 request today and this month", usage, err)
+	}
+
+	// Midnight on the 31st starts both a new day and a new month
+	now = now.Add(time.Minute)
+	if w := doRequest(r, http.MethodGet, "/all", "", "X-API-Key", secret); w.Code != http.StatusOK {
+		t.Fatalf("keyed request the next day got %d, want 200", w.Code)
+	}
+	usage, err = listKeyUsage(t.Context(), db, now)
+	if err != nil || usage[0].DailyUsed != 1 || usage[0].MonthlyUsed != 1 {
+		t.Errorf("usage on the new day %+v, %v, want 1 request today and 1 this month", usage, err)
+	}
+}
+
+func TestConcurrentQuota(t *testing.T) {
+	db := newTestDB(t)
+	k, _, err := createAPIKey(t.Context(), db, "busy", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.DailyQuota = 5
+
+	// Every request either gets one of the 5 or is told the quota is used up
+	now := time.Now()
+	errs := make(chan error, 20)
+	var wg sync.WaitGroup
+	for range cap(errs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := countKeyRequest(t.Context(), db, k, now)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	allowed := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			allowed++
+		case errQuotaExceeded:
+		default:
+			t.Errorf("concurrent request failed: %v", err)
+		}
+	}
+	usage, err := listKeyUsage(t.Context(), db, now)
+	if allowed != 5 || err != nil || usage[0].DailyUsed != 5 {
+		t.Errorf("%d requests allowed and usage %+v, %v, want 5", allowed, usage, err)
+	}
+}
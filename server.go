@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ServerOptions configures the HTTP server and how it shuts down
+type ServerOptions struct {
+	// Addr is a host:port to listen on, or unix:/path/to.sock for a Unix socket
+	Addr string
+	// TLSCertFile and TLSKeyFile, when both set, serve HTTPS from PEM files
+	TLSCertFile string
+	TLSKeyFile  string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout doesn't apply to /events, which streams for as long as the client stays
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+
+	// DrainDelay is how long /readyz fails before the server stops accepting
+	// connections, and ShutdownTimeout how long in-flight requests then get
+	// to finish before their connections are closed
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// DefaultServerOptions returns the options the server runs with unless overridden
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		Addr:              ":4000",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 << 10,
+		DrainDelay:        5 * time.Second,
+		ShutdownTimeout:   20 * time.Second,
+	}
+}
+
+// listen opens the listener for an address, removing a stale Unix socket first
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove old socket: %w", err)
+	}
+	return net.Listen("unix", path)
+}
+
+// Server is the HTTP server of the API
+type Server struct {
+	opts      ServerOptions
+	http      *http.Server
+	readiness *Readiness
+}
+
+// NewServer returns a server for handler with the given options. Readiness is
+// drained when it starts shutting down.
+func NewServer(handler http.Handler, opts ServerOptions, readiness *Readiness) *Server {
+	return &Server{
+		opts:      opts,
+		readiness: readiness,
+		http: &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+			ReadTimeout:       opts.ReadTimeout,
+			WriteTimeout:      opts.WriteTimeout,
+			IdleTimeout:       opts.IdleTimeout,
+			MaxHeaderBytes:    opts.MaxHeaderBytes,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		},
+	}
+}
+
+// Serve accepts connections on l until Shutdown is called, returning nil then
+func (s *Server) Serve(l net.Listener) error {
+	var err error
+	if s.opts.TLSCertFile != "" {
+		err = s.http.ServeTLS(l, s.opts.TLSCertFile, s.opts.TLSKeyFile)
+	} else {
+		err = s.http.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown fails readiness and waits DrainDelay for load balancers to notice,
+// then ends open streams, stops accepting connections and waits for in-flight
+// requests until ShutdownTimeout or ctx runs out, closing whatever is left
+// after that
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.readiness.Drain()
+	slog.Info("draining before shutdown", "delay", s.opts.DrainDelay.String())
+	select {
+	case <-time.After(s.opts.DrainDelay):
+	case <-ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.ShutdownTimeout)
+	defer cancel()
+	s.readiness.EndStreams()
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.http.Close()
+		return fmt.Errorf("failed to finish in-flight requests: %w", err)
+	}
+	return nil
+}
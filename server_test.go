@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startServer serves r on a free local port and returns its base URL
+func startServer(t *testing.T, r http.Handler, opts ServerOptions, readiness *Readiness) (*Server, string) {
+	t.Helper()
+	l, err := listen(opts.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(r, opts, readiness)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.http.Close() })
+	return srv, "http://" + l.Addr().String()
+}
+
+func TestServerShutdown(t *testing.T) {
+	readiness := NewReadiness()
+	started := make(chan struct{}, 2)
+	r := gin.New()
+	r.GET("/readyz", func(c *gin.Context) {
+		if readiness.Draining() {
+			c.Status(http.StatusServiceUnavailable)
+		}
+	})
+	r.GET("/slow", func(c *gin.Context) {
+		started <- struct{}{}
+		time.Sleep(300 * time.Millisecond)
+		if err := c.Request.Context().Err(); err != nil {
+			c.String(http.StatusOK, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+		started <- struct{}{}
+		<-readiness.StreamsEnded()
+	})
+
+	opts := DefaultServerOptions()
+	opts.Addr = "127.0.0.1:0"
+	opts.DrainDelay = 100 * time.Millisecond
+	opts.ShutdownTimeout = 5 * time.Second
+	srv, url := startServer(t, r, opts, readiness)
+
+	// A stream that never ends on its own, and a request still running at shutdown
+	stream, err := http.Get(url + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	// Readiness fails while connections are still accepted during the drain delay
+	time.Sleep(20 * time.Millisecond)
+	if resp, err := http.Get(url + "/readyz"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining got %v, %v", resp, err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shutdown = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown waited on the stream")
+	}
+	if body := <-slow; body != "done" {
+		t.Errorf("in-flight request got %q", body)
+	}
+	if _, err := http.Get(url + "/readyz"); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "gundatabase.sock")
+	r := gin.New()
+	r.GET("/healthz", Healthz())
+	opts := DefaultServerOptions()
+	opts.Addr = "unix:" + sock
+	startServer(t, r, opts, NewReadiness())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://unix/healthz")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz over the socket got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestEventsOutliveWriteTimeout(t *testing.T) {
+	defer func(poll time.Duration) { eventPollInterval = poll }(eventPollInterval)
+	eventPollInterval = 10 * time.Millisecond
+
+	db := newTestDB(t)
+	r := gin.New()
+	r.Use(RequestLog(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	r.GET("/events", StreamEvents(db, nil))
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+	opts := DefaultServerOptions()
+	opts.Addr = "127.0.0.1:0"
+	opts.WriteTimeout = 100 * time.Millisecond
+	_, url := startServer(t, r, opts, NewReadiness())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// A change made well after the write timeout still comes through
+	time.Sleep(300 * time.Millisecond)
+	if w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`); w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	events := readEvents(t, bufio.NewScanner(resp.Body), 1)
+	if events[0].name != EventFirearmCreated {
+		t.Errorf("event = %+v", events[0])
+	}
+}
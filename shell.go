@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const shellHelp = `commands:
+  find [-brand b] [-name n] [-caliber c] [-type t] [-country c]
+       [-year y] [-min-price p] [-max-price p] [-sort key] [-limit n]
+                        list the firearms matching the filters, as query does
+  sort <key>            sort the last results again, -key for descending
+  next, prev            page through the last results
+  show <id>             every field of one firearm
+  compare <id> <id>...  firearms side by side, differing fields marked with *
+  help                  this list
+  quit                  leave, as does end of input
+values with spaces go in quotes: find -country "united states"
+`
+
+// errFirearmNotFound is returned by a catalogSource for an ID it has no live firearm for
+var errFirearmNotFound = errors.New("no firearm with this id")
+
+// catalogSource is where the shell reads firearms from, the database file
+// itself or a running server
+type catalogSource interface {
+	// find returns up to limit firearms matching filter in the order of sort,
+	// a sortOrder key, after skipping offset, and how many match in all
+	find(filter FirearmFilter, sort string, limit, offset int) ([]Firearm, int, error)
+	// get returns a single live firearm or errFirearmNotFound
+	get(id int) (Firearm, error)
+}
+
+// dbSource reads straight from the database through the query layer the API uses
+type dbSource struct{ db *sql.DB }
+
+func (s dbSource) find(filter FirearmFilter, sort string, limit, offset int) ([]Firearm, int, error) {
+	orderBy, err := sortOrder(sort)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond, args := filter.where()
+	return pageFirearms(context.Background(), s.db, cond, args, orderBy, limit, offset)
+}
+
+func (s dbSource) get(id int) (Firearm, error) {
+	f, err := getFirearm(context.Background(), s.db, id)
+	if err == sql.ErrNoRows {
+		return Firearm{}, errFirearmNotFound
+	}
+	if err != nil {
+		return Firearm{}, fmt.Errorf("failed to query database: %w", err)
+	}
+	return f, nil
+}
+
+// remoteFirearmsQuery asks /graphql for a page of firearms, aliasing the
+// fields to their REST names so they decode into a Firearm
+const remoteFirearmsQuery = `query Find($filter: FirearmFilter, $sort: FirearmSort!, $order: SortOrder!, $first: Int!, $offset: Int!) {
+  firearms(filter: $filter, sort: $sort, order: $order, first: $first, offset: $offset) {
+    total
+    items {
+      id brand name caliber { name } type magazine_capacity: magazineCapacity
+      effective_range: effectiveRange year price manufacturer { name } weight
+      barrel_length: barrelLength action country_of_origin: countryOfOrigin
+      created_at: createdAt updated_at: updatedAt version
+    }
+  }
+}`
+
+// remoteFirearm is a firearm as remoteFirearmsQuery returns it, with the
+// caliber and manufacturer as objects
+type remoteFirearm struct {
+	Firearm
+	Caliber      struct{ Name string }  `json:"caliber"`
+	Manufacturer *struct{ Name string } `json:"manufacturer"`
+}
+
+// httpSource reads from a running server: lists through /graphql, which
+// takes the same filter, a page of at most graphQLMaxFirst at a time, and
+// single firearms from /id/:id
+type httpSource struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// newHTTPSource returns a source for the server at baseURL, sending apiKey when set
+func newHTTPSource(baseURL, apiKey string) httpSource {
+	return httpSource{baseURL: strings.TrimRight(baseURL, "/"), apiKey: apiKey, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// do sends a request to the server and decodes a 200 response into v
+func (s httpSource) do(req *http.Request, v any) (int, error) {
+	req.Header.Set("Accept", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct{ Error, Message string }
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+		return resp.StatusCode, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, body.Error+body.Message)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid response from %s: %w", req.URL.Path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s httpSource) find(filter FirearmFilter, sort string, limit, offset int) ([]Firearm, int, error) {
+	if _, err := sortOrder(sort); err != nil {
+		return nil, 0, err
+	}
+	order := "ASC"
+	if rest, ok := strings.CutPrefix(sort, "-"); ok {
+		sort, order = rest, "DESC"
+	}
+	input := map[string]any{}
+	for name, v := range map[string]string{"brand": filter.Brand, "name": filter.Name, "caliber": filter.Caliber, "type": filter.Type, "country": filter.Country} {
+		if v != "" {
+			input[name] = v
+		}
+	}
+	for name, v := range map[string]*int{"year": filter.Year, "minPrice": filter.MinPrice, "maxPrice": filter.MaxPrice} {
+		if v != nil {
+			input[name] = *v
+		}
+	}
+	vars := map[string]any{"filter": input, "sort": strings.ToUpper(sort), "order": order}
+
+	// /graphql returns at most graphQLMaxFirst firearms per query, so larger
+	// limits take several
+	var firearms []Firearm
+	for {
+		first := min(limit-len(firearms), graphQLMaxFirst)
+		vars["first"], vars["offset"] = first, offset+len(firearms)
+		page, total, err := s.findPage(vars)
+		if err != nil {
+			return nil, 0, err
+		}
+		firearms = append(firearms, page...)
+		if len(firearms) >= limit || len(page) < first {
+			return firearms, total, nil
+		}
+	}
+}
+
+// findPage runs remoteFirearmsQuery once with vars
+func (s httpSource) findPage(vars map[string]any) ([]Firearm, int, error) {
+	body, err := json.Marshal(graphQLRequest{Query: remoteFirearmsQuery, Variables: vars})
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+"/graphql", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		Data struct {
+			Firearms struct {
+				Total int             `json:"total"`
+				Items []remoteFirearm `json:"items"`
+			} `json:"firearms"`
+		} `json:"data"`
+	}
+	if status, err := s.do(req, &resp); status == http.StatusNotFound {
+		return nil, 0, errors.New("the server doesn't serve /graphql, it needs features.graphql on")
+	} else if err != nil {
+		return nil, 0, err
+	}
+	firearms := make([]Firearm, len(resp.Data.Firearms.Items))
+	for i, r := range resp.Data.Firearms.Items {
+		firearms[i] = r.Firearm
+		firearms[i].Caliber = r.Caliber.Name
+		if r.Manufacturer != nil {
+			firearms[i].Manufacturer = r.Manufacturer.Name
+		}
+	}
+	return firearms, resp.Data.Firearms.Total, nil
+}
+
+func (s httpSource) get(id int) (Firearm, error) {
+	req, err := http.NewRequest(http.MethodGet, s.baseURL+"/id/"+strconv.Itoa(id), nil)
+	if err != nil {
+		return Firearm{}, err
+	}
+	var f Firearm
+	if status, err := s.do(req, &f); status == http.StatusNotFound {
+		return Firearm{}, errFirearmNotFound
+	} else if err != nil {
+		return Firearm{}, err
+	}
+	return f, nil
+}
+
+// shell is an interactive session over a catalogSource. It keeps the last
+// search so it can be sorted and paged without typing it again.
+type shell struct {
+	source catalogSource
+	out    io.Writer
+
+	filter FirearmFilter
+	sort   string
+	limit  int
+	offset int
+}
+
+// runShellCommand starts an interactive session reading commands from in,
+// against the database or, with -server, a running server
+func runShellCommand(cfg Config, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	fs.SetOutput(out)
+	server := fs.String("server", "", "base URL of a running server, e.g. http://localhost:4000, instead of the database")
+	apiKey := fs.String("key", "", "API key to send to the server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	var source catalogSource
+	where := cfg.Database.DSN
+	if *server != "" {
+		if u, err := url.Parse(*server); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("-server must be a URL like http://localhost:4000, got %q", *server)
+		}
+		source, where = newHTTPSource(*server, *apiKey), *server
+	} else {
+		db, err := InitDB(cfg.Database.DSN)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		source = dbSource{db}
+	}
+	fmt.Fprintf(out, "reading firearms from %s, type help for the commands\n", where)
+	return newShell(source, out).run(in)
+}
+
+// newShell returns a shell over source writing to out, with no search yet
+func newShell(source catalogSource, out io.Writer) *shell {
+	return &shell{source: source, out: out, sort: "id", limit: 20}
+}
+
+// run reads commands from in until quit or the end of input. A failing
+// command prints its error and the session carries on.
+func (s *shell) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return scanner.Err()
+		}
+		words, err := splitWords(scanner.Text())
+		if err == nil && len(words) > 0 {
+			if words[0] == "quit" || words[0] == "exit" {
+				return nil
+			}
+			err = s.exec(words[0], words[1:])
+		}
+		if err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+		}
+	}
+}
+
+// exec runs a single shell command
+func (s *shell) exec(cmd string, args []string) error {
+	switch cmd {
+	case "help":
+		fmt.Fprint(s.out, shellHelp)
+		return nil
+	case "find":
+		return s.find(args)
+	case "sort":
+		if len(args) != 1 {
+			return errors.New("usage: sort <key>, one of " + strings.Join(sortKeys(), ", "))
+		}
+		if _, err := sortOrder(args[0]); err != nil {
+			return err
+		}
+		s.sort, s.offset = args[0], 0
+		return s.list()
+	case "next":
+		s.offset += s.limit
+		return s.list()
+	case "prev":
+		s.offset = max(s.offset-s.limit, 0)
+		return s.list()
+	case "show", "compare":
+		if cmd == "show" && len(args) != 1 || cmd == "compare" && len(args) < 2 {
+			return errors.New("usage: show <id> or compare <id> <id>...")
+		}
+		firearms, err := s.load(args)
+		if err != nil {
+			return err
+		}
+		return writeFirearmFields(s.out, firearms)
+	}
+	return fmt.Errorf("unknown command %q, type help for the commands", cmd)
+}
+
+// find starts a new search from the filter flags
+func (s *shell) find(args []string) error {
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	fs.SetOutput(s.out)
+	filter := filterFlags(fs)
+	sort := fs.String("sort", "id", "order by one of "+strings.Join(sortKeys(), ", ")+", prefixed with - for descending")
+	limit := fs.Int("limit", 20, "firearms per page")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q, filters are flags like -brand glock", fs.Args())
+	}
+	if *limit < 1 {
+		return errors.New("-limit must be positive")
+	}
+	if _, err := sortOrder(*sort); err != nil {
+		return err
+	}
+	s.filter, s.sort, s.limit, s.offset = *filter, *sort, *limit, 0
+	return s.list()
+}
+
+// list shows the current page of the last search
+func (s *shell) list() error {
+	firearms, total, err := s.source.find(s.filter, s.sort, s.limit, s.offset)
+	if err != nil {
+		return err
+	}
+	if len(firearms) == 0 && s.offset > 0 {
+		s.offset = max(s.offset-s.limit, 0)
+		return errors.New("no more results")
+	}
+	return writeFirearmTable(s.out, firearms, s.offset, total)
+}
+
+// load fetches the firearms with the given IDs, in that order
+func (s *shell) load(ids []string) ([]Firearm, error) {
+	firearms := make([]Firearm, len(ids))
+	for i, raw := range ids {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an id", raw)
+		}
+		if firearms[i], err = s.source.get(id); err != nil {
+			return nil, fmt.Errorf("firearm %d: %w", id, err)
+		}
+	}
+	return firearms, nil
+}
+
+// writeFirearmFields writes every field of the firearms, one row per field
+// and one column per firearm. With more than one firearm, rows whose values
+// differ are marked with a *.
+func writeFirearmFields(out io.Writer, firearms []Firearm) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, row := range firearmFields(firearms, true) {
+		mark := " "
+		switch {
+		case len(firearms) == 1:
+			mark = ""
+		case row.Differs:
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\n", mark, row.Name, strings.Join(row.Values, "\t"))
+	}
+	return tw.Flush()
+}
+
+// splitWords splits a command line at spaces, keeping text in single or
+// double quotes together
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runShell feeds script to a shell over source and returns what it printed
+func runShell(t *testing.T, source catalogSource, script string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := newShell(source, &out).run(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestShell(t *testing.T) {
+	db := newTestDB(t)
+	glock := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Glock", "19", 1988, 600)
+	sig := addTestFirearm(t, db, "SIG Sauer", "P226", 1984, 900)
+
+	r := gin.New()
+	r.POST("/graphql", GraphQL(db))
+	r.GET("/id/:id", GetFirearmByID(db))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	script := `find -brand glock -sort -price
+sort year
+find -min-price 500 -limit 2
+next
+show 1
+compare 1 3
+show 42
+find -country "no such place"
+bogus
+`
+	local := runShell(t, dbSource{db}, script)
+	remote := runShell(t, newHTTPSource(server.URL, ""), script)
+
+	// Over HTTP the same filters find the same firearms
+	if local != remote {
+		t.Errorf("the database and the server disagree:\n%s\nvs\n%s", local, remote)
+	}
+	for _, want := range []string{
+		"1-2 of 2", "1-2 of 3", "3-3 of 3", "P226", "*price", " caliber", "error: firearm 42: no firearm with this id",
+		"no firearms match, 0 in all", `error: unknown command "bogus"`,
+	} {
+		if !strings.Contains(local, want) {
+			t.Errorf("output is missing %q:\n%s", want, local)
+		}
+	}
+	// Sorting by price descending puts the 19 first, by year the 17
+	pages := strings.Split(local, "> ")
+	if !strings.Contains(strings.Split(pages[1], "\n")[1], " 19 ") || !strings.Contains(strings.Split(pages[2], "\n")[1], " 17 ") {
+		t.Errorf("sorted pages:\n%s%s", pages[1], pages[2])
+	}
+
+	// Records come back whole from either side
+	for _, source := range []catalogSource{dbSource{db}, newHTTPSource(server.URL, "")} {
+		firearms, total, err := source.find(FirearmFilter{Brand: "SIG Sauer"}, "id", 10, 0)
+		if err != nil || total != 1 || !reflect.DeepEqual(firearms[0], sig) {
+			t.Errorf("%T find = %+v, %d, %v", source, firearms, total, err)
+		}
+		if f, err := source.get(glock.ID); err != nil || !reflect.DeepEqual(f, glock) {
+			t.Errorf("%T get = %+v, %v", source, f, err)
+		}
+	}
+}
+
+func TestShellServerPaging(t *testing.T) {
+	db := newTestDB(t)
+	for i := range graphQLMaxFirst + 5 {
+		addTestFirearm(t, db, "Glock", strconv.Itoa(i), 2000, 500+i)
+	}
+	r := gin.New()
+	r.POST("/graphql", GraphQL(db))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// Limits over what /graphql returns at once take several queries
+	local, localTotal, err := dbSource{db}.find(FirearmFilter{}, "-price", graphQLMaxFirst+2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, total, err := newHTTPSource(server.URL, "").find(FirearmFilter{}, "-price", graphQLMaxFirst+2, 1)
+	if err != nil || len(remote) != graphQLMaxFirst+2 || total != localTotal || !reflect.DeepEqual(remote, local) {
+		t.Errorf("find got %d of %d, %v, want the %d the database has", len(remote), total, err, len(local))
+	}
+	remote, _, err = newHTTPSource(server.URL, "").find(FirearmFilter{}, "id", 2*graphQLMaxFirst, 0)
+	if err != nil || len(remote) != graphQLMaxFirst+5 {
+		t.Errorf("find past the end got %d, %v", len(remote), err)
+	}
+}
+
+func TestShellServerWithoutGraphQL(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	out := runShell(t, newHTTPSource(server.URL, ""), "find\n")
+	if !strings.Contains(out, "features.graphql") {
+		t.Errorf("output = %q", out)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	words, err := splitWords(`find -country "united states"  -name 'P 226' -year 1984`)
+	if want := []string{"find", "-country", "united states", "-name", "P 226", "-year", "1984"}; err != nil || !reflect.DeepEqual(words, want) {
+		t.Errorf("words = %q, %v", words, err)
+	}
+	if _, err := splitWords(`find -brand "glock`); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+}
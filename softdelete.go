@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const includeDeletedKey = "includeDeleted"
+
+// defaultRetention is how long soft deleted firearms are kept before purge removes them
+const defaultRetention = 30 * 24 * time.Hour
+
+// IncludeDeleted lets admins add ?include_deleted=true to a read to see soft
+// deleted firearms too. Anyone else asking for them gets a 403. It must run
+// after Authenticate.
+func IncludeDeleted() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.Query("include_deleted")
+		if raw == "" {
+			c.Next()
+			return
+		}
+		include, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "include_deleted must be true or false"})
+			return
+		}
+		if include && !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "include_deleted is only available to admins"})
+			return
+		}
+		c.Set(includeDeletedKey, include)
+		c.Next()
+	}
+}
+
+// isAdmin reports whether the request comes from an admin user or an admin API key
+func isAdmin(c *gin.Context) bool {
+	if claims, ok := currentUser(c); ok {
+		return roleAtLeast(claims.Role, RoleAdmin)
+	}
+	k, ok := currentAPIKey(c)
+	return ok && k.HasScope(ScopeAdmin)
+}
+
+// includeDeleted reports whether IncludeDeleted allowed the request to see soft deleted firearms
+func includeDeleted(c *gin.Context) bool {
+	return c.GetBool(includeDeletedKey)
+}
+
+// runPurgeCommand permanently removes firearms that were soft deleted longer ago
+// than the retention window, writing the result to out
+func runPurgeCommand(db *sql.DB, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	fs.SetOutput(out)
+	olderThan := fs.Duration("older-than", defaultRetention, "purge firearms deleted longer ago than this, e.g. 720h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *olderThan < 0 {
+		return errors.New("-older-than cannot be negative")
+	}
+
+	n, err := purgeFirearms(context.Background(), db, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "purged %d firearms deleted more than %s ago\n", n, *olderThan)
+	return nil
+}
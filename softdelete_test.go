@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSoftDelete(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Colt", "M1911", 1911, 900)
+	_, adminSecret, err := createAPIKey(t.Context(), db, "admin", []string{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writeSecret, err := createAPIKey(t.Context(), db, "writer", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)), IncludeDeleted())
+	r.GET("/all", GetAllFirearms(db))
+	r.GET("/id/:id", GetFirearmByID(db))
+	r.DELETE("/firearms/:id", DeleteFirearm(db, testWrites))
+	r.POST("/firearms/:id/restore", RestoreFirearm(db, testWrites))
+
+	countAll := func(target string, headers ...string) int {
+		t.Helper()
+		w := doRequest(r, http.MethodGet, target, "", headers...)
+		var firearms []Firearm
+		if err := json.Unmarshal(w.Body.Bytes(), &firearms); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		return len(firearms)
+	}
+
+	if w := doRequest(r, http.MethodDelete, "/firearms/1", "", "If-Match", firearmValidators(f).ETag); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+	if n := countAll("/all"); n != 1 {
+		t.Errorf("/all lists %d firearms after a delete, want 1", n)
+	}
+	if w := doRequest(r, http.MethodGet, "/id/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("/id of a deleted firearm got %d, want 404", w.Code)
+	}
+	if n := countAll("/all?include_deleted=true", "X-API-Key", adminSecret); n != 2 {
+		t.Errorf("/all?include_deleted=true for an admin lists %d firearms, want 2", n)
+	}
+	if w := doRequest(r, http.MethodGet, "/all?include_deleted=true", "", "X-API-Key", writeSecret); w.Code != http.StatusForbidden {
+		t.Errorf("include_deleted for a write key got %d, want 403", w.Code)
+	}
+
+	// Undeleting needs no body and brings the same row back
+	w := doRequest(r, http.MethodPost, "/firearms/1/restore", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodPost, "/firearms/1/restore", ""); w.Code != http.StatusConflict {
+		t.Errorf("restoring a firearm that isn't deleted got %d, want 409", w.Code)
+	}
+	if n := countAll("/all"); n != 2 {
+		t.Errorf("/all lists %d firearms after the restore, want 2", n)
+	}
+
+	// Purging only removes firearms deleted before the retention window
+	restored, err := getFirearm(t.Context(), db, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteFirearm(t.Context(), db, restored.ID, restored.Version); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runPurgeCommand(db, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getAnyFirearm(t.Context(), db, f.ID); err != nil {
+		t.Errorf("default purge removed a firearm deleted just now: %v", err)
+	}
+	if _, err := db.Exec("UPDATE firearms SET deleted_at = '2020-01-01 00:00:00' WHERE id = ?", f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPurgeCommand(db, []string{"-older-than", "720h"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getAnyFirearm(t.Context(), db, f.ID); err == nil {
+		t.Error("purge kept a firearm deleted in 2020")
+	}
+}
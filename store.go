@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// errVersionConflict is returned when a write's expected version is no longer current
+	errVersionConflict = errors.New("firearm was modified by another request")
+	// errDuplicateFirearm is returned when a write would break UNIQUE(brand, name)
+	errDuplicateFirearm = errors.New("a firearm with this brand and name already exists")
+)
+
+// firearmColumns lists the firearms columns in the order scanFirearm expects them
+const firearmColumns = `id, brand, name, caliber, type, magazine_capacity, effective_range,
+	year, price, manufacturer, weight, barrel_length, action, country_of_origin,
+	created_at, updated_at, version, deleted_at`
+
+// selectFirearms is the base query every read builds on, see firearmsWhere
+const selectFirearms = "SELECT " + firearmColumns + " FROM firearms"
+
+// firearmsWhere builds a select of the firearms matching cond, leaving out soft
+// deleted ones unless includeDeleted is set. cond may be empty to match everything.
+func firearmsWhere(includeDeleted bool, cond string) string {
+	var conds []string
+	if !includeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if cond != "" {
+		conds = append(conds, "("+cond+")")
+	}
+	if len(conds) == 0 {
+		return selectFirearms
+	}
+	return selectFirearms + " WHERE " + strings.Join(conds, " AND ")
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx so queries can run inside transactions
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanFirearm reads a single firearm selected with firearmColumns
+func scanFirearm(s rowScanner) (Firearm, error) {
+	var f Firearm
+	err := s.Scan(&f.ID, &f.Brand, &f.Name, &f.Caliber, &f.Type, &f.MagazineCapacity,
+		&f.EffectiveRange, &f.Year, &f.Price, &f.Manufacturer, &f.Weight, &f.BarrelLength,
+		&f.Action, &f.CountryOfOrigin, &f.CreatedAt, &f.UpdatedAt, &f.Version, &f.DeletedAt)
+	return f, err
+}
+
+// queryFirearms runs a query selecting firearmColumns and collects the results
+func queryFirearms(ctx context.Context, db dbtx, query string, args ...any) ([]Firearm, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %w", err)
+	}
+	defer rows.Close()
+
+	var firearms []Firearm
+	for rows.Next() {
+		f, err := scanFirearm(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		firearms = append(firearms, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return firearms, nil
+}
+
+// FirearmFilter narrows a list of firearms the way the REST list routes do:
+// brand and year match exactly, name, caliber, type and country in part
+// ignoring case, and price between MinPrice and MaxPrice. Empty fields match anything.
+type FirearmFilter struct {
+	Brand, Name, Caliber, Type, Country string
+	Year, MinPrice, MaxPrice            *int
+}
+
+// where turns the filter into a condition and its arguments for firearmsWhere
+func (f FirearmFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.Brand != "" {
+		add("brand = ?", strings.Title(f.Brand))
+	}
+	if f.Name != "" {
+		add("name LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(f.Name))
+	}
+	if f.Caliber != "" {
+		add("caliber LIKE '%' || ? || '%' COLLATE NOCASE", f.Caliber)
+	}
+	if f.Type != "" {
+		add("type LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(f.Type))
+	}
+	if f.Country != "" {
+		add("country_of_origin LIKE '%' || ? || '%' COLLATE NOCASE", strings.Title(f.Country))
+	}
+	if f.Year != nil {
+		add("year = ?", *f.Year)
+	}
+	if f.MinPrice != nil {
+		add("price >= ?", *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		add("price <= ?", *f.MaxPrice)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// searchColumns are the columns every word of a search is looked for in
+var searchColumns = []string{"brand", "name", "caliber", "type", "manufacturer", "country_of_origin"}
+
+// searchWhere turns the words of a free text search into a condition for
+// firearmsWhere: every word has to turn up in one of searchColumns, ignoring case
+func searchWhere(words []string) (string, []any) {
+	var conds []string
+	var args []any
+	for _, word := range words {
+		matches := make([]string, len(searchColumns))
+		for i, col := range searchColumns {
+			matches[i] = col + " LIKE '%' || ? || '%' COLLATE NOCASE"
+			args = append(args, word)
+		}
+		conds = append(conds, "("+strings.Join(matches, " OR ")+")")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// pageFirearms returns up to limit live firearms matching cond, skipping the
+// first offset in orderBy order, along with how many match in all. orderBy is
+// one of ours, never user input, and should end in a unique column so pages
+// don't overlap.
+func pageFirearms(ctx context.Context, db dbtx, cond string, args []any, orderBy string, limit, offset int) ([]Firearm, int, error) {
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+firearmsWhere(false, cond)+")", args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to query database: %w", err)
+	}
+	firearms, err := queryFirearms(ctx, db, firearmsWhere(false, cond)+" ORDER BY "+orderBy+" LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return firearms, total, nil
+}
+
+// tableVersion returns the change counter and last change time of a table
+func tableVersion(ctx context.Context, db *sql.DB, table string) (int64, time.Time, error) {
+	var version int64
+	var updatedAt time.Time
+	err := db.QueryRowContext(ctx, "SELECT version, updated_at FROM table_versions WHERE name = ?", table).Scan(&version, &updatedAt)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to read %s table version: %w", table, err)
+	}
+	return version, updatedAt, nil
+}
+
+// getFirearm loads a single firearm, returning sql.ErrNoRows when it doesn't exist or is soft deleted
+func getFirearm(ctx context.Context, db dbtx, id int) (Firearm, error) {
+	return scanFirearm(db.QueryRowContext(ctx, firearmsWhere(false, "id = ?"), id))
+}
+
+// getAnyFirearm loads a single firearm whether or not it is soft deleted,
+// returning sql.ErrNoRows when it doesn't exist
+func getAnyFirearm(ctx context.Context, db dbtx, id int) (Firearm, error) {
+	return scanFirearm(db.QueryRowContext(ctx, firearmsWhere(true, "id = ?"), id))
+}
+
+// getFirearmByBrandName loads the firearm with the given brand and name,
+// returning sql.ErrNoRows when it doesn't exist. Soft deleted firearms are
+// included since they still hold their brand and name.
+func getFirearmByBrandName(ctx context.Context, db dbtx, brand, name string) (Firearm, error) {
+	return scanFirearm(db.QueryRowContext(ctx, firearmsWhere(true, "brand = ? AND name = ?"), brand, name))
+}
+
+// insertFirearm creates a firearm and returns its new ID. A zero f.ID lets
+// SQLite assign one, anything else reuses that ID, as restoring a deleted firearm does.
+func insertFirearm(ctx context.Context, db dbtx, f Firearm) (int, error) {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO firearms (
+			id, brand, name, caliber, type, magazine_capacity, effective_range,
+			year, price, manufacturer, weight, barrel_length, action, country_of_origin
+		) VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.ID, f.Brand, f.Name, f.Caliber, f.Type, f.MagazineCapacity, f.EffectiveRange,
+		f.Year, f.Price, f.Manufacturer, f.Weight, f.BarrelLength, f.Action, f.CountryOfOrigin,
+	)
+	if err != nil {
+		return 0, writeError("insert", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return int(id), nil
+}
+
+// updateFirearm overwrites a firearm as long as its version still matches f.Version,
+// bumping the version and updated_at
+func updateFirearm(ctx context.Context, db dbtx, f Firearm) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE firearms SET
+			brand = ?, name = ?, caliber = ?, type = ?, magazine_capacity = ?, effective_range = ?,
+			year = ?, price = ?, manufacturer = ?, weight = ?, barrel_length = ?, action = ?,
+			country_of_origin = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND version = ?`,
+		f.Brand, f.Name, f.Caliber, f.Type, f.MagazineCapacity, f.EffectiveRange,
+		f.Year, f.Price, f.Manufacturer, f.Weight, f.BarrelLength, f.Action, f.CountryOfOrigin,
+		f.ID, f.Version,
+	)
+	if err != nil {
+		return writeError("update", err)
+	}
+	return expectOneRow(res)
+}
+
+// deleteFirearm soft deletes a firearm as long as its version still matches.
+// The row is kept until purgeFirearms removes it.
+func deleteFirearm(ctx context.Context, db dbtx, id, version int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE firearms SET deleted_at = CURRENT_TIMESTAMP, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND version = ? AND deleted_at IS NULL`, id, version)
+	if err != nil {
+		return writeError("delete", err)
+	}
+	return expectOneRow(res)
+}
+
+// undeleteFirearm brings back a soft deleted firearm as long as its version still matches
+func undeleteFirearm(ctx context.Context, db dbtx, id, version int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE firearms SET deleted_at = NULL, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND version = ? AND deleted_at IS NOT NULL`, id, version)
+	if err != nil {
+		return writeError("restore", err)
+	}
+	return expectOneRow(res)
+}
+
+// purgeFirearms permanently removes firearms soft deleted before cutoff and
+// returns how many were removed. Their revisions are kept on purpose, so an
+// admin can still read the history of a purged firearm and restore it from
+// one of them; nobody else gets to see it.
+func purgeFirearms(ctx context.Context, db dbtx, cutoff time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM firearms WHERE deleted_at IS NOT NULL AND deleted_at < ?", cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge firearms: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return n, nil
+}
+
+// inTx runs fn in a transaction, committing when it returns nil and rolling back otherwise
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// expectOneRow turns a versioned write that matched nothing into errVersionConflict
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return errVersionConflict
+	}
+	return nil
+}
+
+// writeError maps constraint violations to sentinel errors and wraps everything else
+func writeError(op string, err error) error {
+	if isUniqueViolation(err) {
+		return errDuplicateFirearm
+	}
+	return fmt.Errorf("failed to %s firearm: %w", op, err)
+}
+
+// isUniqueViolation reports whether err is SQLite rejecting a write that breaks a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
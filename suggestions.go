@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Suggestion statuses
+const (
+	SuggestionPending  = "pending"
+	SuggestionApproved = "approved"
+	SuggestionRejected = "rejected"
+)
+
+// errSuggestionDecided is returned when deciding a suggestion that is no longer pending
+var errSuggestionDecided = errors.New("suggestion has already been decided")
+
+// Suggestion is a proposed correction to a firearm
+type Suggestion struct {
+	ID           int          `json:"id"`
+	FirearmID    int          `json:"firearm_id"`
+	Changes      FirearmInput `json:"changes"`
+	Source       string       `json:"source"`
+	Note         string       `json:"note"`
+	BaseVersion  int          `json:"base_version"`
+	SubmittedBy  string       `json:"submitted_by"`
+	Status       string       `json:"status"`
+	DecidedBy    *string      `json:"decided_by"`
+	DecisionNote *string      `json:"decision_note"`
+	DecidedAt    *string      `json:"decided_at"`
+	CreatedAt    string       `json:"created_at"`
+
+	// Diff and Stale compare the suggestion with the firearm as it is now, for moderators
+	Diff  []FieldChange `json:"diff,omitempty"`
+	Stale bool          `json:"stale,omitempty"`
+}
+
+// suggestionColumns lists the firearm_suggestions columns in the order scanSuggestion expects them
+const suggestionColumns = `id, firearm_id, changes, source, note, base_version, submitted_by,
+	status, decided_by, decision_note, decided_at, created_at`
+
+// scanSuggestion reads a single suggestion selected with suggestionColumns
+func scanSuggestion(s rowScanner) (Suggestion, error) {
+	var sg Suggestion
+	var changes string
+	err := s.Scan(&sg.ID, &sg.FirearmID, &changes, &sg.Source, &sg.Note, &sg.BaseVersion, &sg.SubmittedBy,
+		&sg.Status, &sg.DecidedBy, &sg.DecisionNote, &sg.DecidedAt, &sg.CreatedAt)
+	if err != nil {
+		return Suggestion{}, err
+	}
+	if err := json.Unmarshal([]byte(changes), &sg.Changes); err != nil {
+		return Suggestion{}, fmt.Errorf("failed to decode suggestion %d: %w", sg.ID, err)
+	}
+	return sg, nil
+}
+
+// getSuggestion loads a suggestion, returning sql.ErrNoRows when it doesn't exist
+func getSuggestion(ctx context.Context, db dbtx, id int) (Suggestion, error) {
+	return scanSuggestion(db.QueryRowContext(ctx, "SELECT "+suggestionColumns+" FROM firearm_suggestions WHERE id = ?", id))
+}
+
+// listSuggestions returns the suggestions with a status, oldest first
+func listSuggestions(ctx context.Context, db dbtx, status string) ([]Suggestion, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+suggestionColumns+" FROM firearm_suggestions WHERE status = ? ORDER BY id", status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suggestions: %w", err)
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		sg, err := scanSuggestion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		suggestions = append(suggestions, sg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return suggestions, nil
+}
+
+// insertSuggestion stores a new pending suggestion
+func insertSuggestion(ctx context.Context, db dbtx, sg Suggestion) (Suggestion, error) {
+	changes, err := json.Marshal(sg.Changes)
+	if err != nil {
+		return Suggestion{}, fmt.Errorf("failed to encode suggestion: %w", err)
+	}
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO firearm_suggestions (firearm_id, changes, source, note, base_version, submitted_by)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		sg.FirearmID, string(changes), sg.Source, sg.Note, sg.BaseVersion, sg.SubmittedBy)
+	if err != nil {
+		return Suggestion{}, fmt.Errorf("failed to insert suggestion: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Suggestion{}, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return getSuggestion(ctx, db, int(id))
+}
+
+// decideSuggestion records the decision on a pending suggestion, returning
+// errSuggestionDecided when someone else decided it first
+func decideSuggestion(ctx context.Context, db dbtx, id int, status, actor, note string) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE firearm_suggestions SET status = ?, decided_by = ?, decision_note = ?, decided_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?`, status, actor, note, id, SuggestionPending)
+	if err != nil {
+		return fmt.Errorf("failed to record decision: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return errSuggestionDecided
+	}
+	return nil
+}
+
+// proposeChanges applies a suggestion's changes to a copy of the firearm and
+// returns the result along with the fields that would change
+func proposeChanges(current Firearm, changes FirearmInput) (Firearm, []FieldChange) {
+	proposed := current
+	changes.apply(&proposed)
+	return proposed, diffFirearms(&current, &proposed)
+}
+
+// SubmitSuggestion lets anyone propose {"changes", "source", "note"} for a
+// firearm. The changes use the same fields as PATCH /firearms/:id.
+func SubmitSuggestion(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := loadFirearm(c, db)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Changes FirearmInput `json:"changes"`
+			Source  string       `json:"source"`
+			Note    string       `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		source := strings.TrimSpace(req.Source)
+		if source == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "source cannot be empty, cite where the correction comes from"})
+			return
+		}
+
+		proposed, diff := proposeChanges(f, req.Changes)
+		if len(diff) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "changes must differ from the firearm's current values"})
+			return
+		}
+		if err := validateFirearm(proposed); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sg, err := insertSuggestion(c.Request.Context(), db, Suggestion{
+			FirearmID:   f.ID,
+			Changes:     req.Changes,
+			Source:      source,
+			Note:        strings.TrimSpace(req.Note),
+			BaseVersion: f.Version,
+			SubmittedBy: actorOf(c),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sg.Diff = diff
+		c.JSON(http.StatusCreated, sg)
+	}
+}
+
+// ListSuggestions is the moderation queue. It lists the suggestions with
+// ?status (pending by default), each compared with its firearm as it is now.
+func ListSuggestions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := c.DefaultQuery("status", SuggestionPending)
+		switch status {
+		case SuggestionPending, SuggestionApproved, SuggestionRejected:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("status must be %s, %s or %s", SuggestionPending, SuggestionApproved, SuggestionRejected)})
+			return
+		}
+
+		suggestions, err := listSuggestions(c.Request.Context(), db, status)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Deleted firearms are left without a diff, the suggestion can only be rejected
+		for i, sg := range suggestions {
+			current, err := getFirearm(c.Request.Context(), db, sg.FirearmID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+				return
+			}
+			_, suggestions[i].Diff = proposeChanges(current, sg.Changes)
+			suggestions[i].Stale = current.Version != sg.BaseVersion
+		}
+		c.JSON(http.StatusOK, suggestions)
+	}
+}
+
+// loadPendingSuggestion fetches the suggestion named by :id, responding with
+// 400, 404, 409 or 500 unless it exists and is still pending
+func loadPendingSuggestion(c *gin.Context, db dbtx) (Suggestion, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+		return Suggestion{}, false
+	}
+	sg, err := getSuggestion(c.Request.Context(), db, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no suggestion found with id: %d", id)})
+		return Suggestion{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+		return Suggestion{}, false
+	}
+	if sg.Status != SuggestionPending {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%v, it was %s", errSuggestionDecided, sg.Status)})
+		return Suggestion{}, false
+	}
+	return sg, true
+}
+
+// suggestionDecision is the optional body of an approve or reject. Force only
+// matters when approving.
+type suggestionDecision struct {
+	Note  string `json:"note"`
+	Force bool   `json:"force"`
+}
+
+// readDecision reads the optional body of an approve or reject
+func readDecision(c *gin.Context) (suggestionDecision, bool) {
+	var req suggestionDecision
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return req, false
+		}
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	return req, true
+}
+
+// ApproveSuggestion applies a pending suggestion to its firearm as a normal
+// revisioned write and marks it approved, both in one transaction. A stale
+// suggestion, made against an older version of the firearm, is only applied
+// when the moderator confirms it with If-Match for the current ETag or
+// {"force": true}, since it could undo whatever changed since.
+func ApproveSuggestion(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sg, ok := loadPendingSuggestion(c, db)
+		if !ok {
+			return
+		}
+		decision, ok := readDecision(c)
+		if !ok {
+			return
+		}
+
+		current, err := getFirearm(c.Request.Context(), db, sg.FirearmID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("firearm %d has been deleted, reject the suggestion instead", sg.FirearmID)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch != "" && !ifMatchMatches(ifMatch, current) {
+			c.Header("ETag", firearmValidators(current).ETag)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": errStaleETag.Error()})
+			return
+		}
+		if current.Version != sg.BaseVersion && ifMatch == "" && !decision.Force {
+			c.Header("ETag", firearmValidators(current).ETag)
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("firearm %d changed since the suggestion was made, check its diff and approve again with If-Match or {\"force\": true}", sg.FirearmID)})
+			return
+		}
+		proposed, _ := proposeChanges(current, sg.Changes)
+		if err := validateFirearm(proposed); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("suggestion no longer applies: %v", err)})
+			return
+		}
+
+		actor := actorOf(c)
+		var updated Firearm
+		err = inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			if err := decideSuggestion(c.Request.Context(), tx, sg.ID, SuggestionApproved, actor, decision.Note); err != nil {
+				return err
+			}
+			var err error
+			updated, err = saveFirearm(c.Request.Context(), tx, opts, actor, current, proposed)
+			return err
+		})
+		if err == errSuggestionDecided {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(writeStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		writeValidators(c, firearmValidators(updated))
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// RejectSuggestion marks a pending suggestion rejected without touching its firearm
+func RejectSuggestion(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sg, ok := loadPendingSuggestion(c, db)
+		if !ok {
+			return
+		}
+		decision, ok := readDecision(c)
+		if !ok {
+			return
+		}
+
+		if err := decideSuggestion(c.Request.Context(), db, sg.ID, SuggestionRejected, actorOf(c), decision.Note); err != nil {
+			status := http.StatusInternalServerError
+			if err == errSuggestionDecided {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSuggestions(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	_, writeSecret, err := createAPIKey(t.Context(), db, "moderator", []string{ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)))
+	r.POST("/firearms/:id/suggestions", SubmitSuggestion(db))
+	suggestions := r.Group("/suggestions", RequireScope(ScopeWrite))
+	suggestions.GET("", ListSuggestions(db))
+	suggestions.POST("/:id/approve", ApproveSuggestion(db, testWrites))
+	suggestions.POST("/:id/reject", RejectSuggestion(db))
+
+	submit := func(body string) Suggestion {
+		t.Helper()
+		w := doRequest(r, http.MethodPost, "/firearms/1/suggestions", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("submit got %d: %s", w.Code, w.Body)
+		}
+		var sg Suggestion
+		if err := json.Unmarshal(w.Body.Bytes(), &sg); err != nil {
+			t.Fatal(err)
+		}
+		return sg
+	}
+
+	for _, body := range []string{
+		`{"changes": {"year": 1983}}`,
+		`{"changes": {"year": 1982}, "source": "catalog"}`,
+		`{"changes": {"year": -1}, "source": "catalog"}`,
+	} {
+		if w := doRequest(r, http.MethodPost, "/firearms/1/suggestions", body); w.Code != http.StatusBadRequest {
+			t.Errorf("submitting %s got %d, want 400", body, w.Code)
+		}
+	}
+
+	// Anonymous visitors submit, the queue needs a write key
+	first := submit(`{"changes": {"year": 1983}, "source": "Glock factory catalog, 1984", "note": "off by one"}`)
+	if first.SubmittedBy != "anonymous" || first.Status != SuggestionPending || first.BaseVersion != f.Version {
+		t.Errorf("submitted suggestion = %+v", first)
+	}
+	second := submit(`{"changes": {"price": 600}, "source": "dealer price list"}`)
+	third := submit(`{"changes": {"name": "17 Gen4"}, "source": "Glock factory catalog, 2010"}`)
+	fourth := submit(`{"changes": {"effective_range": 55}, "source": "owner's manual"}`)
+	if w := doRequest(r, http.MethodGet, "/suggestions", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous queue got %d, want 401", w.Code)
+	}
+
+	w := doRequest(r, http.MethodGet, "/suggestions", "", "X-API-Key", writeSecret)
+	var queue []Suggestion
+	if err := json.Unmarshal(w.Body.Bytes(), &queue); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if len(queue) != 4 || len(queue[0].Diff) != 1 || queue[0].Diff[0].Field != "year" || queue[0].Stale {
+		t.Fatalf("queue = %+v", queue)
+	}
+
+	w = doRequest(r, http.MethodPost, fmt.Sprintf("/suggestions/%d/approve", first.ID), `{"note": "checked"}`, "X-API-Key", writeSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve got %d: %s", w.Code, w.Body)
+	}
+	if updated := mustFirearm(t, db, f.ID); updated.Year != 1983 || updated.Version != f.Version+1 {
+		t.Errorf("approved firearm = %+v", updated)
+	}
+	revisions, err := listRevisions(t.Context(), db, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Actor != "key:1:moderator" {
+		t.Errorf("approval revisions = %+v", revisions)
+	}
+	decided, err := getSuggestion(t.Context(), db, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decided.Status != SuggestionApproved || decided.DecidedBy == nil || *decided.DecisionNote != "checked" {
+		t.Errorf("approved suggestion = %+v", decided)
+	}
+	if w := doRequest(r, http.MethodPost, fmt.Sprintf("/suggestions/%d/reject", first.ID), "", "X-API-Key", writeSecret); w.Code != http.StatusConflict {
+		t.Errorf("rejecting an approved suggestion got %d, want 409", w.Code)
+	}
+
+	// The other suggestions were made against the old version
+	w = doRequest(r, http.MethodGet, "/suggestions", "", "X-API-Key", writeSecret)
+	queue = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 3 || queue[0].ID != second.ID || !queue[0].Stale {
+		t.Errorf("queue after approval = %+v", queue)
+	}
+
+	if w := doRequest(r, http.MethodPost, fmt.Sprintf("/suggestions/%d/reject", second.ID), "", "X-API-Key", writeSecret); w.Code != http.StatusNoContent {
+		t.Fatalf("reject got %d: %s", w.Code, w.Body)
+	}
+	if price := mustFirearm(t, db, f.ID).Price; price != 550 {
+		t.Errorf("rejected suggestion changed price to %d", price)
+	}
+	if w := doRequest(r, http.MethodGet, "/suggestions?status=rejected", "", "X-API-Key", writeSecret); w.Code != http.StatusOK {
+		t.Errorf("rejected queue got %d", w.Code)
+	}
+
+	// A stale suggestion could undo what changed since, so approving one needs
+	// the current ETag or an explicit force
+	approveThird := fmt.Sprintf("/suggestions/%d/approve", third.ID)
+	w = doRequest(r, http.MethodPost, approveThird, "", "X-API-Key", writeSecret)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("approving a stale suggestion got %d, want 409", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if w := doRequest(r, http.MethodPost, approveThird, "", "X-API-Key", writeSecret, "If-Match", `"1-0"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("approving a stale suggestion with an old ETag got %d, want 412", w.Code)
+	}
+	if w := doRequest(r, http.MethodPost, approveThird, "", "X-API-Key", writeSecret, "If-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("approving a stale suggestion with the current ETag got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodPost, fmt.Sprintf("/suggestions/%d/approve", fourth.ID), `{"force": true}`, "X-API-Key", writeSecret); w.Code != http.StatusOK {
+		t.Errorf("forcing a stale suggestion got %d: %s", w.Code, w.Body)
+	}
+	if updated := mustFirearm(t, db, f.ID); updated.Name != "17 Gen4" || updated.EffectiveRange != 55 || updated.Year != 1983 {
+		t.Errorf("firearm after the stale approvals = %+v", updated)
+	}
+}
+
+func mustFirearm(t *testing.T, db dbtx, id int) Firearm {
+	t.Helper()
+	f, err := getFirearm(t.Context(), db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// syncPageSize is how many changes one sync response covers at most
+const syncPageSize = 1000
+
+// syncTokenPrefix versions the change token format
+const syncTokenPrefix = "v1:"
+
+// errInvalidSyncToken is returned for change tokens this server didn't hand out
+var errInvalidSyncToken = errors.New("invalid sync token, start over without since")
+
+// Tombstone marks a firearm a replica should delete
+type Tombstone struct {
+	ID        int    `json:"id"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+// SyncResponse is what a replica applies to catch up. Records are in their
+// state as of Token, which the replica sends back as ?since next time; when
+// HasMore is set it should do so straight away.
+type SyncResponse struct {
+	Created []Firearm   `json:"created"`
+	Updated []Firearm   `json:"updated"`
+	Deleted []Tombstone `json:"deleted"`
+	Token   string      `json:"token"`
+	HasMore bool        `json:"has_more"`
+}
+
+// syncToken encodes a changelog position as an opaque change token
+func syncToken(changeID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(syncTokenPrefix + strconv.Itoa(changeID)))
+}
+
+// parseSyncToken decodes a change token back into its changelog position
+func parseSyncToken(token string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidSyncToken
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(raw), syncTokenPrefix))
+	if err != nil || !strings.HasPrefix(string(raw), syncTokenPrefix) || id < 0 {
+		return 0, errInvalidSyncToken
+	}
+	return id, nil
+}
+
+// syncSnapshot returns every live firearm as created, along with the token of
+// the latest change they include
+func syncSnapshot(ctx context.Context, tx dbtx) (SyncResponse, error) {
+	latest, err := latestChange(ctx, tx)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+	firearms, err := queryFirearms(ctx, tx, firearmsWhere(false, ""))
+	if err != nil {
+		return SyncResponse{}, err
+	}
+	return SyncResponse{Created: firearms, Updated: []Firearm{}, Deleted: []Tombstone{}, Token: syncToken(latest)}, nil
+}
+
+// syncChanges folds the changes after since into the net change of every
+// firearm they touched. A firearm that didn't exist before the first of its
+// changes was created, one that doesn't exist after the last was deleted, and
+// one created and deleted in between is left out.
+func syncChanges(ctx context.Context, tx dbtx, since int) (SyncResponse, error) {
+	latest, err := latestChange(ctx, tx)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+	if since > latest {
+		return SyncResponse{}, errInvalidSyncToken
+	}
+	events, err := listChangesSince(ctx, tx, since, syncPageSize)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+
+	type netChange struct {
+		existed bool
+		last    ChangeEvent
+	}
+	var order []int
+	changes := make(map[int]*netChange)
+	for _, ev := range events {
+		ch, ok := changes[ev.FirearmID]
+		if !ok {
+			ch = &netChange{existed: ev.Before != nil}
+			changes[ev.FirearmID] = ch
+			order = append(order, ev.FirearmID)
+		}
+		ch.last = ev
+	}
+
+	resp := SyncResponse{Created: []Firearm{}, Updated: []Firearm{}, Deleted: []Tombstone{}, Token: syncToken(since)}
+	for _, id := range order {
+		ch := changes[id]
+		switch exists := ch.last.After != nil; {
+		case exists && ch.existed:
+			resp.Updated = append(resp.Updated, *ch.last.After)
+		case exists:
+			resp.Created = append(resp.Created, *ch.last.After)
+		case ch.existed:
+			resp.Deleted = append(resp.Deleted, Tombstone{ID: id, DeletedAt: ch.last.OccurredAt})
+		}
+	}
+	if len(events) > 0 {
+		last := events[len(events)-1].ID
+		resp.Token, resp.HasMore = syncToken(last), last < latest
+	}
+	return resp, nil
+}
+
+// SyncFirearms lets a client keep an exact local replica of the catalog.
+// Without ?since it returns the whole catalog as created; with the token of a
+// previous response it returns only what was created, updated or deleted
+// since, plus the token to use next.
+func SyncFirearms(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		since, full := 0, true
+		if token := c.Query("since"); token != "" {
+			var err error
+			if since, err = parseSyncToken(token); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			full = false
+		}
+
+		// Reading in one transaction keeps the records and the token consistent
+		var resp SyncResponse
+		err := inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			var err error
+			if full {
+				resp, err = syncSnapshot(c.Request.Context(), tx)
+			} else {
+				resp, err = syncChanges(c.Request.Context(), tx, since)
+			}
+			return err
+		})
+		if err == errInvalidSyncToken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to sync: %v", err)})
+			return
+		}
+		setResultCount(c, len(resp.Created)+len(resp.Updated)+len(resp.Deleted))
+		c.JSON(http.StatusOK, resp)
+	}
+}
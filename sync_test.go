@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSyncFirearms(t *testing.T) {
+	db := newTestDB(t)
+	// Added without a revision, like firearms from before the changelog existed
+	glock := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+
+	r := gin.New()
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+	r.PATCH("/firearms/:id", UpdateFirearm(db, testWrites))
+	r.DELETE("/firearms/:id", DeleteFirearm(db, testWrites))
+	r.GET("/all", GetAllFirearms(db))
+	r.GET("/sync", SyncFirearms(db))
+
+	// The replica applies every response the way a client would
+	replica := map[int]Firearm{}
+	sync := func(token string) SyncResponse {
+		t.Helper()
+		target := "/sync"
+		if token != "" {
+			target += "?since=" + token
+		}
+		w := doRequest(r, http.MethodGet, target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("sync got %d: %s", w.Code, w.Body)
+		}
+		var resp SyncResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range slices.Concat(resp.Created, resp.Updated) {
+			replica[f.ID] = f
+		}
+		for _, ts := range resp.Deleted {
+			delete(replica, ts.ID)
+		}
+		return resp
+	}
+	create := func(name string) Firearm {
+		t.Helper()
+		w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Colt", "name": "`+name+`", "caliber": ".45 ACP", "type": "pistol",
+			"magazine_capacity": 7, "effective_range": 50, "year": 1911, "price": 900}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create got %d: %s", w.Code, w.Body)
+		}
+		var f Firearm
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	checkReplica := func() {
+		t.Helper()
+		var all []Firearm
+		if err := json.Unmarshal(doRequest(r, http.MethodGet, "/all", "").Body.Bytes(), &all); err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != len(replica) {
+			t.Fatalf("replica has %d firearms, the catalog %d", len(replica), len(all))
+		}
+		for _, f := range all {
+			if replica[f.ID] != f {
+				t.Errorf("replica has %+v, the catalog %+v", replica[f.ID], f)
+			}
+		}
+	}
+
+	first := sync("")
+	if len(first.Created) != 1 || first.HasMore {
+		t.Fatalf("initial sync = %+v", first)
+	}
+	checkReplica()
+
+	m1911 := create("M1911")
+	w := doRequest(r, http.MethodPatch, "/firearms/1", `{"price": 600}`, "If-Match", firearmValidators(glock).ETag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch got %d: %s", w.Code, w.Body)
+	}
+	// Created and deleted between two syncs, so the replica never hears of it
+	python := create("Python")
+	if w := doRequest(r, http.MethodDelete, "/firearms/3", "", "If-Match", firearmValidators(python).ETag); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+
+	second := sync(first.Token)
+	if len(second.Created) != 1 || second.Created[0].ID != m1911.ID || len(second.Updated) != 1 || second.Updated[0].Price != 600 || len(second.Deleted) != 0 {
+		t.Fatalf("second sync = %+v", second)
+	}
+	checkReplica()
+
+	if w := doRequest(r, http.MethodDelete, "/firearms/2", "", "If-Match", "*"); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+	third := sync(second.Token)
+	if len(third.Deleted) != 1 || third.Deleted[0].ID != m1911.ID || len(third.Created)+len(third.Updated) != 0 {
+		t.Fatalf("third sync = %+v", third)
+	}
+	checkReplica()
+
+	// Nothing changed, so the token stays put
+	if again := sync(third.Token); again.Token != third.Token || len(again.Deleted) != 0 {
+		t.Errorf("sync without changes = %+v", again)
+	}
+
+	for _, token := range []string{"garbage!", syncToken(99), "djI6MQ"} {
+		if w := doRequest(r, http.MethodGet, "/sync?since="+token, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("sync since %q got %d, want 400", token, w.Code)
+		}
+	}
+}
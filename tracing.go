@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tracer returns the tracer every span of the server is started with. It comes
+// from the global provider, so it is a no-op until initTracing sets one up.
+func tracer() trace.Tracer {
+	return otel.Tracer("gundatabase")
+}
+
+// initTracing sets up the span exporter picked by tracing.exporter:
+// "otlp" sends spans to the collector at OTEL_EXPORTER_OTLP_ENDPOINT, over
+// gRPC when OTEL_EXPORTER_OTLP_PROTOCOL is "grpc" and HTTP otherwise, and
+// "stdout" prints them for local debugging. Tracing stays off with "none".
+// W3C trace context is propagated either way. The returned function flushes
+// any spans not yet exported.
+func initTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		if os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL") == "grpc" {
+			exporter, err = otlptracegrpc.New(ctx)
+		} else {
+			exporter, err = otlptracehttp.New(ctx)
+		}
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want otlp, stdout or none", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("gundatabase")),
+		resource.WithFromEnv(), resource.WithTelemetrySDK(), resource.WithHost())
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startQuerySpan starts the span of a statement, named after its operation,
+// under the span of the request that runs it. Queries outside a traced request
+// aren't traced, so background polling doesn't bury the traces that matter.
+// The statement is recorded as written, so parameters never end up in it.
+func startQuerySpan(ctx context.Context, query string) trace.Span {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return trace.SpanFromContext(context.Background())
+	}
+	op, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	op = strings.ToUpper(strings.TrimSpace(op))
+	_, span := tracer().Start(ctx, "sqlite "+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemSqlite, semconv.DBOperation(op), semconv.DBStatement(strings.TrimSpace(query))))
+	return span
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Tracing starts a server span for every request, continuing the trace of a
+// W3C traceparent header when one is sent. Spans are named after the route
+// template, like the metrics, and the queries the request runs become its
+// children.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(c.Request.URL.Path),
+			semconv.ClientAddress(c.ClientIP()),
+		))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		if errs := c.Errors.String(); errs != "" {
+			span.SetAttributes(attribute.String("error.message", errs))
+		}
+	}
+}
+
+// renderJSON writes a JSON response in its own span, so serializing a large
+// list shows up apart from the queries that built it
+func renderJSON(c *gin.Context, code int, body any) {
+	_, span := tracer().Start(c.Request.Context(), "render JSON")
+	defer span.End()
+	c.JSON(code, body)
+	span.SetAttributes(attribute.Int("http.response.body.size", c.Writer.Size()))
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	if v := metadata.MD(mc).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (mc metadataCarrier) Set(key, value string) { metadata.MD(mc).Set(key, value) }
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for k := range mc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startRPCSpan starts the server span of a gRPC call, continuing the trace in
+// its metadata, and labels the queries of the call with its method
+func startRPCSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	ctx = withQueryHandler(ctx, "grpc."+method)
+	return tracer().Start(ctx, strings.TrimPrefix(fullMethod, "/"), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(method)))
+}
+
+// endRPCSpan records the status code of a gRPC call and ends its span
+func endRPCSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if code != grpccodes.OK {
+		span.SetStatus(codes.Error, status.Convert(err).Message())
+	}
+	span.End()
+}
+
+// traceUnary traces unary gRPC calls like Tracing does HTTP requests
+func traceUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	ctx, span := startRPCSpan(ctx, info.FullMethod)
+	defer func() { endRPCSpan(span, err) }()
+	return handler(ctx, req)
+}
+
+// tracedStream hands a streaming call's handler a context of its own
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s tracedStream) Context() context.Context { return s.ctx }
+
+// traceStream traces streaming gRPC calls like Tracing does HTTP requests
+func traceStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span := startRPCSpan(ss.Context(), info.FullMethod)
+	defer func() { endRPCSpan(span, err) }()
+	return handler(srv, tracedStream{ss, ctx})
+}
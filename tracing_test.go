@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gundatabase/catalogpb"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// recordSpans installs a tracer provider that keeps every span ended until the test is over
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return rec
+}
+
+// spanAttr returns the value of a span attribute, nil when it isn't set
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) any {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	rec := recordSpans(t)
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Glock", "19", 1988, 560)
+	r := gin.New()
+	r.Use(Tracing())
+	r.GET("/brand/:brand", GetFirearmsByBrand(db))
+
+	if w := doRequest(r, http.MethodGet, "/brand/glock", "", "traceparent", testTraceparent); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	spans := rec.Ended()
+	var server sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "GET /brand/:brand" {
+			server = span
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span in %d spans", len(spans))
+	}
+	if server.SpanContext().TraceID().String() != testTraceID || server.Parent().SpanID().String() != "00f067aa0ba902b7" ||
+		spanAttr(server, "http.route") != "/brand/:brand" || spanAttr(server, "http.response.status_code") != int64(200) {
+		t.Errorf("server span continues %v with %v", server.Parent(), server.Attributes())
+	}
+
+	// The query and the rendering are children of the request's span
+	var queried, rendered bool
+	for _, span := range spans {
+		if span == server {
+			continue
+		}
+		if span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("%s isn't a child of the request", span.Name())
+		}
+		switch span.Name() {
+		case "sqlite SELECT":
+			stmt, _ := spanAttr(span, "db.statement").(string)
+			if strings.Contains(stmt, "Glock") || spanAttr(span, "db.rows_returned") != int64(2) {
+				t.Errorf("query span has %v", span.Attributes())
+			}
+			queried = true
+		case "render JSON":
+			rendered = true
+		}
+	}
+	if !queried || !rendered {
+		t.Errorf("got spans %v, want the query and the rendering", spans)
+	}
+
+	// Queries outside a request aren't traced
+	if _, err := db.Exec("UPDATE firearms SET price = price"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rec.Ended()); n != len(spans) {
+		t.Errorf("background query got %d spans", n-len(spans))
+	}
+}
+
+func TestTracingGRPC(t *testing.T) {
+	rec := recordSpans(t)
+	db := newTestDB(t)
+	addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	client := newCatalogClient(t, db)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", testTraceparent)
+	if _, err := client.GetFirearm(ctx, &catalogpb.GetFirearmRequest{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var server sdktrace.ReadOnlySpan
+	for _, span := range rec.Ended() {
+		if span.Name() == "catalog.v1.FirearmCatalog/GetFirearm" {
+			server = span
+		}
+	}
+	if server == nil || server.SpanContext().TraceID().String() != testTraceID || spanAttr(server, "rpc.grpc.status_code") != int64(0) {
+		t.Fatalf("server span = %v", server)
+	}
+	for _, span := range rec.Ended() {
+		if span != server && span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("%s isn't a child of the call", span.Name())
+		}
+	}
+}
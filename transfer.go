@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// exportFormats are the file formats export writes and import reads
+var exportFormats = []string{"json", "csv"}
+
+// csvColumns is the header of a CSV export. Import reads any subset of them
+// in any order, ignoring the read-only ones.
+var csvColumns = []string{
+	"id", "brand", "name", "caliber", "type", "magazine_capacity", "effective_range",
+	"year", "price", "manufacturer", "weight", "barrel_length", "action", "country_of_origin",
+	"created_at", "updated_at",
+}
+
+// readOnlyColumns are exported for reference but never imported
+var readOnlyColumns = []string{"id", "created_at", "updated_at", "version", "deleted_at"}
+
+// errDryRun rolls back an import made with -dry-run once it has been checked
+var errDryRun = errors.New("dry run")
+
+// writeFirearms writes firearms to out as a JSON array, the same as the API
+// returns them, or as CSV with a csvColumns header
+func writeFirearms(out io.Writer, format string, firearms []Firearm) error {
+	if format == "json" {
+		if firearms == nil {
+			firearms = []Firearm{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(firearms)
+	}
+
+	w := csv.NewWriter(out)
+	w.Write(csvColumns)
+	for _, f := range firearms {
+		w.Write([]string{
+			strconv.Itoa(f.ID), f.Brand, f.Name, f.Caliber, f.Type, strconv.Itoa(f.MagazineCapacity),
+			strconv.Itoa(f.EffectiveRange), strconv.Itoa(f.Year), strconv.Itoa(f.Price), f.Manufacturer,
+			strconv.FormatFloat(f.Weight, 'f', -1, 64), strconv.FormatFloat(f.BarrelLength, 'f', -1, 64),
+			f.Action, f.CountryOfOrigin, f.CreatedAt, f.UpdatedAt,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// runExportCommand writes the live firearms matching the filter flags in
+// the given format, to stdout or the -o file
+func runExportCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 || !slices.Contains(exportFormats, args[0]) {
+		return fmt.Errorf("usage: export %s [-o file] [filters]", strings.Join(exportFormats, "|"))
+	}
+	format := args[0]
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(out)
+	output := fs.String("o", "", "file to write instead of stdout")
+	filter := filterFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	cond, condArgs := filter.where()
+	firearms, err := queryFirearms(context.Background(), db, firearmsWhere(false, cond)+" ORDER BY id", condArgs...)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return writeFirearms(out, format, firearms)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create export: %w", err)
+	}
+	if err := writeFirearms(f, format, firearms); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	fmt.Fprintf(out, "exported %d firearms to %s\n", len(firearms), *output)
+	return nil
+}
+
+// importRecord is a firearm in a JSON import. The read-only fields of an
+// export are accepted so exports can be imported as they are, but ignored.
+type importRecord struct {
+	FirearmInput
+	ID        any `json:"id"`
+	CreatedAt any `json:"created_at"`
+	UpdatedAt any `json:"updated_at"`
+	Version   any `json:"version"`
+	DeletedAt any `json:"deleted_at"`
+}
+
+// readImportFile reads the firearms in a JSON or CSV file, picked by its
+// extension unless format is given
+func readImportFile(path, format string) ([]FirearmInput, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	if !slices.Contains(exportFormats, format) {
+		return nil, fmt.Errorf("cannot tell the format of %s, pass -format %s", path, strings.Join(exportFormats, "|"))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import: %w", err)
+	}
+	defer f.Close()
+
+	if format == "csv" {
+		return readCSVFirearms(f)
+	}
+	var records []importRecord
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&records); err != nil {
+		return nil, fmt.Errorf("invalid JSON import: %w", err)
+	}
+	inputs := make([]FirearmInput, len(records))
+	for i, r := range records {
+		inputs[i] = r.FirearmInput
+	}
+	return inputs, nil
+}
+
+// readCSVFirearms reads firearms from CSV with a header row naming the
+// columns. Empty cells are left out, like fields missing from JSON.
+func readCSVFirearms(r io.Reader) ([]FirearmInput, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV import: %w", err)
+	}
+
+	var inputs []FirearmInput
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return inputs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV import: %w", err)
+		}
+		var in FirearmInput
+		for i, cell := range row {
+			if err := in.setColumn(strings.TrimSpace(header[i]), cell); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		inputs = append(inputs, in)
+	}
+}
+
+// setColumn sets the field with the given JSON name from a CSV cell
+func (in *FirearmInput) setColumn(column, cell string) error {
+	if slices.Contains(readOnlyColumns, column) {
+		return nil
+	}
+	v := reflect.ValueOf(in).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if jsonName(v.Type().Field(i)) != column {
+			continue
+		}
+		if cell == "" {
+			return nil
+		}
+		ptr := reflect.New(v.Type().Field(i).Type.Elem())
+		switch ptr.Elem().Kind() {
+		case reflect.String:
+			ptr.Elem().SetString(cell)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(cell))
+			if err != nil {
+				return fmt.Errorf("%s must be a whole number", column)
+			}
+			ptr.Elem().SetInt(int64(n))
+		case reflect.Float64:
+			x, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", column)
+			}
+			ptr.Elem().SetFloat(x)
+		}
+		v.Field(i).Set(ptr)
+		return nil
+	}
+	return fmt.Errorf("unknown column %q", column)
+}
+
+// importResult counts what an import did with its records
+type importResult struct {
+	Created, Updated, Unchanged, Skipped int
+}
+
+// importFirearms adds the records as new firearms in one transaction,
+// recording a revision for each so the history, /sync and webhooks see them.
+// Records whose brand and name already exist are skipped, or with update
+// patched onto the firearm. Any invalid record fails the whole import.
+func importFirearms(ctx context.Context, db *sql.DB, opts WriteOptions, records []FirearmInput, update, dryRun bool) (importResult, error) {
+	var res importResult
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		for i, in := range records {
+			if err := importFirearm(ctx, tx, opts, in, update, &res); err != nil {
+				return fmt.Errorf("record %d: %w", i+1, err)
+			}
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		err = nil
+	}
+	return res, err
+}
+
+// importFirearm writes a single import record and counts the outcome in res
+func importFirearm(ctx context.Context, tx *sql.Tx, opts WriteOptions, in FirearmInput, update bool, res *importResult) error {
+	if in.Brand == nil || in.Name == nil {
+		return errors.New("brand and name are required")
+	}
+	before, err := getFirearmByBrandName(ctx, tx, strings.TrimSpace(*in.Brand), strings.TrimSpace(*in.Name))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err := in.requireAll(); err != nil {
+			return err
+		}
+		var f Firearm
+		in.apply(&f)
+		if err := validateFirearm(f); err != nil {
+			return err
+		}
+		id, err := insertFirearm(ctx, tx, f)
+		if err != nil {
+			return err
+		}
+		created, err := getFirearm(ctx, tx, id)
+		if err != nil {
+			return fmt.Errorf("failed to query database: %w", err)
+		}
+		res.Created++
+		return recordRevision(ctx, tx, opts, cliActor, RevisionCreate, nil, &created)
+	case err != nil:
+		return fmt.Errorf("failed to query database: %w", err)
+	case !update:
+		res.Skipped++
+		return nil
+	case before.DeletedAt != nil:
+		return fmt.Errorf("%s %s is deleted, restore it before updating it", before.Brand, before.Name)
+	}
+
+	f := before
+	in.apply(&f)
+	if err := validateFirearm(f); err != nil {
+		return err
+	}
+	if len(diffFirearms(&before, &f)) == 0 {
+		res.Unchanged++
+		return nil
+	}
+	if _, err := saveFirearm(ctx, tx, opts, cliActor, before, f); err != nil {
+		return err
+	}
+	res.Updated++
+	return nil
+}
+
+// runImportCommand adds the firearms in a JSON or CSV file, in the formats
+// export writes
+func runImportCommand(db *sql.DB, opts WriteOptions, args []string, out io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: import <file> [-format json|csv] [-update] [-dry-run]")
+	}
+	path := args[0]
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(out)
+	format := fs.String("format", "", "json or csv, by default taken from the file extension")
+	update := fs.Bool("update", false, "update firearms that already exist instead of skipping them")
+	dryRun := fs.Bool("dry-run", false, "check the file and report what would change without writing")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	records, err := readImportFile(path, *format)
+	if err != nil {
+		return err
+	}
+	res, err := importFirearms(context.Background(), db, opts, records, *update, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(out, "%s %d firearms: %d created, %d updated, %d unchanged, %d skipped as existing\n",
+		verb, len(records), res.Created, res.Updated, res.Unchanged, res.Skipped)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usersUsage = `usage:
+  users create -username <name> -password <password> -role viewer|contributor|editor|admin
+  users list
+  users role <id> <role>
+  users password <id> <password>
+  users disable <id>
+  users enable <id>`
+
+// runUsersCommand manages user accounts from the command line, writing results to
+// out. It is how the first admin account gets created.
+func runUsersCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usersUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("users create", flag.ContinueOnError)
+		fs.SetOutput(out)
+		username := fs.String("username", "", "login name")
+		password := fs.String("password", "", fmt.Sprintf("password, at least %d characters", minPasswordLength))
+		role := fs.String("role", RoleViewer, "one of "+strings.Join(roleOrder, ", "))
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if strings.TrimSpace(*username) == "" {
+			return errors.New("-username is required")
+		}
+		u, err := createUser(context.Background(), db, strings.TrimSpace(*username), *password, *role)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created user %d (%s) with role %s\n", u.ID, u.Username, u.Role)
+
+	case "list":
+		users, err := listUsers(context.Background(), db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tROLE\tCREATED\tSTATUS")
+		for _, u := range users {
+			status := "active"
+			if u.DisabledAt != nil {
+				status = "disabled " + *u.DisabledAt
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Role, u.CreatedAt, status)
+		}
+		return tw.Flush()
+
+	case "role", "password", "disable", "enable":
+		want := 2
+		if args[0] == "role" || args[0] == "password" {
+			want = 3
+		}
+		if len(args) != want {
+			return errors.New(usersUsage)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("id must be a valid integer: %q", args[1])
+		}
+
+		var upd UserUpdate
+		switch args[0] {
+		case "role":
+			upd.Role = &args[2]
+		case "password":
+			upd.Password = &args[2]
+		default:
+			disabled := args[0] == "disable"
+			upd.Disabled = &disabled
+		}
+		u, err := updateUser(context.Background(), db, id, upd)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "updated user %d (%s)\n", u.ID, u.Username)
+
+	default:
+		return fmt.Errorf("unknown users command %q\n%s", args[0], usersUsage)
+	}
+	return nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userKey = "user"
+
+// Roles a user account can have, from least to most privileged. Each role can
+// do everything the roles before it can.
+const (
+	RoleViewer      = "viewer"
+	RoleContributor = "contributor"
+	RoleEditor      = "editor"
+	RoleAdmin       = "admin"
+)
+
+// roleOrder ranks the roles from least to most privileged
+var roleOrder = []string{RoleViewer, RoleContributor, RoleEditor, RoleAdmin}
+
+// roleScopes maps each role to the API key scope it is equivalent to, so routes
+// guarded by RequireScope accept both keys and user sessions. Contributors
+// read like viewers, RequireRoleOrScope lets them at sources and citations.
+var roleScopes = map[string]string{
+	RoleViewer:      ScopeRead,
+	RoleContributor: ScopeRead,
+	RoleEditor:      ScopeWrite,
+	RoleAdmin:       ScopeAdmin,
+}
+
+// minPasswordLength is the shortest password an account may have
+const minPasswordLength = 8
+
+// bcryptCost is the work factor for password hashes, lowered by tests
+var bcryptCost = bcrypt.DefaultCost
+
+var (
+	// errInvalidLogin is returned for an unknown user, a wrong password or a disabled account
+	errInvalidLogin = errors.New("invalid username or password")
+	// errInvalidRefreshToken is returned for refresh tokens that are unknown, used, revoked or expired
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// errUserNotFound is returned when managing a user that doesn't exist
+	errUserNotFound = errors.New("user not found")
+	// errDuplicateUser is returned when a username is already taken
+	errDuplicateUser = errors.New("a user with this username already exists")
+)
+
+// userInputError reports an invalid role or password
+type userInputError string
+
+func (e userInputError) Error() string { return string(e) }
+
+// dummyPasswordHash is compared against when a login names an unknown user, so
+// those take as long as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcryptCost)
+	return hash
+})
+
+// User is an account as returned by the API, without its password hash
+type User struct {
+	ID         int     `json:"id"`
+	Username   string  `json:"username"`
+	Role       string  `json:"role"`
+	CreatedAt  string  `json:"created_at"`
+	UpdatedAt  string  `json:"updated_at"`
+	DisabledAt *string `json:"disabled_at"`
+}
+
+// roleAtLeast reports whether role is at least as privileged as min
+func roleAtLeast(role, min string) bool {
+	want := slices.Index(roleOrder, min)
+	return want >= 0 && slices.Index(roleOrder, role) >= want
+}
+
+// validateRole checks role is one of roleOrder
+func validateRole(role string) error {
+	if !slices.Contains(roleOrder, role) {
+		return userInputError(fmt.Sprintf("unknown role %q, expected one of %s", role, strings.Join(roleOrder, ", ")))
+	}
+	return nil
+}
+
+// hashPassword checks a password's length and returns its bcrypt hash
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", userInputError(fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// userColumns lists the users columns in the order scanUser expects them
+const userColumns = "id, username, role, created_at, updated_at, disabled_at"
+
+// scanUser reads a single user selected with userColumns
+func scanUser(s rowScanner) (User, error) {
+	var u User
+	err := s.Scan(&u.ID, &u.Username, &u.Role, &u.CreatedAt, &u.UpdatedAt, &u.DisabledAt)
+	return u, err
+}
+
+// getUser loads a user by ID, returning errUserNotFound when it doesn't exist
+func getUser(ctx context.Context, db dbtx, id int) (User, error) {
+	u, err := scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to query user: %w", err)
+	}
+	return u, nil
+}
+
+// createUser stores a new account with a hashed password
+func createUser(ctx context.Context, db dbtx, username, password, role string) (User, error) {
+	if err := validateRole(role); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	res, err := db.ExecContext(ctx, "INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)", username, hash, role)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errDuplicateUser
+		}
+		return User{}, fmt.Errorf("failed to insert user: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return getUser(ctx, db, int(id))
+}
+
+// listUsers returns every account, disabled ones included
+func listUsers(ctx context.Context, db dbtx) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return users, nil
+}
+
+// UserUpdate is the body of PATCH /admin/users/:id. Fields left out keep their current value.
+type UserUpdate struct {
+	Role     *string `json:"role"`
+	Password *string `json:"password"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// updateUser applies an update to an account. Changing the password or
+// disabling the account also ends all of its sessions.
+func updateUser(ctx context.Context, db *sql.DB, id int, upd UserUpdate) (User, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := getUser(ctx, tx, id); err != nil {
+		return User{}, err
+	}
+
+	var sets []string
+	var args []any
+	if upd.Role != nil {
+		if err := validateRole(*upd.Role); err != nil {
+			return User{}, err
+		}
+		sets, args = append(sets, "role = ?"), append(args, *upd.Role)
+	}
+	if upd.Password != nil {
+		hash, err := hashPassword(*upd.Password)
+		if err != nil {
+			return User{}, err
+		}
+		sets, args = append(sets, "password_hash = ?"), append(args, hash)
+	}
+	if upd.Disabled != nil {
+		if *upd.Disabled {
+			sets = append(sets, "disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP)")
+		} else {
+			sets = append(sets, "disabled_at = NULL")
+		}
+	}
+	if len(sets) > 0 {
+		sets = append(sets, "updated_at = CURRENT_TIMESTAMP")
+		args = append(args, id)
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+			return User{}, fmt.Errorf("failed to update user: %w", err)
+		}
+	}
+	if upd.Password != nil || (upd.Disabled != nil && *upd.Disabled) {
+		if err := revokeUserSessions(ctx, tx, id); err != nil {
+			return User{}, err
+		}
+	}
+
+	u, err := getUser(ctx, tx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, fmt.Errorf("failed to commit user update: %w", err)
+	}
+	return u, nil
+}
+
+// checkLogin returns the active account matching a username and password
+func checkLogin(ctx context.Context, db dbtx, username, password string) (User, error) {
+	var hash string
+	var disabled *string
+	var id int
+	err := db.QueryRowContext(ctx, "SELECT id, password_hash, disabled_at FROM users WHERE username = ?", username).Scan(&id, &hash, &disabled)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return User{}, errInvalidLogin
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to query user: %w", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || disabled != nil {
+		return User{}, errInvalidLogin
+	}
+	return getUser(ctx, db, id)
+}
+
+// createRefreshToken stores a new refresh token for the user and returns its secret
+func createRefreshToken(ctx context.Context, db dbtx, userID int, expires time.Time) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	secret := "rt_" + hex.EncodeToString(b)
+	if _, err := db.ExecContext(ctx, "INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashAPIKey(secret), expires.Unix()); err != nil {
+		return "", fmt.Errorf("failed to insert refresh token: %w", err)
+	}
+	return secret, nil
+}
+
+// useRefreshToken revokes a refresh token and returns the active account it
+// belongs to. Presenting a token that was already used ends every session of
+// its user, since one of the two holders must have stolen it.
+func useRefreshToken(ctx context.Context, db *sql.DB, secret string, now time.Time) (User, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var expiresAt int64
+	var revoked *string
+	err = tx.QueryRowContext(ctx, "SELECT id, user_id, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = ?",
+		hashAPIKey(secret)).Scan(&id, &userID, &expiresAt, &revoked)
+	if err == sql.ErrNoRows {
+		return User{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to query refresh token: %w", err)
+	}
+	if revoked != nil {
+		if err := revokeUserSessions(ctx, tx, userID); err != nil {
+			return User{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return User{}, fmt.Errorf("failed to commit session revocation: %w", err)
+		}
+		return User{}, errInvalidRefreshToken
+	}
+	if now.Unix() >= expiresAt {
+		return User{}, errInvalidRefreshToken
+	}
+
+	u, err := getUser(ctx, tx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	if u.DisabledAt != nil {
+		return User{}, errInvalidRefreshToken
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
+		return User{}, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, fmt.Errorf("failed to commit refresh token use: %w", err)
+	}
+	return u, nil
+}
+
+// revokeRefreshToken ends the session of a refresh token, if it is still active
+func revokeRefreshToken(ctx context.Context, db dbtx, secret string) error {
+	_, err := db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND revoked_at IS NULL", hashAPIKey(secret))
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	return nil
+}
+
+// revokeUserSessions revokes every active refresh token of a user
+func revokeUserSessions(ctx context.Context, db dbtx, userID int) error {
+	_, err := db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL", userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// currentUser returns the session claims Authenticate stored on the context
+func currentUser(c *gin.Context) (Claims, bool) {
+	claims, ok := c.Get(userKey)
+	if !ok {
+		return Claims{}, false
+	}
+	return claims.(Claims), true
+}
+
+// activeSession checks the claims of an access token against the account as
+// it is now, so a disabled account is locked out and a changed role applies
+// right away rather than once the token expires
+func activeSession(ctx context.Context, db dbtx, claims Claims) (Claims, error) {
+	u, err := getUser(ctx, db, claims.UserID)
+	if err == errUserNotFound {
+		return Claims{}, errInvalidToken
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+	if u.DisabledAt != nil {
+		return Claims{}, errInvalidToken
+	}
+	claims.Username, claims.Role = u.Username, u.Role
+	return claims, nil
+}
+
+// RequireRole rejects requests that don't come from a user session with at
+// least role. API keys are rejected too, whatever their scopes.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := currentUser(c)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a user session is required, log in at POST /auth/login"})
+			return
+		}
+		if !roleAtLeast(claims.Role, role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("the %s role is required", role)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRoleOrScope lets through user sessions with at least role and API
+// keys granting scope, for routes open to more roles than the scope maps to
+func RequireRoleOrScope(role, scope string) gin.HandlerFunc {
+	requireScope := RequireScope(scope)
+	return func(c *gin.Context) {
+		if claims, ok := currentUser(c); ok && roleAtLeast(claims.Role, role) {
+			c.Next()
+			return
+		}
+		requireScope(c)
+	}
+}
+
+// tokenResponse is returned by login and refresh
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	User         User   `json:"user"`
+}
+
+// issueTokens starts a new session for the user
+func issueTokens(ctx context.Context, db dbtx, s *Sessions, u User) (tokenResponse, error) {
+	access, err := s.issueAccessToken(u)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refresh, err := createRefreshToken(ctx, db, u.ID, s.now().Add(s.RefreshTTL))
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.AccessTTL.Seconds()),
+		RefreshToken: refresh,
+		User:         u,
+	}, nil
+}
+
+// Login exchanges {"username", "password"} for an access token and a refresh token
+func Login(db *sql.DB, s *Sessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+
+		u, err := checkLogin(c.Request.Context(), db, strings.TrimSpace(req.Username), req.Password)
+		if err == errInvalidLogin {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp, err := issueTokens(c.Request.Context(), db, s, u)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// Refresh exchanges {"refresh_token"} for a new access token and refresh
+// token, picking up any change to the user's role
+func Refresh(db *sql.DB, s *Sessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+
+		u, err := useRefreshToken(c.Request.Context(), db, req.RefreshToken, s.now())
+		if err == errInvalidRefreshToken {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp, err := issueTokens(c.Request.Context(), db, s, u)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// Logout revokes {"refresh_token"}. The access token stays valid until it expires.
+func Logout(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if err := revokeRefreshToken(c.Request.Context(), db, req.RefreshToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// GetCurrentUser returns the account of the session making the request
+func GetCurrentUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, _ := currentUser(c)
+		u, err := getUser(c.Request.Context(), db, claims.UserID)
+		if err != nil {
+			c.JSON(userStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, u)
+	}
+}
+
+// userIDParam parses the :id route parameter of the user admin routes
+func userIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// userStatus maps an error from a user store function to its HTTP status code
+func userStatus(err error) int {
+	var inputErr userInputError
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errDuplicateUser):
+		return http.StatusConflict
+	case errors.As(err, &inputErr):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ListUsers lists every account
+func ListUsers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		users, err := listUsers(c.Request.Context(), db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, users)
+	}
+}
+
+// CreateUser creates an account from {"username", "password", "role"}
+func CreateUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		username := strings.TrimSpace(req.Username)
+		if username == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "username cannot be empty"})
+			return
+		}
+		if req.Role == "" {
+			req.Role = RoleViewer
+		}
+
+		u, err := createUser(c.Request.Context(), db, username, req.Password, req.Role)
+		if err != nil {
+			c.JSON(userStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, u)
+	}
+}
+
+// UpdateUser changes an account's role or password, or disables it
+func UpdateUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		var upd UserUpdate
+		if err := c.ShouldBindJSON(&upd); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+
+		u, err := updateUser(c.Request.Context(), db, id, upd)
+		if err != nil {
+			c.JSON(userStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, u)
+	}
+}
+
+// DisableUser disables an account and ends its sessions
+func DisableUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		disabled := true
+		if _, err := updateUser(c.Request.Context(), db, id, UserUpdate{Disabled: &disabled}); err != nil {
+			c.JSON(userStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
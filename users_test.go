@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// login logs a user in and returns the decoded token response
+func login(t *testing.T, h http.Handler, username, password string) tokenResponse {
+	t.Helper()
+	w := doRequest(h, http.MethodPost, "/auth/login", `{"username": "`+username+`", "password": "`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login as %s got %d: %s", username, w.Code, w.Body)
+	}
+	var resp tokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestUserSessions(t *testing.T) {
+	db := newTestDB(t)
+	s := testSessions(t)
+	viewer, err := createUser(t.Context(), db, "vera", "password1", RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUser(t.Context(), db, "ed", "password2", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUser(t.Context(), db, "cole", "password4", RoleContributor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUser(t.Context(), db, "ED", "password3", RoleViewer); err != errDuplicateUser {
+		t.Errorf("creating ED after ed returned %v, want errDuplicateUser", err)
+	}
+
+	r := gin.New()
+	r.Use(Authenticate(db, s))
+	r.POST("/auth/login", Login(db, s))
+	r.POST("/auth/refresh", Refresh(db, s))
+	r.GET("/auth/me", RequireRole(RoleViewer), GetCurrentUser(db))
+	r.POST("/firearms", RequireScope(ScopeWrite), CreateFirearm(db, testWrites))
+	r.GET("/admin/users", RequireRole(RoleAdmin), ListUsers(db))
+	r.POST("/sources", RequireRoleOrScope(RoleContributor, ScopeWrite), CreateSource(db))
+
+	if w := doRequest(r, http.MethodPost, "/auth/login", `{"username": "vera", "password": "wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password got %d, want 401", w.Code)
+	}
+
+	vera := login(t, r, "vera", "password1")
+	ed := login(t, r, "ed", "password2")
+	cole := login(t, r, "cole", "password4")
+	body := `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`
+	sourceBody := `{"title": "Glock 17 manual", "url": "https://example.com/g17.pdf"}`
+	tests := []struct {
+		name           string
+		method, target string
+		token          string
+		want           int
+	}{
+		{"viewer reading their account", http.MethodGet, "/auth/me", vera.AccessToken, http.StatusOK},
+		{"viewer writing", http.MethodPost, "/firearms", vera.AccessToken, http.StatusForbidden},
+		{"editor writing", http.MethodPost, "/firearms", ed.AccessToken, http.StatusCreated},
+		{"editor managing users", http.MethodGet, "/admin/users", ed.AccessToken, http.StatusForbidden},
+		{"contributor writing", http.MethodPost, "/firearms", cole.AccessToken, http.StatusForbidden},
+		{"contributor adding a source", http.MethodPost, "/sources", cole.AccessToken, http.StatusCreated},
+		{"viewer adding a source", http.MethodPost, "/sources", vera.AccessToken, http.StatusForbidden},
+		{"tampered token", http.MethodGet, "/auth/me", vera.AccessToken[:len(vera.AccessToken)-2] + "xx", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		var reqBody string
+		if tt.method == http.MethodPost {
+			reqBody = body
+		}
+		if tt.target == "/sources" {
+			reqBody = sourceBody
+		}
+		if w := doRequest(r, tt.method, tt.target, reqBody, "Authorization", "Bearer "+tt.token); w.Code != tt.want {
+			t.Errorf("%s got %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+
+	// A role change applies to tokens issued before it, and refreshing
+	// picks it up and rotates the refresh token
+	role := RoleEditor
+	if _, err := updateUser(t.Context(), db, viewer.ID, UserUpdate{Role: &role}); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodPost, "/sources", sourceBody, "Authorization", "Bearer "+vera.AccessToken); w.Code != http.StatusCreated {
+		t.Errorf("promoted viewer's old token adding a source got %d, want 201", w.Code)
+	}
+	w := doRequest(r, http.MethodPost, "/auth/refresh", `{"refresh_token": "`+vera.RefreshToken+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh got %d: %s", w.Code, w.Body)
+	}
+	var refreshed tokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.User.Role != RoleEditor || refreshed.RefreshToken == vera.RefreshToken {
+		t.Errorf("refresh answered role %s with refresh token %q, want editor and a new token", refreshed.User.Role, refreshed.RefreshToken)
+	}
+
+	// Replaying the used refresh token ends every session of the user
+	if w := doRequest(r, http.MethodPost, "/auth/refresh", `{"refresh_token": "`+vera.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("reusing a refresh token got %d, want 401", w.Code)
+	}
+	if w := doRequest(r, http.MethodPost, "/auth/refresh", `{"refresh_token": "`+refreshed.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after a replayed token got %d, want 401", w.Code)
+	}
+
+	// Disabled accounts can't log in, and their unexpired tokens stop working
+	disabled := true
+	if _, err := updateUser(t.Context(), db, viewer.ID, UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, "/auth/me", "", "Authorization", "Bearer "+refreshed.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of a disabled account got %d, want 401", w.Code)
+	}
+	if w := doRequest(r, http.MethodPost, "/auth/login", `{"username": "vera", "password": "password1"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("login to a disabled account got %d, want 401", w.Code)
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	s := testSessions(t)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	token, err := s.issueAccessToken(User{ID: 7, Username: "vera", Role: RoleEditor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.verifyAccessToken(token)
+	if err != nil || claims.UserID != 7 || claims.Role != RoleEditor {
+		t.Fatalf("verify returned %+v, %v, want user 7 as editor", claims, err)
+	}
+
+	other, err := NewSessions("another secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.verifyAccessToken(token); err != errInvalidToken {
+		t.Errorf("token signed with another secret returned %v, want errInvalidToken", err)
+	}
+
+	now = now.Add(s.AccessTTL)
+	if _, err := s.verifyAccessToken(token); err != errInvalidToken {
+		t.Errorf("expired token returned %v, want errInvalidToken", err)
+	}
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	if _, err := s.verifyAccessToken(none + token[strings.Index(token, "."):]); err != errInvalidToken {
+		t.Errorf("token with alg none returned %v, want errInvalidToken", err)
+	}
+}
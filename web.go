@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogPageSize is how many firearms a page of the HTML catalog lists
+const catalogPageSize = 25
+
+// maxCompared is how many firearms the compare page puts side by side
+const maxCompared = 6
+
+// catalogSortKeys are the columns of the catalog table that can be sorted
+// by, a subset of the sortOrder keys
+var catalogSortKeys = []string{"brand", "name", "year", "price"}
+
+// catalogListing is a page listing the values of a column, each linking to
+// the catalog filtered by it
+type catalogListing struct {
+	title  string
+	column string
+	param  string
+}
+
+// catalogListings are the listing pages by their path under /catalog
+var catalogListings = map[string]catalogListing{
+	"brands":    {title: "Brands", column: "brand", param: "brand"},
+	"calibers":  {title: "Calibers", column: "caliber", param: "caliber"},
+	"countries": {title: "Countries", column: "country_of_origin", param: "country"},
+}
+
+// catalogFuncs are the helpers the HTML templates use. They have to be set
+// on the router before the templates are loaded.
+var catalogFuncs = template.FuncMap{
+	"label": fieldLabel,
+}
+
+// fieldLabel turns a JSON field name like country_of_origin into Country of origin
+func fieldLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	label := strings.ReplaceAll(name, "_", " ")
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+// fieldRow is one field of some firearms, for showing them side by side
+type fieldRow struct {
+	Name    string
+	Values  []string
+	Differs bool
+}
+
+// firearmFields lays out the fields of firearms in rows, in the order of
+// Firearm, marking the rows whose values differ. The store's bookkeeping
+// fields are left out unless asked for, deleted_at always is.
+func firearmFields(firearms []Firearm, bookkeeping bool) []fieldRow {
+	var rows []fieldRow
+	t := reflect.TypeOf(Firearm{})
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name == "deleted_at" || !bookkeeping && bookkeepingField(name) {
+			continue
+		}
+		row := fieldRow{Name: name, Values: make([]string, len(firearms))}
+		for j, f := range firearms {
+			row.Values[j] = fmt.Sprint(reflect.ValueOf(f).Field(i).Interface())
+			row.Differs = row.Differs || row.Values[j] != row.Values[0]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// renderPage writes an HTML page, with the validators ConditionalCatalog set
+// when it's a success
+func renderPage(c *gin.Context, status int, name string, data gin.H) {
+	if v, ok := c.Get(validatorsKey); ok && status == http.StatusOK {
+		writeValidators(c, v.(Validators))
+	}
+	c.HTML(status, name, data)
+}
+
+// renderErrorPage writes the error page with the status and what went wrong
+func renderErrorPage(c *gin.Context, status int, message string) {
+	renderPage(c, status, "error.html", gin.H{"Title": http.StatusText(status), "Message": message})
+}
+
+// ConditionalCatalog answers catalog pages with 304 Not Modified while
+// neither the firearms nor the citations shown with them have changed
+func ConditionalCatalog(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, err := listValidators(db, c.Request)
+		if err == nil {
+			v, err = withCitationsVersion(c.Request.Context(), db, v)
+		}
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+		c.Set(validatorsKey, v)
+
+		if notModified(c, v) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// catalogFilter reads a FirearmFilter from the query string, which uses the
+// snake_case names of the JSON fields
+func catalogFilter(c *gin.Context) (FirearmFilter, error) {
+	f := FirearmFilter{
+		Brand: c.Query("brand"), Name: c.Query("name"), Caliber: c.Query("caliber"),
+		Type: c.Query("type"), Country: c.Query("country"),
+	}
+	for param, p := range map[string]**int{"year": &f.Year, "min_price": &f.MinPrice, "max_price": &f.MaxPrice} {
+		if raw := strings.TrimSpace(c.Query(param)); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return f, fmt.Errorf("%s must be a whole number", param)
+			}
+			*p = &n
+		}
+	}
+	return f, nil
+}
+
+// withQuery returns the current page's URL with the given query parameters
+// changed, removing those set to ""
+func withQuery(c *gin.Context, changes map[string]string) string {
+	q := c.Request.URL.Query()
+	for k, v := range changes {
+		if v == "" {
+			q.Del(k)
+		} else {
+			q.Set(k, v)
+		}
+	}
+	if len(q) == 0 {
+		return c.Request.URL.Path
+	}
+	return c.Request.URL.Path + "?" + q.Encode()
+}
+
+// CatalogIndex renders the browsable catalog: a page of firearms found with
+// the filters of the list routes and a free text search in ?q, sorted by a
+// column of the table
+func CatalogIndex(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := catalogFilter(c)
+		if err != nil {
+			renderErrorPage(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		sort := c.DefaultQuery("sort", "brand")
+		if !slices.Contains(catalogSortKeys, strings.TrimPrefix(sort, "-")) {
+			renderErrorPage(c, http.StatusBadRequest, "cannot sort by "+sort+", use one of "+strings.Join(catalogSortKeys, ", "))
+			return
+		}
+		orderBy, _ := sortOrder(sort)
+		page := 1
+		if raw := c.Query("page"); raw != "" {
+			if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+				renderErrorPage(c, http.StatusBadRequest, "page must be a positive whole number")
+				return
+			}
+		}
+
+		cond, args := filter.where()
+		query := strings.TrimSpace(c.Query("q"))
+		if words := strings.Fields(query); len(words) > 0 {
+			searchCond, searchArgs := searchWhere(words)
+			if cond != "" {
+				searchCond = cond + " AND " + searchCond
+			}
+			cond, args = searchCond, append(args, searchArgs...)
+		}
+		firearms, total, err := pageFirearms(c.Request.Context(), db, cond, args, orderBy, catalogPageSize, (page-1)*catalogPageSize)
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// The choices of the brand, type and country filters
+		options := gin.H{}
+		for name, column := range map[string]string{"brand": "brand", "type": "type", "country": "country_of_origin"} {
+			counts, err := countsBy(c.Request.Context(), db, column)
+			if err != nil {
+				renderErrorPage(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+			values := make([]string, 0, len(counts))
+			for _, count := range counts {
+				if count.Value != "" {
+					values = append(values, count.Value)
+				}
+			}
+			slices.Sort(values)
+			options[name] = values
+		}
+
+		// Headers sort by their column, the current one flips direction
+		sortLinks := gin.H{}
+		for _, key := range catalogSortKeys {
+			next := key
+			if sort == key {
+				next = "-" + key
+			}
+			sortLinks[key] = withQuery(c, map[string]string{"sort": next, "page": ""})
+		}
+		pages := max((total+catalogPageSize-1)/catalogPageSize, 1)
+		data := gin.H{
+			"Title":     "Catalog",
+			"Query":     query,
+			"Filter":    c.Request.URL.Query(),
+			"Options":   options,
+			"Firearms":  firearms,
+			"Total":     total,
+			"Page":      page,
+			"Pages":     pages,
+			"Sort":      sort,
+			"SortLinks": sortLinks,
+		}
+		if page > 1 {
+			data["PrevURL"] = withQuery(c, map[string]string{"page": strconv.Itoa(page - 1)})
+		}
+		if page < pages {
+			data["NextURL"] = withQuery(c, map[string]string{"page": strconv.Itoa(page + 1)})
+		}
+		renderPage(c, http.StatusOK, "index.html", data)
+	}
+}
+
+// CatalogFirearm renders everything about one firearm: its fields with the
+// sources they cite, and similar firearms to compare it with
+func CatalogFirearm(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			renderErrorPage(c, http.StatusNotFound, "no firearm with id "+c.Param("id"))
+			return
+		}
+		f, err := getFirearm(c.Request.Context(), db, id)
+		if err == sql.ErrNoRows {
+			renderErrorPage(c, http.StatusNotFound, fmt.Sprintf("no firearm with id %d", id))
+			return
+		}
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, fmt.Sprintf("failed to query database: %v", err))
+			return
+		}
+		cited, err := citationsFor(c.Request.Context(), db, []int{id})
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		similar, err := similarFirearms(c.Request.Context(), db, []Firearm{f}, 5)
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		ids := []string{strconv.Itoa(f.ID)}
+		for _, s := range similar[0] {
+			ids = append(ids, strconv.Itoa(s.ID))
+		}
+		renderPage(c, http.StatusOK, "firearm.html", gin.H{
+			"Title":      f.Brand + " " + f.Name,
+			"Firearm":    f,
+			"Fields":     firearmFields([]Firearm{f}, false),
+			"Sources":    fieldCitations(cited, id),
+			"Similar":    similar[0],
+			"CompareURL": "/catalog/compare?ids=" + strings.Join(ids[:min(len(ids), maxCompared)], ","),
+		})
+	}
+}
+
+// CatalogListing renders the brands, calibers or countries of the catalog
+// with how many firearms each has, linking to the catalog filtered by them
+func CatalogListing(db *sql.DB, path string) gin.HandlerFunc {
+	listing := catalogListings[path]
+	type item struct {
+		Value string
+		Count int32
+		URL   string
+	}
+	return func(c *gin.Context) {
+		counts, err := countsBy(c.Request.Context(), db, listing.column)
+		if err != nil {
+			renderErrorPage(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var items []item
+		for _, count := range counts {
+			if count.Value != "" {
+				items = append(items, item{count.Value, count.Count, "/catalog?" + url.Values{listing.param: {count.Value}}.Encode()})
+			}
+		}
+		slices.SortFunc(items, func(a, b item) int { return strings.Compare(a.Value, b.Value) })
+		renderPage(c, http.StatusOK, "listing.html", gin.H{"Title": listing.title, "Items": items})
+	}
+}
+
+// CatalogCompare renders firearms side by side, taking their IDs from
+// ?ids=1,2 or repeated ?ids= as the catalog's compare form sends them
+func CatalogCompare(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ids []int
+		for _, raw := range c.QueryArray("ids") {
+			for _, part := range strings.Split(raw, ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil {
+					renderErrorPage(c, http.StatusBadRequest, fmt.Sprintf("%q is not a firearm id", part))
+					return
+				}
+				if !slices.Contains(ids, id) {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(ids) < 2 || len(ids) > maxCompared {
+			renderErrorPage(c, http.StatusBadRequest, fmt.Sprintf("pick between 2 and %d firearms to compare", maxCompared))
+			return
+		}
+
+		firearms := make([]Firearm, len(ids))
+		for i, id := range ids {
+			f, err := getFirearm(c.Request.Context(), db, id)
+			if err == sql.ErrNoRows {
+				renderErrorPage(c, http.StatusNotFound, fmt.Sprintf("no firearm with id %d", id))
+				return
+			}
+			if err != nil {
+				renderErrorPage(c, http.StatusInternalServerError, fmt.Sprintf("failed to query database: %v", err))
+				return
+			}
+			firearms[i] = f
+		}
+		renderPage(c, http.StatusOK, "compare.html", gin.H{
+			"Title":    "Compare",
+			"Firearms": firearms,
+			"Fields":   firearmFields(firearms, false),
+		})
+	}
+}
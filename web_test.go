@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newCatalogRouter serves the HTML catalog pages over db with the templates in public/
+func newCatalogRouter(db *sql.DB) *gin.Engine {
+	r := gin.New()
+	r.SetFuncMap(catalogFuncs)
+	r.LoadHTMLGlob("public/*.html")
+	catalog := r.Group("/catalog", ConditionalCatalog(db))
+	catalog.GET("", CatalogIndex(db))
+	catalog.GET("/firearms/:id", CatalogFirearm(db))
+	catalog.GET("/compare", CatalogCompare(db))
+	for path := range catalogListings {
+		catalog.GET("/"+path, CatalogListing(db, path))
+	}
+	return r
+}
+
+func TestCatalogIndex(t *testing.T) {
+	db := newTestDB(t)
+	glock := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	addTestFirearm(t, db, "Glock", "19", 1988, 600)
+	sig := addTestFirearm(t, db, "SIG Sauer", "P226", 1984, 900)
+	r := newCatalogRouter(db)
+
+	w := doRequest(r, http.MethodGet, "/catalog", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "3 firearms, page 1 of 1") || w.Header().Get("ETag") == "" {
+		t.Fatalf("index got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodGet, "/catalog", "", "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("conditional index got %d", w.Code)
+	}
+
+	// The filters match like the list routes, and ?q searches across columns
+	w = doRequest(r, http.MethodGet, "/catalog?brand=glock&min_price=560", "")
+	if body := w.Body.String(); !strings.Contains(body, "1 firearms") || !strings.Contains(body, "Glock 19") || strings.Contains(body, "Glock 17") {
+		t.Errorf("filtered index got %d: %s", w.Code, body)
+	}
+	w = doRequest(r, http.MethodGet, "/catalog?q=sauer+p2", "")
+	if body := w.Body.String(); !strings.Contains(body, fmt.Sprintf(`href="/catalog/firearms/%d"`, sig.ID)) || strings.Contains(body, "Glock 17") {
+		t.Errorf("search got %d: %s", w.Code, body)
+	}
+	w = doRequest(r, http.MethodGet, "/catalog?sort=-price", "")
+	if body := w.Body.String(); strings.Index(body, "P226") > strings.Index(body, "Glock 17") || !strings.Contains(body, `href="/catalog?sort=price"`) {
+		t.Errorf("sorted index got %s", body)
+	}
+
+	for _, target := range []string{"/catalog?year=soon", "/catalog?sort=caliber", "/catalog?page=0"} {
+		if w := doRequest(r, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d", target, w.Code)
+		}
+	}
+
+	// Page links keep the filters
+	for i := range catalogPageSize {
+		addTestFirearm(t, db, "Glock", fmt.Sprintf("Test %d", i), 2000, 500)
+	}
+	w = doRequest(r, http.MethodGet, "/catalog?brand=Glock", "")
+	if body := w.Body.String(); !strings.Contains(body, "page 1 of 2") || !strings.Contains(body, `href="/catalog?brand=Glock&amp;page=2"`) {
+		t.Errorf("first page got %s", body)
+	}
+
+	// Soft deleted firearms are gone from the pages
+	if err := deleteFirearm(t.Context(), db, glock.ID, glock.Version); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(r, http.MethodGet, fmt.Sprintf("/catalog/firearms/%d", glock.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted firearm got %d", w.Code)
+	}
+}
+
+func TestCatalogPages(t *testing.T) {
+	db := newTestDB(t)
+	glock := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	other := addTestFirearm(t, db, "Glock", "19", 1988, 550)
+	sig := addTestFirearm(t, db, "SIG Sauer", "P226", 1984, 900)
+	r := newCatalogRouter(db)
+
+	// Same caliber and type make the others similar
+	w := doRequest(r, http.MethodGet, fmt.Sprintf("/catalog/firearms/%d", glock.ID), "")
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "<h1>Glock 17</h1>") || !strings.Contains(body, "Magazine capacity") ||
+		!strings.Contains(body, fmt.Sprintf("/catalog/compare?ids=%d,%d,%d", glock.ID, other.ID, sig.ID)) {
+		t.Errorf("firearm page got %d: %s", w.Code, body)
+	}
+	if w := doRequest(r, http.MethodGet, "/catalog/firearms/abc", ""); w.Code != http.StatusNotFound {
+		t.Errorf("firearm page for a bad id got %d", w.Code)
+	}
+
+	w = doRequest(r, http.MethodGet, "/catalog/brands", "")
+	if body := w.Body.String(); !strings.Contains(body, `<a href="/catalog?brand=SIG&#43;Sauer">SIG Sauer</a> <span class="count">1</span>`) ||
+		!strings.Contains(body, `<a href="/catalog?brand=Glock">Glock</a> <span class="count">2</span>`) {
+		t.Errorf("brands got %d: %s", w.Code, body)
+	}
+
+	// Only the rows that differ are highlighted
+	w = doRequest(r, http.MethodGet, fmt.Sprintf("/catalog/compare?ids=%d&ids=%d", glock.ID, other.ID), "")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Count(body, `class="differs"`) != 2 || !strings.Contains(body, "<td>1982</td><td>1988</td>") {
+		t.Errorf("compare got %d: %s", w.Code, body)
+	}
+	for target, code := range map[string]int{
+		fmt.Sprintf("/catalog/compare?ids=%d", glock.ID):          http.StatusBadRequest,
+		"/catalog/compare?ids=1,x":                                http.StatusBadRequest,
+		fmt.Sprintf("/catalog/compare?ids=%d,9999", glock.ID):     http.StatusNotFound,
+		fmt.Sprintf("/catalog/compare?ids=%d,%d", sig.ID, sig.ID): http.StatusBadRequest,
+	} {
+		if w := doRequest(r, http.MethodGet, target, ""); w.Code != code {
+			t.Errorf("%s got %d, want %d", target, w.Code, code)
+		}
+	}
+}
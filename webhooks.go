@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookEvents lists every event type a webhook can subscribe to
+var webhookEvents = []string{EventFirearmCreated, EventFirearmUpdated, EventFirearmDeleted}
+
+// Delivery statuses. Dead deliveries ran out of attempts and wait in the
+// dead-letter list until someone retries them.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Webhook is a subscription to catalog change events. Its secret is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID         int      `json:"id"`
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	CreatedAt  string   `json:"created_at"`
+	DisabledAt *string  `json:"disabled_at"`
+}
+
+// WebhookDelivery is one event queued for or sent to one webhook
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  string          `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	CreatedAt      string          `json:"created_at"`
+	DeliveredAt    *string         `json:"delivered_at"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// parseWebhookEvents validates the event types of a subscription, defaulting to all of them
+func parseWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return webhookEvents, nil
+	}
+	var parsed []string
+	for _, e := range events {
+		e = strings.TrimSpace(e)
+		if !slices.Contains(webhookEvents, e) {
+			return nil, fmt.Errorf("unknown event %q, must be one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+		if !slices.Contains(parsed, e) {
+			parsed = append(parsed, e)
+		}
+	}
+	return parsed, nil
+}
+
+// newWebhookSecret generates the secret deliveries are signed with
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// signWebhook computes the X-Webhook-Signature of a delivery: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook's secret
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookColumns lists the webhooks columns in the order scanWebhook expects them
+const webhookColumns = "id, url, events, created_at, disabled_at"
+
+func scanWebhook(s rowScanner) (Webhook, error) {
+	var w Webhook
+	var events string
+	if err := s.Scan(&w.ID, &w.URL, &events, &w.CreatedAt, &w.DisabledAt); err != nil {
+		return Webhook{}, err
+	}
+	w.Events = strings.Split(events, ",")
+	return w, nil
+}
+
+// getWebhook loads a webhook, returning sql.ErrNoRows when it doesn't exist
+func getWebhook(ctx context.Context, db dbtx, id int) (Webhook, error) {
+	return scanWebhook(db.QueryRowContext(ctx, "SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+}
+
+// listWebhooks returns every webhook, disabled ones included
+func listWebhooks(ctx context.Context, db dbtx) ([]Webhook, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+webhookColumns+" FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return webhooks, nil
+}
+
+// createWebhook stores a subscription with already validated events
+func createWebhook(ctx context.Context, db dbtx, rawURL string, events []string, secret string) (Webhook, error) {
+	res, err := db.ExecContext(ctx, "INSERT INTO webhooks (url, events, secret) VALUES (?, ?, ?)", rawURL, strings.Join(events, ","), secret)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to insert webhook: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to read inserted id: %w", err)
+	}
+	return getWebhook(ctx, db, int(id))
+}
+
+// disableWebhook stops deliveries to a webhook, returning sql.ErrNoRows when
+// it doesn't exist or is already disabled
+func disableWebhook(ctx context.Context, db dbtx, id int) error {
+	res, err := db.ExecContext(ctx, "UPDATE webhooks SET disabled_at = CURRENT_TIMESTAMP WHERE id = ? AND disabled_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to disable webhook: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// enqueueWebhookEvent queues an event for every active webhook subscribed to
+// it. It runs on the transaction of the change, so nothing is delivered for
+// changes that roll back and nothing is lost for ones that commit. The event's
+// ID lets receivers drop duplicates.
+func enqueueWebhookEvent(ctx context.Context, db dbtx, ev ChangeEvent) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, events FROM webhooks WHERE disabled_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	var subscribed []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if slices.Contains(strings.Split(events, ","), ev.Type) {
+			subscribed = append(subscribed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+	for _, id := range subscribed {
+		_, err := db.ExecContext(ctx, "INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at) VALUES (?, ?, ?, ?)",
+			id, ev.Type, string(payload), time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
+
+// deliveryColumns lists the webhook_deliveries columns in the order scanDelivery expects them
+const deliveryColumns = `id, webhook_id, event, status, attempts, next_attempt_at, last_status_code,
+	last_error, created_at, delivered_at, payload`
+
+func scanDelivery(s rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var nextAttempt int64
+	var payload string
+	err := s.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &nextAttempt, &d.LastStatusCode,
+		&d.LastError, &d.CreatedAt, &d.DeliveredAt, &payload)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.NextAttemptAt = time.Unix(nextAttempt, 0).UTC().Format(time.RFC3339)
+	d.Payload = json.RawMessage(payload)
+	return d, nil
+}
+
+// listDeliveries returns the deliveries with a status, newest first, either of
+// one webhook or of all of them when webhookID is 0. An empty status matches any.
+func listDeliveries(ctx context.Context, db dbtx, webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries
+		WHERE (? = 0 OR webhook_id = ?) AND (? = '' OR status = ?)
+		ORDER BY id DESC LIMIT ?`, webhookID, webhookID, status, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return deliveries, nil
+}
+
+// retryDelivery puts a dead delivery back in the queue with a fresh set of
+// attempts, returning sql.ErrNoRows when there is no such dead delivery
+func retryDelivery(ctx context.Context, db dbtx, id int, now time.Time) error {
+	res, err := db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?",
+		DeliveryPending, now.Unix(), id, DeliveryDead)
+	if err != nil {
+		return fmt.Errorf("failed to retry webhook delivery: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// WebhookDispatcher sends queued deliveries, to up to Concurrency webhooks at
+// once and at most BatchSize to each per round. A failed delivery is retried
+// after BaseDelay, doubling every attempt up to MaxDelay, and moves to the
+// dead-letter list after MaxAttempts.
+type WebhookDispatcher struct {
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	PollInterval time.Duration
+	Concurrency  int
+	BatchSize    int
+
+	db     *sql.DB
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewWebhookDispatcher returns a dispatcher for the deliveries queued in db
+func NewWebhookDispatcher(db *sql.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		MaxAttempts:  8,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     6 * time.Hour,
+		PollInterval: 2 * time.Second,
+		Concurrency:  8,
+		BatchSize:    100,
+		db:           db,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		now:          time.Now,
+	}
+}
+
+// Run sends due deliveries every PollInterval until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.deliverDue(ctx); err != nil {
+			slog.Error("failed to deliver webhooks", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dueDelivery is a pending delivery along with where to send it
+type dueDelivery struct {
+	id        int
+	webhookID int
+	event     string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverDue makes one attempt at the deliveries that are due, returning how
+// many were attempted. Each webhook gets its deliveries in order, one at a
+// time, while webhooks are sent to in parallel. Once a webhook's receiver
+// fails the rest of its deliveries wait until the failed one is retried, so
+// a slow receiver costs at most one timeout a round and holds up no one else.
+func (d *WebhookDispatcher) deliverDue(ctx context.Context) (int, error) {
+	// A delivery is held back while an earlier one of its webhook is waiting
+	// for a retry, and each webhook gets its own share of the batch
+	now := d.now().Unix()
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, webhook_id, event, payload, attempts, url, secret FROM (
+			SELECT dl.id, dl.webhook_id, dl.event, dl.payload, dl.attempts, w.url, w.secret,
+				ROW_NUMBER() OVER (PARTITION BY dl.webhook_id ORDER BY dl.id) AS n
+			FROM webhook_deliveries dl JOIN webhooks w ON w.id = dl.webhook_id
+			WHERE dl.status = ? AND dl.next_attempt_at <= ? AND w.disabled_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM webhook_deliveries p
+				WHERE p.webhook_id = dl.webhook_id AND p.status = ? AND p.id < dl.id AND p.next_attempt_at > ?))
+		WHERE n <= ? ORDER BY id`, DeliveryPending, now, DeliveryPending, now, max(d.BatchSize, 1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query due deliveries: %w", err)
+	}
+	// Collect the batch first, the results are written on the same database
+	var webhooks []int
+	due := make(map[int][]dueDelivery)
+	for rows.Next() {
+		var dl dueDelivery
+		var payload string
+		if err := rows.Scan(&dl.id, &dl.webhookID, &dl.event, &payload, &dl.attempts, &dl.url, &dl.secret); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		dl.payload = []byte(payload)
+		if _, ok := due[dl.webhookID]; !ok {
+			webhooks = append(webhooks, dl.webhookID)
+		}
+		due[dl.webhookID] = append(due[dl.webhookID], dl)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		attempted int
+		errs      []error
+	)
+	sem := make(chan struct{}, max(d.Concurrency, 1))
+	for _, id := range webhooks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(deliveries []dueDelivery) {
+			defer func() { <-sem; wg.Done() }()
+			n, err := d.deliverInOrder(ctx, deliveries)
+			mu.Lock()
+			defer mu.Unlock()
+			attempted += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}(due[id])
+	}
+	wg.Wait()
+	return attempted, errors.Join(errs...)
+}
+
+// deliverInOrder sends the deliveries of one webhook until one fails,
+// returning how many were attempted. An attempt is recorded even when ctx
+// ends while it is being sent.
+func (d *WebhookDispatcher) deliverInOrder(ctx context.Context, deliveries []dueDelivery) (int, error) {
+	for i, dl := range deliveries {
+		code, sendErr := d.send(ctx, dl)
+		if err := d.recordAttempt(context.WithoutCancel(ctx), dl, code, sendErr); err != nil {
+			return i + 1, err
+		}
+		if sendErr != nil {
+			return i + 1, nil
+		}
+	}
+	return len(deliveries), nil
+}
+
+// send posts a delivery to its webhook, treating anything but a 2xx as a failure
+func (d *WebhookDispatcher) send(ctx context.Context, dl dueDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.url, bytes.NewReader(dl.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gundatabase-webhooks")
+	req.Header.Set("X-Webhook-ID", strconv.Itoa(dl.id))
+	req.Header.Set("X-Webhook-Event", dl.event)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(dl.secret, timestamp, dl.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryDelay is how long to wait after a delivery's nth failed attempt
+func (d *WebhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxDelay)
+}
+
+// recordAttempt stores the outcome of sending a delivery and schedules the next attempt of failed ones
+func (d *WebhookDispatcher) recordAttempt(ctx context.Context, dl dueDelivery, code int, sendErr error) error {
+	attempts := dl.attempts + 1
+	var statusCode any
+	if code != 0 {
+		statusCode = code
+	}
+
+	var err error
+	if sendErr == nil {
+		_, err = d.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL,
+			delivered_at = CURRENT_TIMESTAMP WHERE id = ?`, DeliveryDelivered, attempts, statusCode, dl.id)
+	} else {
+		status := DeliveryPending
+		if attempts >= d.MaxAttempts {
+			status = DeliveryDead
+		}
+		next := d.now().Add(d.retryDelay(attempts)).Unix()
+		_, err = d.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?,
+			last_error = ? WHERE id = ?`, status, attempts, next, statusCode, sendErr.Error(), dl.id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// webhookIDParam parses the :id path parameter, responding with a 400 when it isn't a number
+func webhookIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// ListWebhooks lists every webhook subscription
+func ListWebhooks(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhooks, err := listWebhooks(c.Request.Context(), db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, webhooks)
+	}
+}
+
+// CreateWebhook subscribes {"url", "events", "secret"} to catalog changes. The
+// events default to all of them and a secret is generated when none is given;
+// it is returned once, like an API key.
+func CreateWebhook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+			Secret string   `json:"secret"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		rawURL := strings.TrimSpace(req.URL)
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("url %q must be an absolute http or https URL", rawURL)})
+			return
+		}
+		events, err := parseWebhookEvents(req.Events)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		secret := req.Secret
+		if secret == "" {
+			if secret, err = newWebhookSecret(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		} else if len(secret) < 16 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "secret must be at least 16 characters"})
+			return
+		}
+
+		w, err := createWebhook(c.Request.Context(), db, rawURL, events, secret)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"webhook": w, "secret": secret})
+	}
+}
+
+// DeleteWebhook disables a webhook. Its delivery log is kept.
+func DeleteWebhook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := webhookIDParam(c)
+		if !ok {
+			return
+		}
+		err := disableWebhook(c.Request.Context(), db, id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no active webhook found with id: %d", id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// deliveryLimit is how many deliveries the log endpoints return at most
+const deliveryLimit = 100
+
+// ListWebhookDeliveries is the delivery log of one webhook, newest first,
+// optionally narrowed down with ?status
+func ListWebhookDeliveries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := webhookIDParam(c)
+		if !ok {
+			return
+		}
+		if _, err := getWebhook(c.Request.Context(), db, id); err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no webhook found with id: %d", id)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+			return
+		}
+
+		status := c.Query("status")
+		switch status {
+		case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("status must be %s, %s or %s", DeliveryPending, DeliveryDelivered, DeliveryDead)})
+			return
+		}
+
+		deliveries, err := listDeliveries(c.Request.Context(), db, id, status, deliveryLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// ListDeadLetters lists the deliveries of every webhook that ran out of attempts
+func ListDeadLetters(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deliveries, err := listDeliveries(c.Request.Context(), db, 0, DeliveryDead, deliveryLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// RetryDeadLetter queues a dead delivery again
+func RetryDeadLetter(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := webhookIDParam(c)
+		if !ok {
+			return
+		}
+		err := retryDelivery(c.Request.Context(), db, id, time.Now())
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no dead delivery found with id: %d", id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
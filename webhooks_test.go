@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWebhooks(t *testing.T) {
+	db := newTestDB(t)
+	_, adminSecret, err := createAPIKey(t.Context(), db, "admin", []string{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The receiver checks signatures the way a downstream service would
+	const secret = "receiver shared secret"
+	var received []ChangeEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if r.Header.Get("X-Webhook-Signature") != signWebhook(secret, ts, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var ev ChangeEvent
+		if err := json.Unmarshal(body, &ev); err != nil || ev.Type != r.Header.Get("X-Webhook-Event") {
+			http.Error(w, "bad event", http.StatusBadRequest)
+			return
+		}
+		received = append(received, ev)
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	r := gin.New()
+	r.Use(Authenticate(db, testSessions(t)))
+	admin := r.Group("/admin", RequireScope(ScopeAdmin))
+	admin.POST("/webhooks", CreateWebhook(db))
+	admin.GET("/webhooks/:id/deliveries", ListWebhookDeliveries(db))
+	admin.GET("/dead-letters", ListDeadLetters(db))
+	admin.POST("/dead-letters/:id/retry", RetryDeadLetter(db))
+	r.POST("/firearms", RequireScope(ScopeWrite), CreateFirearm(db, testWrites))
+	r.DELETE("/firearms/:id", RequireScope(ScopeWrite), DeleteFirearm(db, testWrites))
+
+	for _, body := range []string{
+		`{"url": "not a url"}`,
+		`{"url": "https://example.com", "events": ["firearm.renamed"]}`,
+		`{"url": "https://example.com", "secret": "short"}`,
+	} {
+		if w := doRequest(r, http.MethodPost, "/admin/webhooks", body, "X-API-Key", adminSecret); w.Code != http.StatusBadRequest {
+			t.Errorf("creating webhook %s got %d, want 400", body, w.Code)
+		}
+	}
+	for _, body := range []string{
+		fmt.Sprintf(`{"url": %q, "secret": %q}`, receiver.URL, secret),
+		fmt.Sprintf(`{"url": %q, "events": ["firearm.deleted"]}`, failing.URL),
+	} {
+		if w := doRequest(r, http.MethodPost, "/admin/webhooks", body, "X-API-Key", adminSecret); w.Code != http.StatusCreated {
+			t.Fatalf("creating webhook got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	now := time.Now()
+	d := NewWebhookDispatcher(db)
+	d.MaxAttempts = 2
+	d.now = func() time.Time { return now }
+	deliver := func(want int) {
+		t.Helper()
+		n, err := d.deliverDue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("attempted %d deliveries, want %d", n, want)
+		}
+	}
+
+	body := `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`
+	w := doRequest(r, http.MethodPost, "/firearms", body, "X-API-Key", adminSecret)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	// A write that rolls back announces nothing
+	if w := doRequest(r, http.MethodPost, "/firearms", body, "X-API-Key", adminSecret); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate create got %d: %s", w.Code, w.Body)
+	}
+	deliver(1)
+	if len(received) != 1 || received[0].Type != EventFirearmCreated || received[0].After == nil || received[0].After.Name != "17" {
+		t.Fatalf("received %+v", received)
+	}
+
+	if w := doRequest(r, http.MethodDelete, "/firearms/1", "", "X-API-Key", adminSecret, "If-Match", "*"); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+	deliver(2)
+	if len(received) != 2 || received[1].Type != EventFirearmDeleted || received[1].Before == nil {
+		t.Fatalf("received %+v", received)
+	}
+
+	// The failing receiver is retried with backoff, then dead-lettered
+	deliver(0)
+	now = now.Add(d.BaseDelay)
+	deliver(1)
+
+	var deliveries []WebhookDelivery
+	w = doRequest(r, http.MethodGet, "/admin/webhooks/2/deliveries", "", "X-API-Key", adminSecret)
+	if err := json.Unmarshal(w.Body.Bytes(), &deliveries); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != DeliveryDead || deliveries[0].Attempts != 2 || *deliveries[0].LastStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("failing webhook log = %+v", deliveries)
+	}
+
+	var dead []WebhookDelivery
+	w = doRequest(r, http.MethodGet, "/admin/dead-letters", "", "X-API-Key", adminSecret)
+	if err := json.Unmarshal(w.Body.Bytes(), &dead); err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != deliveries[0].ID {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	retry := fmt.Sprintf("/admin/dead-letters/%d/retry", dead[0].ID)
+	if w := doRequest(r, http.MethodPost, retry, "", "X-API-Key", adminSecret); w.Code != http.StatusAccepted {
+		t.Fatalf("retry got %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(r, http.MethodPost, retry, "", "X-API-Key", adminSecret); w.Code != http.StatusNotFound {
+		t.Errorf("retrying a queued delivery got %d, want 404", w.Code)
+	}
+	deliver(1)
+}
+
+func TestWebhooksDisabled(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := createWebhook(t.Context(), db, "https://example.com/hook", webhookEvents, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are still recorded, they just queue nothing
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	if err := recordRevision(t.Context(), db, WriteOptions{Webhooks: false}, "test", RevisionCreate, nil, &f); err != nil {
+		t.Fatal(err)
+	}
+	if n := tableCount(t, db, "firearm_revisions"); n != 1 {
+		t.Errorf("recorded %d revisions with webhooks off, want 1", n)
+	}
+	if n := tableCount(t, db, "webhook_deliveries"); n != 0 {
+		t.Errorf("queued %d deliveries with webhooks off", n)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	d := NewWebhookDispatcher(nil)
+	d.BaseDelay, d.MaxDelay = time.Second, 10*time.Second
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 60: 10 * time.Second} {
+		if got := d.retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestSlowWebhookReceiver(t *testing.T) {
+	db := newTestDB(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	for _, url := range []string{slow.URL, fast.URL} {
+		if _, err := createWebhook(t.Context(), db, url, webhookEvents, "receiver shared secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 3 {
+		f := Firearm{ID: i + 1, Brand: "Glock", Name: strconv.Itoa(17 + i)}
+		if err := enqueueWebhookEvent(t.Context(), db, ChangeEvent{ID: i + 1, Type: EventFirearmCreated, FirearmID: f.ID, After: &f}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The slow receiver times out once and its other deliveries wait, while
+	// the fast one gets all of its own
+	d := NewWebhookDispatcher(db)
+	d.client.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	n, err := d.deliverDue(context.Background())
+	if err != nil || n != 4 {
+		t.Fatalf("deliverDue attempted %d, %v, want 4", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("deliverDue took %s", elapsed)
+	}
+	for webhook, want := range map[int]string{1: DeliveryPending, 2: DeliveryDelivered} {
+		deliveries, err := listDeliveries(t.Context(), db, webhook, want, 10)
+		if err != nil || len(deliveries) != 3 {
+			t.Errorf("webhook %d has %d %s deliveries, %v, want 3", webhook, len(deliveries), want, err)
+		}
+	}
+
+	// The rest of the slow receiver's deliveries are due, but stay behind the
+	// one waiting for its retry
+	if n, err := d.deliverDue(context.Background()); err != nil || n != 0 {
+		t.Errorf("deliverDue before the retry attempted %d, %v, want 0", n, err)
+	}
+}
+
+func TestWebhookBatchPerWebhook(t *testing.T) {
+	db := newTestDB(t)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	enqueue := func(id int) {
+		t.Helper()
+		f := Firearm{ID: id, Brand: "Glock", Name: strconv.Itoa(16 + id)}
+		if err := enqueueWebhookEvent(t.Context(), db, ChangeEvent{ID: id, Type: EventFirearmCreated, FirearmID: id, After: &f}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first webhook has a backlog by the time the second one is added
+	if _, err := createWebhook(t.Context(), db, receiver.URL, webhookEvents, "receiver shared secret"); err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		enqueue(id)
+	}
+	if _, err := createWebhook(t.Context(), db, receiver.URL, webhookEvents, "receiver shared secret"); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(4)
+
+	d := NewWebhookDispatcher(db)
+	d.BatchSize = 2
+	if n, err := d.deliverDue(context.Background()); err != nil || n != 3 {
+		t.Fatalf("deliverDue attempted %d, %v, want 2 for the first webhook and 1 for the second", n, err)
+	}
+	for webhook, want := range map[int]int{1: 2, 2: 1} {
+		deliveries, err := listDeliveries(t.Context(), db, webhook, DeliveryDelivered, 10)
+		if err != nil || len(deliveries) != want {
+			t.Errorf("webhook %d has %d delivered, %v, want %d", webhook, len(deliveries), err, want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errStaleETag is reported when an If-Match value no longer names the current firearm
+var errStaleETag = errors.New("firearm has been modified since it was last fetched")
+
+// FirearmInput is the request body for creating or patching a firearm.
+// Fields left out of the JSON are nil and keep their current value on a patch.
+type FirearmInput struct {
+	Brand            *string  `json:"brand"`
+	Name             *string  `json:"name"`
+	Caliber          *string  `json:"caliber"`
+	Type             *string  `json:"type"`
+	MagazineCapacity *int     `json:"magazine_capacity"`
+	EffectiveRange   *int     `json:"effective_range"`
+	Year             *int     `json:"year"`
+	Price            *int     `json:"price"`
+	Manufacturer     *string  `json:"manufacturer"`
+	Weight           *float64 `json:"weight"`
+	BarrelLength     *float64 `json:"barrel_length"`
+	Action           *string  `json:"action"`
+	CountryOfOrigin  *string  `json:"country_of_origin"`
+}
+
+// requireAll checks that every NOT NULL column is present, as needed when creating a firearm
+func (in FirearmInput) requireAll() error {
+	var missing []string
+	if in.Brand == nil {
+		missing = append(missing, "brand")
+	}
+	if in.Name == nil {
+		missing = append(missing, "name")
+	}
+	if in.Caliber == nil {
+		missing = append(missing, "caliber")
+	}
+	if in.Type == nil {
+		missing = append(missing, "type")
+	}
+	if in.MagazineCapacity == nil {
+		missing = append(missing, "magazine_capacity")
+	}
+	if in.EffectiveRange == nil {
+		missing = append(missing, "effective_range")
+	}
+	if in.Year == nil {
+		missing = append(missing, "year")
+	}
+	if in.Price == nil {
+		missing = append(missing, "price")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// apply copies every non-nil field onto f
+func (in FirearmInput) apply(f *Firearm) {
+	if in.Brand != nil {
+		f.Brand = strings.TrimSpace(*in.Brand)
+	}
+	if in.Name != nil {
+		f.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Caliber != nil {
+		f.Caliber = strings.TrimSpace(*in.Caliber)
+	}
+	if in.Type != nil {
+		f.Type = strings.TrimSpace(*in.Type)
+	}
+	if in.MagazineCapacity != nil {
+		f.MagazineCapacity = *in.MagazineCapacity
+	}
+	if in.EffectiveRange != nil {
+		f.EffectiveRange = *in.EffectiveRange
+	}
+	if in.Year != nil {
+		f.Year = *in.Year
+	}
+	if in.Price != nil {
+		f.Price = *in.Price
+	}
+	if in.Manufacturer != nil {
+		f.Manufacturer = strings.TrimSpace(*in.Manufacturer)
+	}
+	if in.Weight != nil {
+		f.Weight = *in.Weight
+	}
+	if in.BarrelLength != nil {
+		f.BarrelLength = *in.BarrelLength
+	}
+	if in.Action != nil {
+		f.Action = strings.TrimSpace(*in.Action)
+	}
+	if in.CountryOfOrigin != nil {
+		f.CountryOfOrigin = strings.TrimSpace(*in.CountryOfOrigin)
+	}
+}
+
+// validateFirearm checks a firearm is fit to be written
+func validateFirearm(f Firearm) error {
+	switch {
+	case f.Brand == "":
+		return errors.New("brand cannot be empty")
+	case f.Name == "":
+		return errors.New("name cannot be empty")
+	case f.Caliber == "":
+		return errors.New("caliber cannot be empty")
+	case f.Type == "":
+		return errors.New("type cannot be empty")
+	case f.MagazineCapacity < 0:
+		return errors.New("magazine_capacity cannot be negative")
+	case f.EffectiveRange < 0:
+		return errors.New("effective_range cannot be negative")
+	case f.Year < 0:
+		return errors.New("year cannot be negative")
+	case f.Price < 0:
+		return errors.New("price cannot be negative")
+	case f.Weight < 0:
+		return errors.New("weight cannot be negative")
+	case f.BarrelLength < 0:
+		return errors.New("barrel_length cannot be negative")
+	}
+	return nil
+}
+
+// checkIfMatch enforces optimistic concurrency on a write. It responds with
+// 428 when the request has no If-Match header and 412 when the header doesn't
+// match the firearm's current ETag, returning false in both cases.
+func checkIfMatch(c *gin.Context, current Firearm) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header with the firearm's current ETag is required"})
+		return false
+	}
+
+	if ifMatchMatches(ifMatch, current) {
+		return true
+	}
+
+	c.Header("ETag", firearmValidators(current).ETag)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": errStaleETag.Error()})
+	return false
+}
+
+// ifMatchMatches reports whether a comma separated If-Match list names the firearm's current ETag
+func ifMatchMatches(list string, current Firearm) bool {
+	etag := firearmValidators(current).ETag
+	for _, candidate := range strings.Split(list, ",") {
+		// If-Match uses strong comparison, so weak tags never match
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// firearmIDParam parses the :id route parameter, responding with 400 if it isn't an integer
+func firearmIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a valid integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+// loadFirearm fetches the firearm named by :id, responding with 404 or 500 on failure
+func loadFirearm(c *gin.Context, db dbtx) (Firearm, bool) {
+	id, ok := firearmIDParam(c)
+	if !ok {
+		return Firearm{}, false
+	}
+
+	f, err := getFirearm(c.Request.Context(), db, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no firearm found with id: %d", id)})
+		return Firearm{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query database: %v", err)})
+		return Firearm{}, false
+	}
+	return f, true
+}
+
+// writeStatus maps an error from a store write to its HTTP status code
+func writeStatus(err error) int {
+	switch {
+	case errors.Is(err, errVersionConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errDuplicateFirearm):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// saveFirearm writes f over before, which must still be its current version,
+// and records the revision. It returns the row as stored.
+func saveFirearm(ctx context.Context, db dbtx, opts WriteOptions, actor string, before, f Firearm) (Firearm, error) {
+	if err := updateFirearm(ctx, db, f); err != nil {
+		return Firearm{}, err
+	}
+	updated, err := getFirearm(ctx, db, f.ID)
+	if err != nil {
+		return Firearm{}, fmt.Errorf("failed to query database: %w", err)
+	}
+	if err := recordRevision(ctx, db, opts, actor, RevisionUpdate, &before, &updated); err != nil {
+		return Firearm{}, err
+	}
+	return updated, nil
+}
+
+// CreateFirearm adds a new firearm
+func CreateFirearm(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var in FirearmInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if err := in.requireAll(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var f Firearm
+		in.apply(&f)
+		if err := validateFirearm(f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var created Firearm
+		err := inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			id, err := insertFirearm(c.Request.Context(), tx, f)
+			if err != nil {
+				return err
+			}
+			if created, err = getFirearm(c.Request.Context(), tx, id); err != nil {
+				return fmt.Errorf("failed to query database: %w", err)
+			}
+			return recordRevision(c.Request.Context(), tx, opts, actorOf(c), RevisionCreate, nil, &created)
+		})
+		if err != nil {
+			c.JSON(writeStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Location", fmt.Sprintf("/id/%d", created.ID))
+		writeValidators(c, firearmValidators(created))
+		c.JSON(http.StatusCreated, created)
+	}
+}
+
+// UpdateFirearm applies a partial update to a firearm, guarded by If-Match
+func UpdateFirearm(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := loadFirearm(c, db)
+		if !ok || !checkIfMatch(c, f) {
+			return
+		}
+
+		var in FirearmInput
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		before := f
+		in.apply(&f)
+		if err := validateFirearm(f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The version check in the UPDATE catches writes that raced past checkIfMatch
+		var updated Firearm
+		err := inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			var err error
+			updated, err = saveFirearm(c.Request.Context(), tx, opts, actorOf(c), before, f)
+			return err
+		})
+		if err != nil {
+			c.JSON(writeStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		writeValidators(c, firearmValidators(updated))
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// DeleteFirearm removes a firearm, guarded by If-Match
+func DeleteFirearm(db *sql.DB, opts WriteOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := loadFirearm(c, db)
+		if !ok || !checkIfMatch(c, f) {
+			return
+		}
+
+		err := inTx(c.Request.Context(), db, func(tx *sql.Tx) error {
+			if err := deleteFirearm(c.Request.Context(), tx, f.ID, f.Version); err != nil {
+				return err
+			}
+			return recordRevision(c.Request.Context(), tx, opts, actorOf(c), RevisionDelete, &f, nil)
+		})
+		if err != nil {
+			c.JSON(writeStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWritesRequireIfMatch(t *testing.T) {
+	db := newTestDB(t)
+	f := addTestFirearm(t, db, "Glock", "17", 1982, 550)
+	etag := firearmValidators(f).ETag
+	r := gin.New()
+	r.PATCH("/firearms/:id", UpdateFirearm(db, testWrites))
+	r.DELETE("/firearms/:id", DeleteFirearm(db, testWrites))
+
+	patch := `{"price": 600}`
+	tests := []struct {
+		name    string
+		ifMatch string
+		want    int
+	}{
+		{"missing", "", http.StatusPreconditionRequired},
+		{"stale", `"0123456789abcdef0123456789abcdef"`, http.StatusPreconditionFailed},
+		{"weak", "W/" + etag, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		var headers []string
+		if tt.ifMatch != "" {
+			headers = []string{"If-Match", tt.ifMatch}
+		}
+		w := doRequest(r, http.MethodPatch, "/firearms/1", patch, headers...)
+		if w.Code != tt.want {
+			t.Errorf("%s If-Match got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusPreconditionFailed && w.Header().Get("ETag") != etag {
+			t.Errorf("%s If-Match answered with ETag %q, want the current %q", tt.name, w.Header().Get("ETag"), etag)
+		}
+	}
+	if current, err := getFirearm(t.Context(), db, f.ID); err != nil || current.Price != f.Price {
+		t.Fatalf("rejected patches changed the firearm: %+v, %v", current, err)
+	}
+
+	w := doRequest(r, http.MethodPatch, "/firearms/1", patch, "If-Match", `"other", `+etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("matching If-Match got %d: %s", w.Code, w.Body)
+	}
+	var updated Firearm
+	if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Price != 600 || w.Header().Get("ETag") != firearmValidators(updated).ETag {
+		t.Errorf("update answered price %d with ETag %q, want 600 with %q", updated.Price, w.Header().Get("ETag"), firearmValidators(updated).ETag)
+	}
+
+	// The ETag the first writer had is stale now, so a second writer holding it loses
+	if w := doRequest(r, http.MethodDelete, "/firearms/1", "", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with the old ETag got %d, want 412", w.Code)
+	}
+	if w := doRequest(r, http.MethodDelete, "/firearms/1", "", "If-Match", "*"); w.Code != http.StatusNoContent {
+		t.Errorf("delete with If-Match: * got %d, want 204", w.Code)
+	}
+}
+
+func TestCreateFirearm(t *testing.T) {
+	db := newTestDB(t)
+	r := gin.New()
+	r.POST("/firearms", CreateFirearm(db, testWrites))
+
+	body := `{"brand": "Glock", "name": "17", "caliber": "9mm", "type": "pistol",
+		"magazine_capacity": 17, "effective_range": 50, "year": 1982, "price": 550}`
+	w := doRequest(r, http.MethodPost, "/firearms", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	var created Firearm
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if loc := w.Header().Get("Location"); loc != "/id/"+strconv.Itoa(created.ID) {
+		t.Errorf("Location = %q, want /id/%d", loc, created.ID)
+	}
+	if etag := w.Header().Get("ETag"); etag != firearmValidators(created).ETag {
+		t.Errorf("ETag = %q, want %q", etag, firearmValidators(created).ETag)
+	}
+
+	if w := doRequest(r, http.MethodPost, "/firearms", body); w.Code != http.StatusConflict {
+		t.Errorf("creating the same brand and name again got %d, want 409", w.Code)
+	}
+	if w := doRequest(r, http.MethodPost, "/firearms", `{"brand": "Colt"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "missing required fields") {
+		t.Errorf("create without required fields got %d: %s, want 400 naming them", w.Code, w.Body)
+	}
+}